@@ -43,10 +43,26 @@ func main() {
 	viper.SetDefault("tsdb.bufsize", 128)
 	viper.SetDefault("tsdb.awstimestream.region", "us-east-1")
 	viper.SetDefault("tsdb.awstimestream.maxretries", 3)
+	viper.SetDefault("tsdb.influxdb.timeout_seconds", 10)
+	viper.SetDefault("tsdb.timescaledb.schema", "public")
+	viper.SetDefault("tsdb.timescaledb.hypertable", true)
+	viper.SetDefault("tsdb.file.format", "json")
+	viper.SetDefault("tsdb.file.rotate", "hourly")
+	viper.SetDefault("tsdb.clickhouse.timeout_seconds", 10)
+	viper.SetDefault("tsdb.opensearch.timeout_seconds", 10)
+	viper.SetDefault("tsdb.opensearch.max_retries", 3)
+	viper.SetDefault("tsdb.opensearch.index_date_format", "2006.01.02")
 	viper.SetDefault("pubsub.enabled", false)
 	viper.SetDefault("pubsub.debug", false)
 	viper.SetDefault("pubsub.driver", "kafka")
 	viper.SetDefault("pubsub.kafka.async", true)
+	viper.SetDefault("pubsub.mqtt.qos", 1)
+	viper.SetDefault("pubsub.mqtt.timeout_seconds", 10)
+	viper.SetDefault("pubsub.mqtt.flush_wait_seconds", 5)
+	viper.SetDefault("pubsub.nats.timeout_seconds", 10)
+	viper.SetDefault("pubsub.nats.flush_wait_seconds", 5)
+	viper.SetDefault("pubsub.redis.maxlen", 100000)
+	viper.SetDefault("pubsub.redis.timeout_seconds", 10)
 	viper.SetDefault("pubsub.bufsize", 128)
 
 	// Read Configuration File Before Start
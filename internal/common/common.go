@@ -1,6 +1,11 @@
 package common
 
+import (
+	"time"
+)
+
 type MistApiData struct {
-	Origin	string
-	Data	string
+	Origin		string
+	Data		string
+	RecvTime	time.Time
 }
@@ -301,6 +301,7 @@ func (s *PollAgent) doPublish(data string) {
 	out := common.MistApiData {
 		Origin: s.Uri,
 		Data: data,
+		RecvTime: time.Now(),
 	}
 
 	s.Out <-out
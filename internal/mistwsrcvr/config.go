@@ -11,11 +11,45 @@ type Config struct {
 		Driver			string	  `mapstructure:"driver"`
 		Debug			bool	  `mapstructure:"debug"`
 		BufSize			int	  `mapstructure:"channel_buffer_size"`
-		Awstimestream		struct {
-			Region		string	  `mapstructure:"aws_region"`
-			Database	string	  `mapstructure:"database"`
-			Maxretries	int	  `mapstructure:"max_retries"`
-		}                                 `mapstructure:"aws_timestream"`
+		Batch			struct {
+			MaxRecords	int	  `mapstructure:"max_records"`
+			MaxBytes	int	  `mapstructure:"max_bytes"`
+			MaxLatency	int	  `mapstructure:"max_latency_ms"`
+		}                                 `mapstructure:"batch"`
+		DeadLetter		struct {
+			Driver		string	  `mapstructure:"driver"`
+			Path		string	  `mapstructure:"path"`
+			Topic		string	  `mapstructure:"topic"`
+		}                                 `mapstructure:"dead_letter"`
+		Wal			struct {
+			Path		string	  `mapstructure:"path"`
+			MaxBytes	int64	  `mapstructure:"max_bytes"`
+			MaxBackoff	int	  `mapstructure:"max_backoff_seconds"`
+		}                                 `mapstructure:"wal"`
+		Cardinality		struct {
+			MaxSeries	int	  `mapstructure:"max_series"`
+			Action		string	  `mapstructure:"action"`
+			Ttl		int	  `mapstructure:"ttl_hours"`
+			LogInterval	int	  `mapstructure:"log_interval_seconds"`
+		}                                 `mapstructure:"cardinality"`
+		Awstimestream		ConfigTsdbAwsTimestream	`mapstructure:"aws_timestream"`
+		Influxdb		ConfigTsdbInfluxdb	`mapstructure:"influxdb"`
+		Timescaledb		ConfigTsdbTimescaledb	`mapstructure:"timescaledb"`
+		File			ConfigTsdbFile		`mapstructure:"file"`
+		Clickhouse		ConfigTsdbClickhouse	`mapstructure:"clickhouse"`
+		Opensearch		ConfigTsdbOpensearch	`mapstructure:"opensearch"`
+		Backends		[]struct {
+			Name		string	  `mapstructure:"name"`
+			Driver		string	  `mapstructure:"driver"`
+			Channels	[]string  `mapstructure:"channels"`
+			QueueSize	int	  `mapstructure:"queue_size"`
+			Awstimestream	ConfigTsdbAwsTimestream	`mapstructure:"aws_timestream"`
+			Influxdb	ConfigTsdbInfluxdb	`mapstructure:"influxdb"`
+			Timescaledb	ConfigTsdbTimescaledb	`mapstructure:"timescaledb"`
+			File		ConfigTsdbFile		`mapstructure:"file"`
+			Clickhouse	ConfigTsdbClickhouse	`mapstructure:"clickhouse"`
+			Opensearch	ConfigTsdbOpensearch	`mapstructure:"opensearch"`
+		}                                 `mapstructure:"backends"`
 	}                                         `mapstructure:"tsdb"`
 	Pubsub struct {
 		Enabled			bool	  `mapstructure:"enabled"`
@@ -33,17 +67,88 @@ type Config struct {
 			}			  `mapstructure:"client_options"`
 			FlushWait	int	  `mapstructure:"flush_wait_seconds"`
 		}                                 `mapstructure:"kafka"`
+		Mqtt struct {
+			Brokers		[]string  `mapstructure:"brokers"`
+			Clientid	string	  `mapstructure:"client_id"`
+			CidUseHostname	bool	  `mapstructure:"client_id_use_hostname"`
+			Username	string	  `mapstructure:"username"`
+			Password	string	  `mapstructure:"password"`
+			Qos		int	  `mapstructure:"qos"`
+			Retain		bool	  `mapstructure:"retain"`
+			Tls		ConfigPubsubTls	  `mapstructure:"tls"`
+			Timeout		int	  `mapstructure:"timeout_seconds"`
+			FlushWait	int	  `mapstructure:"flush_wait_seconds"`
+		}                                 `mapstructure:"mqtt"`
+		Nats struct {
+			Servers		[]string  `mapstructure:"servers"`
+			Clientid	string	  `mapstructure:"client_id"`
+			CidUseHostname	bool	  `mapstructure:"client_id_use_hostname"`
+			Username	string	  `mapstructure:"username"`
+			Password	string	  `mapstructure:"password"`
+			Token		string	  `mapstructure:"token"`
+			CredsFile	string	  `mapstructure:"creds_file"`
+			Tls		ConfigPubsubTls	  `mapstructure:"tls"`
+			JetStream	bool	  `mapstructure:"jetstream"`
+			Timeout		int	  `mapstructure:"timeout_seconds"`
+			FlushWait	int	  `mapstructure:"flush_wait_seconds"`
+		}                                 `mapstructure:"nats"`
+		Redis struct {
+			Addr		string	  `mapstructure:"addr"`
+			Username	string	  `mapstructure:"username"`
+			Password	string	  `mapstructure:"password"`
+			Db		int	  `mapstructure:"db"`
+			Tls		ConfigPubsubTls	  `mapstructure:"tls"`
+			MaxLen		int64	  `mapstructure:"maxlen"`
+			MaxLenExact	bool	  `mapstructure:"maxlen_exact"`
+			Timeout		int	  `mapstructure:"timeout_seconds"`
+		}                                 `mapstructure:"redis"`
 	}                                         `mapstructure:"pubsub"`
+	Stats struct {
+		Listen			string	  `mapstructure:"listen"`
+	}                                         `mapstructure:"stats"`
+	Privacy struct {
+		KeyFile			string	  `mapstructure:"key_file"`
+		KeyEnv			string	  `mapstructure:"key_env"`
+	}                                         `mapstructure:"privacy"`
 	Datasource []struct {
 		Channel			string	  `mapstructure:"channel"`
 		Datalayout		string	  `mapstructure:"data_layout"`
+		Privacy			[]struct {
+			Field		string	  `mapstructure:"field"`
+			Action		string	  `mapstructure:"action"`
+		}                                 `mapstructure:"privacy"`
 		Tsdb			struct {
 			Table		string	  `mapstructure:"table"`
+			RecordType	string	  `mapstructure:"record_type"`
+			MeasureName	string	  `mapstructure:"measure_name"`
+			TimeKey		string	  `mapstructure:"time_key"`
+			TimeUnit	string	  `mapstructure:"time_unit"`
+			MemoryRetentionHours	int	`mapstructure:"memory_retention_hours"`
+			MagneticRetentionDays	int	`mapstructure:"magnetic_retention_days"`
+			MagneticStoreWrites	*bool	`mapstructure:"magnetic_store_writes"`
+			PartitionKey		string	`mapstructure:"partition_key"`
+			PartitionKeyRequired	bool	`mapstructure:"partition_key_required"`
 			Keys		[]string  `mapstructure:"keys"`
 			Metrics		[]struct {
 				Key	string	  `mapstructure:"key"`
 				Type	string	  `mapstructure:"type"`
 			}                         `mapstructure:"metrics"`
+			Derive		struct {
+				Counters	[]string  `mapstructure:"counters"`
+				Mode		string	  `mapstructure:"mode"`
+				KeepRaw		bool	  `mapstructure:"keep_raw"`
+				ResetKey	string	  `mapstructure:"reset_key"`
+			}                         `mapstructure:"derive"`
+			Dedup		struct {
+				Window		int	  `mapstructure:"window_seconds"`
+				Heartbeat	int	  `mapstructure:"heartbeat_minutes"`
+				UseTtl		bool	  `mapstructure:"use_ttl"`
+			}                         `mapstructure:"dedup"`
+			Aggregate	struct {
+				Window		int	  `mapstructure:"window_seconds"`
+				Grace		int	  `mapstructure:"grace_seconds"`
+				Functions	[]string  `mapstructure:"functions"`
+			}                         `mapstructure:"aggregate"`
 		}                                 `mapstructure:"tsdb"`
 		Pubsub			struct {
 			Topic		string	  `mapstructure:"topic"`
@@ -51,6 +156,64 @@ type Config struct {
 				Key	string	  `mapstructure:"key"`
 				Value	string	  `mapstructure:"value"`
 			}			  `mapstructure:"header"`
+			Keys		[]string  `mapstructure:"keys"`
 		}                                 `mapstructure:"pubsub"`
 	}                                         `mapstructure:"datasource"`
 }
+
+// driver settings, shared by the tsdb block and its backends list
+type ConfigTsdbAwsTimestream struct {
+	Region		string	  `mapstructure:"aws_region"`
+	Database	string	  `mapstructure:"database"`
+	Maxretries	int	  `mapstructure:"max_retries"`
+	RawMaxChunks	int	  `mapstructure:"raw_max_chunks"`
+}
+
+type ConfigTsdbInfluxdb struct {
+	Url		string	  `mapstructure:"url"`
+	Org		string	  `mapstructure:"org"`
+	Bucket		string	  `mapstructure:"bucket"`
+	Token		string	  `mapstructure:"token"`
+	Timeout		int	  `mapstructure:"timeout_seconds"`
+}
+
+type ConfigTsdbTimescaledb struct {
+	Dsn		string	  `mapstructure:"dsn"`
+	Schema		string	  `mapstructure:"schema"`
+	Hypertable	*bool	  `mapstructure:"hypertable"`
+}
+
+type ConfigTsdbFile struct {
+	Path		string	  `mapstructure:"path"`
+	Format		string	  `mapstructure:"format"`
+	Rotate		string	  `mapstructure:"rotate"`
+	MaxBytes	int64	  `mapstructure:"max_bytes"`
+	Gzip		bool	  `mapstructure:"gzip"`
+	Retention	int	  `mapstructure:"retention"`
+}
+
+type ConfigTsdbClickhouse struct {
+	Url		string	  `mapstructure:"url"`
+	Database	string	  `mapstructure:"database"`
+	User		string	  `mapstructure:"user"`
+	Password	string	  `mapstructure:"password"`
+	Timeout		int	  `mapstructure:"timeout_seconds"`
+	TtlDays		int	  `mapstructure:"ttl_days"`
+}
+
+type ConfigTsdbOpensearch struct {
+	Url		string	  `mapstructure:"url"`
+	User		string	  `mapstructure:"user"`
+	Password	string	  `mapstructure:"password"`
+	Timeout		int	  `mapstructure:"timeout_seconds"`
+	MaxRetries	int	  `mapstructure:"max_retries"`
+	IndexDate	string	  `mapstructure:"index_date_format"`
+}
+
+type ConfigPubsubTls struct {
+	Enabled		bool	  `mapstructure:"enabled"`
+	CaFile		string	  `mapstructure:"ca_file"`
+	CertFile	string	  `mapstructure:"cert_file"`
+	KeyFile		string	  `mapstructure:"key_file"`
+	SkipVerify	bool	  `mapstructure:"insecure_skip_verify"`
+}
@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/yumyudai/misttools/internal/common"
+	"github.com/yumyudai/misttools/internal/privacy"
 	"github.com/yumyudai/misttools/internal/wsclient"
 	"github.com/yumyudai/misttools/internal/tsdb"
 	"github.com/yumyudai/misttools/internal/pubsub"
@@ -49,16 +50,106 @@ func New(cfg Config) (*Rcvr, error) {
 		return nil, err
 	}
 
+	// Privacy transforms, shared by TSDB and PubSub
+	var privacyRules []privacy.PrivacyConfRule
+	var privacyDSs []privacy.PrivacyConfDS
+	for _, v := range(cfg.Datasource) {
+		for _, p := range(v.Privacy) {
+			rule := privacy.PrivacyConfRule {
+				Channel:	v.Channel,
+				Field:		p.Field,
+				Action:		p.Action,
+			}
+
+			privacyRules = append(privacyRules, rule)
+		}
+
+		// fields read after the transform, rules must leave them decodable
+		ds := privacy.PrivacyConfDS {
+			Channel:	v.Channel,
+		}
+		if cfg.Tsdb.Enabled {
+			ds.Typed = tsdb.LayoutTypedFields(v.Datalayout)
+			ds.Used = append(ds.Used, v.Tsdb.Keys...)
+			for _, m := range(v.Tsdb.Metrics) {
+				ds.Used = append(ds.Used, m.Key)
+			}
+			ds.Used = append(ds.Used, v.Tsdb.Derive.Counters...)
+			for _, k := range([]string{v.Tsdb.TimeKey, v.Tsdb.PartitionKey, v.Tsdb.Derive.ResetKey}) {
+				if k != "" {
+					ds.Used = append(ds.Used, k)
+				}
+			}
+		}
+		if cfg.Pubsub.Enabled {
+			ds.Used = append(ds.Used, v.Pubsub.Keys...)
+		}
+
+		privacyDSs = append(privacyDSs, ds)
+	}
+
+	privacyConf := privacy.PrivacyConf {
+		KeyFile:	cfg.Privacy.KeyFile,
+		KeyEnv:		cfg.Privacy.KeyEnv,
+		Rules:		privacyRules,
+		Datasource:	privacyDSs,
+	}
+	privacyIntf, err := privacy.New(privacyConf)
+	if err != nil {
+		return nil, err
+	}
+
+	// PubSub data channel, also used for TSDB dead-letter output
+	var pubsubChan chan common.MistApiData
+	if cfg.Pubsub.Enabled {
+		pubsubChan = make(chan common.MistApiData, cfg.Pubsub.BufSize)
+	}
+
 	// TSDB Client Initialization
 	if cfg.Tsdb.Enabled {
 		var tsdbDSs []tsdb.TsdbIntfConfDS
 		for _, v := range(cfg.Datasource) {
+			var metrics []tsdb.TsdbIntfConfDSMetric
+			for _, v := range(v.Tsdb.Metrics) {
+				m := tsdb.TsdbIntfConfDSMetric {
+					Key:	v.Key,
+					Type:	v.Type,
+				}
+
+				metrics = append(metrics, m)
+			}
+
 			ds := tsdb.TsdbIntfConfDS {
 				Channel:	v.Channel,
 				Datalayout:	v.Datalayout,
 				Table:		v.Tsdb.Table,
+				RecordType:	v.Tsdb.RecordType,
+				MeasureName:	v.Tsdb.MeasureName,
+				TimeKey:	v.Tsdb.TimeKey,
+				TimeUnit:	v.Tsdb.TimeUnit,
+				MemoryRetentionHours:	v.Tsdb.MemoryRetentionHours,
+				MagneticRetentionDays:	v.Tsdb.MagneticRetentionDays,
+				MagneticStoreWrites:	v.Tsdb.MagneticStoreWrites,
+				PartitionKey:		v.Tsdb.PartitionKey,
+				PartitionKeyRequired:	v.Tsdb.PartitionKeyRequired,
 				Keys:		v.Tsdb.Keys,
-				Metrics:	v.Tsdb.Metrics,
+				Metrics:	metrics,
+				Derive:		tsdb.TsdbIntfConfDSDerive {
+							Counters:	v.Tsdb.Derive.Counters,
+							Mode:		v.Tsdb.Derive.Mode,
+							KeepRaw:	v.Tsdb.Derive.KeepRaw,
+							ResetKey:	v.Tsdb.Derive.ResetKey,
+						},
+				Dedup:		tsdb.TsdbIntfConfDSDedup {
+							Window:		v.Tsdb.Dedup.Window,
+							Heartbeat:	v.Tsdb.Dedup.Heartbeat,
+							UseTtl:		v.Tsdb.Dedup.UseTtl,
+						},
+				Aggregate:	tsdb.TsdbIntfConfDSAggregate {
+							Window:		v.Tsdb.Aggregate.Window,
+							Grace:		v.Tsdb.Aggregate.Grace,
+							Functions:	v.Tsdb.Aggregate.Functions,
+						},
 			}
 
 			tsdbDSs = append(tsdbDSs, ds)
@@ -73,12 +164,55 @@ func New(cfg Config) (*Rcvr, error) {
 		tsdbConf := tsdb.TsdbIntfConf {
 			Debug:		cfg.Tsdb.Debug,
 			Driver:		cfg.Tsdb.Driver,
+			Batch:		tsdb.TsdbIntfConfBatch {
+						MaxRecords:	cfg.Tsdb.Batch.MaxRecords,
+						MaxBytes:	cfg.Tsdb.Batch.MaxBytes,
+						MaxLatency:	cfg.Tsdb.Batch.MaxLatency,
+					},
+			DeadLetter:	tsdb.TsdbIntfConfDeadLetter {
+						Driver:		cfg.Tsdb.DeadLetter.Driver,
+						Path:		cfg.Tsdb.DeadLetter.Path,
+						DataOutChannel:	pubsubChan,
+					},
+			Privacy:	privacyIntf,
+			Wal:		tsdb.TsdbIntfConfWal {
+						Path:		cfg.Tsdb.Wal.Path,
+						MaxBytes:	cfg.Tsdb.Wal.MaxBytes,
+						MaxBackoff:	cfg.Tsdb.Wal.MaxBackoff,
+					},
+			Cardinality:	tsdb.TsdbIntfConfCardinality {
+						MaxSeries:	cfg.Tsdb.Cardinality.MaxSeries,
+						Action:		cfg.Tsdb.Cardinality.Action,
+						Ttl:		cfg.Tsdb.Cardinality.Ttl,
+						LogInterval:	cfg.Tsdb.Cardinality.LogInterval,
+					},
 			Datasource:	tsdbDSs,
 			DataInChannel:	tsdbChan,
 		}
-		tsdbConf.DriverAwsTimeStream.Region = cfg.Tsdb.Awstimestream.Region
-		tsdbConf.DriverAwsTimeStream.Database = cfg.Tsdb.Awstimestream.Database
-		tsdbConf.DriverAwsTimeStream.MaxRetries = cfg.Tsdb.Awstimestream.Maxretries
+		tsdbConf.DriverAwsTimeStream = tsdbConfAwsTimestream(cfg.Tsdb.Awstimestream)
+		tsdbConf.DriverInfluxDB = tsdbConfInfluxdb(cfg.Tsdb.Influxdb)
+		tsdbConf.DriverTimescaleDB = tsdbConfTimescaledb(cfg.Tsdb.Timescaledb)
+		tsdbConf.DriverFile = tsdbConfFile(cfg.Tsdb.File)
+		tsdbConf.DriverClickHouse = tsdbConfClickhouse(cfg.Tsdb.Clickhouse)
+		tsdbConf.DriverOpenSearch = tsdbConfOpensearch(cfg.Tsdb.Opensearch)
+
+		for _, v := range(cfg.Tsdb.Backends) {
+			b := tsdb.TsdbIntfConfBackend {
+				Name:			v.Name,
+				Driver:			v.Driver,
+				DriverAwsTimeStream:	tsdbConfAwsTimestream(v.Awstimestream),
+				DriverInfluxDB:		tsdbConfInfluxdb(v.Influxdb),
+				DriverTimescaleDB:	tsdbConfTimescaledb(v.Timescaledb),
+				DriverFile:		tsdbConfFile(v.File),
+				DriverClickHouse:	tsdbConfClickhouse(v.Clickhouse),
+				DriverOpenSearch:	tsdbConfOpensearch(v.Opensearch),
+				Channels:		v.Channels,
+				QueueSize:		v.QueueSize,
+			}
+
+			tsdbConf.Backends = append(tsdbConf.Backends, b)
+		}
+
 		r.tsdb, err = tsdb.New(tsdbConf)
 		if err != nil {
 			return nil, err
@@ -103,6 +237,16 @@ func New(cfg Config) (*Rcvr, error) {
 				Channel:	v.Channel,
 				Topic:		v.Pubsub.Topic,
 				Header:		hdr,
+				Keys:		v.Pubsub.Keys,
+			}
+
+			pubsubDSs = append(pubsubDSs, ds)
+		}
+
+		if cfg.Tsdb.Enabled && cfg.Tsdb.DeadLetter.Driver == "pubsub" {
+			ds := pubsub.PubsubIntfTarget {
+				Channel:	tsdb.DEADLETTER_ORIGIN,
+				Topic:		cfg.Tsdb.DeadLetter.Topic,
 			}
 
 			pubsubDSs = append(pubsubDSs, ds)
@@ -125,9 +269,42 @@ func New(cfg Config) (*Rcvr, error) {
 			ClientOpts:	kafkaClientOpts,
 			FlushWait:	cfg.Pubsub.Kafka.FlushWait,
 		}
+		pubsubMqttConf := pubsub.PubsubIntfConfDrvMqtt {
+			Brokers:	cfg.Pubsub.Mqtt.Brokers,
+			Clientid:	cfg.Pubsub.Mqtt.Clientid,
+			CidUseHostname:	cfg.Pubsub.Mqtt.CidUseHostname,
+			Username:	cfg.Pubsub.Mqtt.Username,
+			Password:	cfg.Pubsub.Mqtt.Password,
+			Qos:		cfg.Pubsub.Mqtt.Qos,
+			Retain:		cfg.Pubsub.Mqtt.Retain,
+			Tls:		pubsubConfTls(cfg.Pubsub.Mqtt.Tls),
+			Timeout:	cfg.Pubsub.Mqtt.Timeout,
+			FlushWait:	cfg.Pubsub.Mqtt.FlushWait,
+		}
+		pubsubNatsConf := pubsub.PubsubIntfConfDrvNats {
+			Servers:	cfg.Pubsub.Nats.Servers,
+			Clientid:	cfg.Pubsub.Nats.Clientid,
+			CidUseHostname:	cfg.Pubsub.Nats.CidUseHostname,
+			Username:	cfg.Pubsub.Nats.Username,
+			Password:	cfg.Pubsub.Nats.Password,
+			Token:		cfg.Pubsub.Nats.Token,
+			CredsFile:	cfg.Pubsub.Nats.CredsFile,
+			Tls:		pubsubConfTls(cfg.Pubsub.Nats.Tls),
+			JetStream:	cfg.Pubsub.Nats.JetStream,
+			Timeout:	cfg.Pubsub.Nats.Timeout,
+			FlushWait:	cfg.Pubsub.Nats.FlushWait,
+		}
+		pubsubRedisConf := pubsub.PubsubIntfConfDrvRedis {
+			Addr:		cfg.Pubsub.Redis.Addr,
+			Username:	cfg.Pubsub.Redis.Username,
+			Password:	cfg.Pubsub.Redis.Password,
+			Db:		cfg.Pubsub.Redis.Db,
+			Tls:		pubsubConfTls(cfg.Pubsub.Redis.Tls),
+			MaxLen:		cfg.Pubsub.Redis.MaxLen,
+			MaxLenExact:	cfg.Pubsub.Redis.MaxLenExact,
+			Timeout:	cfg.Pubsub.Redis.Timeout,
+		}
 
-
-		pubsubChan := make(chan common.MistApiData, cfg.Pubsub.BufSize)
 		err = r.client.AddDataChannel(pubsubChan)
 		if err != nil {
 			return nil, err
@@ -137,6 +314,10 @@ func New(cfg Config) (*Rcvr, error) {
 			Debug:		cfg.Pubsub.Debug,
 			Driver:		cfg.Pubsub.Driver,
 			DriverKafka:	pubsubKafkaConf,
+			DriverMqtt:	pubsubMqttConf,
+			DriverNats:	pubsubNatsConf,
+			DriverRedis:	pubsubRedisConf,
+			Privacy:	privacyIntf,
 			Datasource:	pubsubDSs,
 			DataInChannel:	pubsubChan,
 		}
@@ -151,6 +332,16 @@ func New(cfg Config) (*Rcvr, error) {
 
 func (r *Rcvr) Run() error {
 	var shutdownSigs []chan struct{}
+
+	// Stats endpoint
+	if r.cfg.Stats.Listen != "" {
+		srv, err := r.startStats()
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+
 	// Launch
 	clientShutdownSig := make(chan struct{}, 1)
 	shutdownSigs = append(shutdownSigs, clientShutdownSig)
@@ -183,3 +374,116 @@ func (r *Rcvr) Run() error {
 
 	return nil
 }
+
+// list entries do not get viper defaults, fill them here
+func tsdbConfAwsTimestream(c ConfigTsdbAwsTimestream) tsdb.TsdbIntfConfDrvAwsTS {
+	r := tsdb.TsdbIntfConfDrvAwsTS {
+		Region:		c.Region,
+		Database:	c.Database,
+		MaxRetries:	c.Maxretries,
+		RawMaxChunks:	c.RawMaxChunks,
+	}
+
+	if r.Region == "" {
+		r.Region = "us-east-1"
+	}
+	if r.MaxRetries < 1 {
+		r.MaxRetries = 3
+	}
+
+	return r
+}
+
+func tsdbConfInfluxdb(c ConfigTsdbInfluxdb) tsdb.TsdbIntfConfDrvInfluxDB {
+	r := tsdb.TsdbIntfConfDrvInfluxDB {
+		Url:		c.Url,
+		Org:		c.Org,
+		Bucket:		c.Bucket,
+		Token:		c.Token,
+		Timeout:	c.Timeout,
+	}
+
+	if r.Timeout < 1 {
+		r.Timeout = 10
+	}
+
+	return r
+}
+
+func tsdbConfTimescaledb(c ConfigTsdbTimescaledb) tsdb.TsdbIntfConfDrvTimescaleDB {
+	r := tsdb.TsdbIntfConfDrvTimescaleDB {
+		Dsn:		c.Dsn,
+		Schema:		c.Schema,
+		Hypertable:	true,
+	}
+
+	if r.Schema == "" {
+		r.Schema = "public"
+	}
+	// pointer tells an explicit false apart from an unset key
+	if c.Hypertable != nil {
+		r.Hypertable = *c.Hypertable
+	}
+
+	return r
+}
+
+func tsdbConfFile(c ConfigTsdbFile) tsdb.TsdbIntfConfDrvFile {
+	return tsdb.TsdbIntfConfDrvFile {
+		Path:		c.Path,
+		Format:		c.Format,
+		Rotate:		c.Rotate,
+		MaxBytes:	c.MaxBytes,
+		Gzip:		c.Gzip,
+		Retention:	c.Retention,
+	}
+}
+
+func tsdbConfClickhouse(c ConfigTsdbClickhouse) tsdb.TsdbIntfConfDrvClickHouse {
+	r := tsdb.TsdbIntfConfDrvClickHouse {
+		Url:		c.Url,
+		Database:	c.Database,
+		User:		c.User,
+		Password:	c.Password,
+		Timeout:	c.Timeout,
+		TtlDays:	c.TtlDays,
+	}
+
+	if r.Timeout < 1 {
+		r.Timeout = 10
+	}
+
+	return r
+}
+
+func tsdbConfOpensearch(c ConfigTsdbOpensearch) tsdb.TsdbIntfConfDrvOpenSearch {
+	r := tsdb.TsdbIntfConfDrvOpenSearch {
+		Url:		c.Url,
+		User:		c.User,
+		Password:	c.Password,
+		Timeout:	c.Timeout,
+		MaxRetries:	c.MaxRetries,
+		IndexDate:	c.IndexDate,
+	}
+
+	if r.Timeout < 1 {
+		r.Timeout = 10
+	}
+	if r.MaxRetries < 1 {
+		r.MaxRetries = 3
+	}
+
+	return r
+}
+
+func pubsubConfTls(c ConfigPubsubTls) pubsub.PubsubIntfConfTls {
+	r := pubsub.PubsubIntfConfTls {
+		Enabled:	c.Enabled,
+		CaFile:		c.CaFile,
+		CertFile:	c.CertFile,
+		KeyFile:	c.KeyFile,
+		SkipVerify:	c.SkipVerify,
+	}
+
+	return r
+}
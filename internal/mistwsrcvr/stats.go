@@ -0,0 +1,54 @@
+package mistwsrcvr
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/yumyudai/misttools/internal/tsdb"
+)
+
+type rcvrStats struct {
+	Tsdb struct {
+		Cardinality	[]tsdb.TsdbCardinalityStat	`json:"cardinality"`
+	}							`json:"tsdb"`
+}
+
+// serves runtime statistics as JSON, listener is opened here so bind errors surface at start
+func (r *Rcvr) startStats() (*http.Server, error) {
+	ln, err := net.Listen("tcp", r.cfg.Stats.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", r.statsHandler)
+
+	srv := &http.Server {
+		Handler:	mux,
+	}
+
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Stats server has thrown error: %v", err)
+		}
+	}()
+
+	log.Printf("Stats server listening on %s", ln.Addr())
+	return srv, nil
+}
+
+func (r *Rcvr) statsHandler(w http.ResponseWriter, req *http.Request) {
+	var s rcvrStats
+	if r.tsdb != nil {
+		s.Tsdb.Cardinality = r.tsdb.CardinalityStats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s)
+	if err != nil {
+		log.Printf("Failed to write stats: %v", err)
+	}
+}
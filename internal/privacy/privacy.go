@@ -0,0 +1,188 @@
+package privacy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type PrivacyConf struct {
+	KeyFile		string
+	KeyEnv		string
+	Rules		[]PrivacyConfRule
+	Datasource	[]PrivacyConfDS
+}
+
+// fields of a datasource read by the stages after the transform
+type PrivacyConfDS struct {
+	Channel		string
+	Used		[]string
+	Typed		[]string
+}
+
+type PrivacyConfRule struct {
+	Channel		string
+	Field		string
+	Action		string
+}
+
+const (
+	ACTION_HMAC	= "hmac"
+	ACTION_OUI	= "oui"
+	ACTION_REDACT	= "redact"
+	ACTION_DROP	= "drop"
+)
+
+// value written in place of redacted fields
+const REDACTED = "redacted"
+
+type Privacy struct {
+	key		[]byte
+	rules		map[string][]PrivacyConfRule
+}
+
+func New(cfg PrivacyConf) (*Privacy, error) {
+	r := &Privacy {
+		rules:	make(map[string][]PrivacyConfRule),
+	}
+
+	dss := make(map[string]PrivacyConfDS)
+	for _, v := range cfg.Datasource {
+		dss[v.Channel] = v
+	}
+
+	needKey := false
+	for _, v := range cfg.Rules {
+		if v.Channel == "" || v.Field == "" {
+			return nil, fmt.Errorf("Missing channel or field in privacy rule")
+		}
+
+		v.Action = strings.ToLower(v.Action)
+		switch v.Action {
+		case ACTION_HMAC:
+			needKey = true
+		case ACTION_OUI:
+		case ACTION_REDACT:
+		case ACTION_DROP:
+		default:
+			return nil, fmt.Errorf("Unknown privacy action %s for field %s", v.Action, v.Field)
+		}
+
+		// fail at startup rather than on every message
+		ds := dss[v.Channel]
+		if v.Action == ACTION_DROP && contains(ds.Used, v.Field) {
+			return nil, fmt.Errorf("Privacy rule drops field %s on channel %s, but it is used as key, metric or time", v.Field, v.Channel)
+		} else if v.Action != ACTION_DROP && contains(ds.Typed, v.Field) {
+			return nil, fmt.Errorf("Privacy action %s would store a string in non-string field %s on channel %s, only drop is allowed", v.Action, v.Field, v.Channel)
+		}
+
+		r.rules[v.Channel] = append(r.rules[v.Channel], v)
+	}
+
+	// hashing key, file takes precedence over environment
+	if cfg.KeyFile != "" {
+		b, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read privacy key file: %v", err)
+		}
+		r.key = bytes.TrimSpace(b)
+	} else if cfg.KeyEnv != "" {
+		r.key = []byte(os.Getenv(cfg.KeyEnv))
+	}
+
+	if needKey && len(r.key) < 1 {
+		return nil, fmt.Errorf("HMAC privacy rule configured but no key was loaded")
+	}
+
+	return r, nil
+}
+
+// Apply rewrites top-level fields of a JSON payload according to rules for the channel
+func (p *Privacy) Apply(channel string, data string) (string, error) {
+	if p == nil {
+		return data, nil
+	}
+
+	rules, ok := p.rules[channel]
+	if !ok {
+		return data, nil
+	}
+
+	m := make(map[string]interface{})
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&m)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse payload for privacy transform: %v", err)
+	}
+
+	for _, v := range rules {
+		val, ok := m[v.Field]
+		if !ok || val == nil {
+			continue
+		}
+
+		if v.Action == ACTION_DROP {
+			delete(m, v.Field)
+			continue
+		}
+
+		s := fmt.Sprintf("%v", val)
+		if s == "" {
+			continue
+		}
+
+		switch v.Action {
+		case ACTION_HMAC:
+			m[v.Field] = p.hash(s)
+		case ACTION_OUI:
+			m[v.Field] = truncateOui(s)
+		case ACTION_REDACT:
+			m[v.Field] = REDACTED
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func contains(l []string, v string) bool {
+	for _, e := range l {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Privacy) hash(v string) string {
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(v))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// keep first three octets, separators are preserved as given
+func truncateOui(v string) string {
+	n := 0
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') {
+			n++
+			if n == 6 {
+				return v[:i + 1]
+			}
+		}
+	}
+
+	return REDACTED
+}
@@ -0,0 +1,197 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testChannel = "/sites/s1/stats/clients"
+
+func testHash(key string, v string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(v))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestApply(t *testing.T) {
+	t.Setenv("PRIVACY_TEST_KEY", "secret")
+	p, err := New(PrivacyConf {
+		KeyEnv:	"PRIVACY_TEST_KEY",
+		Rules:	[]PrivacyConfRule {
+				{ Channel: testChannel, Field: "mac", Action: "hmac" },
+				{ Channel: testChannel, Field: "ap_mac", Action: "OUI" },
+				{ Channel: testChannel, Field: "hostname", Action: "redact" },
+				{ Channel: testChannel, Field: "username", Action: "drop" },
+				{ Channel: testChannel, Field: "ip", Action: "oui" },
+			},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name	string
+		channel	string
+		data	string
+		want	map[string]interface{}
+		err	bool
+	}{
+		{
+			name:		"all actions",
+			channel:	testChannel,
+			data:		`{"mac":"5c5b35000001","ap_mac":"d4:20:b0:11:22:33","hostname":"laptop","username":"alice","ip":"10.0.0.1","rssi":-61}`,
+			want:		map[string]interface{} {
+						"mac":		testHash("secret", "5c5b35000001"),
+						"ap_mac":	"d4:20:b0",
+						"hostname":	REDACTED,
+						"ip":		REDACTED,
+						"rssi":		json.Number("-61"),
+					},
+		},
+		{
+			name:		"absent, null and empty fields are kept",
+			channel:	testChannel,
+			data:		`{"mac":null,"hostname":"","rssi":-61}`,
+			want:		map[string]interface{} {
+						"mac":		nil,
+						"hostname":	"",
+						"rssi":		json.Number("-61"),
+					},
+		},
+		{
+			name:		"other channel is untouched",
+			channel:	"/sites/s1/stats/devices",
+			data:		`{"mac":"5c5b35000001","username":"alice"}`,
+			want:		map[string]interface{} {
+						"mac":		"5c5b35000001",
+						"username":	"alice",
+					},
+		},
+		{
+			name:		"invalid payload",
+			channel:	testChannel,
+			data:		`not json`,
+			err:		true,
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := p.Apply(tt.channel, tt.data)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		} else if tt.err {
+			continue
+		}
+
+		got := make(map[string]interface{})
+		d := json.NewDecoder(strings.NewReader(out))
+		d.UseNumber()
+		err = d.Decode(&got)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for k, want := range tt.want {
+			if got[k] != want {
+				t.Errorf("%s: field %s is %v, want %v", tt.name, k, got[k], want)
+			}
+		}
+	}
+
+	// nil privacy passes payload through
+	var none *Privacy
+	out, err := none.Apply(testChannel, "not json")
+	if err != nil || out != "not json" {
+		t.Errorf("nil privacy changed payload to %s (%v)", out, err)
+	}
+}
+
+func TestKeyLoading(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "privacy.key")
+	err := os.WriteFile(keyFile, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PRIVACY_TEST_KEY", "from-env")
+
+	tests := []struct {
+		name	string
+		keyFile	string
+		keyEnv	string
+		want	string
+		err	bool
+	}{
+		{ name: "file, trailing newline trimmed", keyFile: keyFile, want: "from-file" },
+		{ name: "environment", keyEnv: "PRIVACY_TEST_KEY", want: "from-env" },
+		{ name: "file takes precedence", keyFile: keyFile, keyEnv: "PRIVACY_TEST_KEY", want: "from-file" },
+		{ name: "missing file", keyFile: filepath.Join(dir, "missing"), err: true },
+		{ name: "empty environment", keyEnv: "PRIVACY_TEST_UNSET", err: true },
+		{ name: "no key", err: true },
+	}
+
+	for _, tt := range tests {
+		p, err := New(PrivacyConf {
+			KeyFile:	tt.keyFile,
+			KeyEnv:		tt.keyEnv,
+			Rules:		[]PrivacyConfRule{{ Channel: testChannel, Field: "mac", Action: ACTION_HMAC }},
+		})
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		} else if tt.err {
+			continue
+		}
+
+		out, _ := p.Apply(testChannel, `{"mac":"a"}`)
+		if out != `{"mac":"` + testHash(tt.want, "a") + `"}` {
+			t.Errorf("%s: hashed with wrong key: %s", tt.name, out)
+		}
+	}
+}
+
+func TestNewValidation(t *testing.T) {
+	t.Setenv("PRIVACY_TEST_KEY", "secret")
+	ds := []PrivacyConfDS {
+		{ Channel: testChannel, Used: []string{"mac", "rssi"}, Typed: []string{"rssi", "dual_band"} },
+	}
+
+	tests := []struct {
+		name	string
+		rule	PrivacyConfRule
+		err	bool
+	}{
+		{ name: "redact string field", rule: PrivacyConfRule { Channel: testChannel, Field: "hostname", Action: "redact" } },
+		{ name: "hash key", rule: PrivacyConfRule { Channel: testChannel, Field: "mac", Action: "hmac" } },
+		{ name: "drop unused field", rule: PrivacyConfRule { Channel: testChannel, Field: "username", Action: "drop" } },
+		{ name: "drop unused typed field", rule: PrivacyConfRule { Channel: testChannel, Field: "dual_band", Action: "drop" } },
+		{ name: "drop key", rule: PrivacyConfRule { Channel: testChannel, Field: "mac", Action: "drop" }, err: true },
+		{ name: "drop metric", rule: PrivacyConfRule { Channel: testChannel, Field: "rssi", Action: "drop" }, err: true },
+		{ name: "redact number", rule: PrivacyConfRule { Channel: testChannel, Field: "rssi", Action: "redact" }, err: true },
+		{ name: "hash bool", rule: PrivacyConfRule { Channel: testChannel, Field: "dual_band", Action: "hmac" }, err: true },
+		{ name: "other channel", rule: PrivacyConfRule { Channel: "/sites/s1/stats/devices", Field: "rssi", Action: "drop" } },
+		{ name: "unknown action", rule: PrivacyConfRule { Channel: testChannel, Field: "hostname", Action: "mask" }, err: true },
+		{ name: "missing field", rule: PrivacyConfRule { Channel: testChannel, Action: "drop" }, err: true },
+	}
+
+	for _, tt := range tests {
+		_, err := New(PrivacyConf {
+			KeyEnv:		"PRIVACY_TEST_KEY",
+			Rules:		[]PrivacyConfRule{tt.rule},
+			Datasource:	ds,
+		})
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
@@ -16,6 +16,10 @@ func (s *pubsubIntfDummy) Close() error {
 	return nil
 }
 
+func (s *pubsubIntfDummy) CheckTopicValue(v string) error {
+	return nil
+}
+
 func (s *pubsubIntfDummy) PublishRaw(target PubsubIntfTarget, data string) error {
 	log.Printf("Publish Target %v Data %s", target, data)	
 	return nil
@@ -127,6 +127,28 @@ func (s *pubsubIntfKafka) Close() error {
 	return nil
 }
 
+// payload is decoded by caller, a missing key field fails the message rather than losing its ordering
+// topic names are limited to ASCII alphanumerics, '.', '_' and '-'
+func (s *pubsubIntfKafka) CheckTopicValue(v string) error {
+	for _, c := range(v) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '_' || c == '-' {
+			continue
+		}
+		return fmt.Errorf("Value %q is not valid in a Kafka topic", v)
+	}
+
+	return nil
+}
+
+func (s *pubsubIntfKafka) buildKafkaKey(target PubsubIntfTarget) ([]byte, error) {
+	key, err := target.payload.Key(target.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("Could not build message key for topic %s: %v", target.Topic, err)
+	}
+
+	return key, nil
+}
+
 func (s *pubsubIntfKafka) PublishRaw(target PubsubIntfTarget, data string) error {
 	if s.debug {
 		log.Printf("Publish data %s to target %v", data, target)
@@ -147,6 +169,16 @@ func (s *pubsubIntfKafka) PublishRaw(target PubsubIntfTarget, data string) error
 		Headers:        msgHeader,
 	}
 
+	// keyed messages of one entity go to the same partition and stay ordered
+	if len(target.Keys) > 0 {
+		key, err := s.buildKafkaKey(target)
+		if err != nil {
+			log.Printf("Failed to publish message: %v", err)
+			return err
+		}
+		msg.Key = key
+	}
+
 	// send
 	if s.cfg.Async {
 		err := s.kafkaProducer.Produce(msg, nil)
@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+// backend keeping published targets, so the driver side can be checked without a broker
+// records published targets, topic values are checked with check if set
+type pubsubTestBackend struct {
+	targets		[]PubsubIntfTarget
+	check		func(string) error
+}
+
+func (b *pubsubTestBackend) PublishRaw(target PubsubIntfTarget, data string) error {
+	b.targets = append(b.targets, target)
+	return nil
+}
+
+func (b *pubsubTestBackend) CheckTopicValue(v string) error {
+	if b.check == nil {
+		return nil
+	}
+
+	return b.check(v)
+}
+
+func (b *pubsubTestBackend) Close() error {
+	return nil
+}
+
+func TestPayloadKey(t *testing.T) {
+	tests := []struct {
+		name	string
+		data	string
+		keys	[]string
+		want	string
+		err	bool
+	}{
+		{ name: "single field", data: `{"mac":"aabbcc","rssi":-61}`, keys: []string{"mac"}, want: "aabbcc" },
+		{ name: "several fields", data: `{"map_id":"m1","mac":"aabbcc"}`, keys: []string{"map_id", "mac"}, want: "m1/aabbcc" },
+		{ name: "number kept as sent", data: `{"id":12345678901234567890}`, keys: []string{"id"}, want: "12345678901234567890" },
+		{ name: "missing field", data: `{"mac":"aabbcc"}`, keys: []string{"map_id", "mac"}, err: true },
+		{ name: "null field", data: `{"mac":null}`, keys: []string{"mac"}, err: true },
+	}
+
+	for _, tt := range tests {
+		payload, err := pubsubPayloadNew(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		key, err := (&pubsubIntfKafka{}).buildKafkaKey(PubsubIntfTarget { Topic: "clients", Keys: tt.keys, payload: payload })
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if string(key) != tt.want {
+			t.Errorf("%s: key %q, want %q", tt.name, key, tt.want)
+		}
+	}
+}
+
+func TestPublishKeyedPayload(t *testing.T) {
+	channel := "/sites/s1/stats/clients"
+	tests := []struct {
+		name	string
+		topic	string
+		keys	[]string
+		data	string
+		decoded	bool
+		err	bool
+	}{
+		{ name: "static topic without keys", topic: "clients", data: `not json` },
+		{ name: "keys", topic: "clients", keys: []string{"mac"}, data: `{"mac":"a"}`, decoded: true },
+		{ name: "keys and template", topic: "clients.{mac}", keys: []string{"mac"}, data: `{"mac":"a"}`, decoded: true },
+		{ name: "keys on invalid payload", topic: "clients", keys: []string{"mac"}, data: `not json`, err: true },
+	}
+
+	for _, tt := range tests {
+		i, err := New(PubsubIntfConf {
+			Driver:		"dummy",
+			Datasource:	[]PubsubIntfTarget {
+						{ Channel: channel, Topic: tt.topic, Keys: tt.keys },
+					},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b := &pubsubTestBackend{}
+		i.backend = b
+
+		err = i.processData(channel, tt.data)
+		if (err != nil) != tt.err {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		} else if tt.err {
+			if len(b.targets) > 0 {
+				t.Errorf("%s: message published despite error", tt.name)
+			}
+			continue
+		}
+
+		if len(b.targets) != 1 {
+			t.Fatalf("%s: got %d messages, want 1", tt.name, len(b.targets))
+		} else if (b.targets[0].payload != nil) != tt.decoded {
+			t.Errorf("%s: payload decoded is %v, want %v", tt.name, b.targets[0].payload != nil, tt.decoded)
+		}
+	}
+}
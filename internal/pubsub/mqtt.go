@@ -0,0 +1,169 @@
+package pubsub
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type PubsubIntfConfDrvMqtt struct {
+	Brokers		[]string
+	Clientid	string
+	CidUseHostname	bool
+	Username	string
+	Password	string
+	Qos		int
+	Retain		bool
+	Tls		PubsubIntfConfTls
+	Timeout		int
+	FlushWait	int
+}
+
+type pubsubIntfMqtt struct {
+	cfg		PubsubIntfConfDrvMqtt
+	debug		bool
+	hostname	string
+	timeout		time.Duration
+
+	mqttClient	mqtt.Client
+}
+
+func pubsubIntfMqttNew(cfg PubsubIntfConf) (*pubsubIntfMqtt, error) {
+	var err error
+
+	// start building interface
+	r := &pubsubIntfMqtt {
+		cfg:		cfg.DriverMqtt,
+		debug:		cfg.Debug,
+		timeout:	time.Duration(cfg.DriverMqtt.Timeout) * time.Second,
+	}
+
+	// check valid parameter
+	if len(r.cfg.Brokers) < 1 {
+		return nil, fmt.Errorf("MQTT broker not specified")
+	}
+
+	if r.cfg.Qos < 0 || r.cfg.Qos > 2 {
+		return nil, fmt.Errorf("MQTT QoS must be 0, 1 or 2")
+	}
+
+	if r.timeout <= 0 {
+		return nil, fmt.Errorf("MQTT timeout is below 1")
+	}
+
+	// MQTT 3.1.1 has no message headers, fail instead of silently dropping them
+	for _, v := range(cfg.Datasource) {
+		if len(v.Header) > 0 {
+			return nil, fmt.Errorf("MQTT does not support message headers, remove header from channel %s", v.Channel)
+		}
+	}
+
+	// client id, broker drops older session when another client connects with same id
+	r.hostname = r.cfg.Clientid
+	if r.cfg.CidUseHostname {
+		r.hostname, err = os.Hostname()
+		if err != nil {
+			log.Printf("client_id_use_hostname is true but could not get hostname: %v", err)
+			return nil, err
+		}
+	} else if r.hostname == "" {
+		err = fmt.Errorf("client_id_use_hostname is false but client_id is not specified")
+		return nil, err
+	}
+
+	// ready
+	err = r.initMqttClient()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("MQTT client ready: %v", r.cfg.Brokers)
+
+	return r, nil
+}
+
+func (s *pubsubIntfMqtt) buildMqttClientOpts() (*mqtt.ClientOptions, error) {
+	r := mqtt.NewClientOptions()
+	for _, v := range(s.cfg.Brokers) {
+		r.AddBroker(v)
+	}
+	r.SetClientID(s.hostname)
+	r.SetUsername(s.cfg.Username)
+	r.SetPassword(s.cfg.Password)
+	r.SetConnectTimeout(s.timeout)
+	r.SetWriteTimeout(s.timeout)
+	r.SetAutoReconnect(true)
+
+	if s.cfg.Tls.Enabled {
+		t, err := pubsubTlsConf(s.cfg.Tls)
+		if err != nil {
+			return nil, err
+		}
+		r.SetTLSConfig(t)
+	}
+
+	r.SetOnConnectHandler(func(_ mqtt.Client) {
+		log.Printf("MQTT Event: connected to broker")
+	})
+	r.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("MQTT Event: connection lost (%v)", err)
+	})
+
+	return r, nil
+}
+
+func (s *pubsubIntfMqtt) initMqttClient() error {
+	opts, err := s.buildMqttClientOpts()
+	if err != nil {
+		return err
+	}
+
+	// first connect must succeed, auto reconnect only takes over after that
+	s.mqttClient = mqtt.NewClient(opts)
+	token := s.mqttClient.Connect()
+	if !token.WaitTimeout(s.timeout) {
+		s.mqttClient.Disconnect(0)
+		return fmt.Errorf("Timed out connecting to MQTT broker %v", s.cfg.Brokers)
+	} else if token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+func (s *pubsubIntfMqtt) Close() error {
+	// quiesce lets in-flight messages complete before disconnecting
+	s.mqttClient.Disconnect(uint(s.cfg.FlushWait * 1000))
+
+	return nil
+}
+
+// wildcards are only allowed in subscriptions, a broker drops the connection on such a publish
+func (s *pubsubIntfMqtt) CheckTopicValue(v string) error {
+	if strings.ContainsAny(v, "+#\x00") {
+		return fmt.Errorf("Value %q is not valid in an MQTT topic", v)
+	}
+
+	return nil
+}
+
+func (s *pubsubIntfMqtt) PublishRaw(target PubsubIntfTarget, data string) error {
+	if s.debug {
+		log.Printf("Publish data %s to target %v", data, target)
+	}
+
+	token := s.mqttClient.Publish(target.Topic, byte(s.cfg.Qos), s.cfg.Retain, []byte(data))
+	if !token.WaitTimeout(s.timeout) {
+		err := fmt.Errorf("Timed out publishing to topic %s", target.Topic)
+		log.Printf("Failed to publish message: %v", err)
+		return err
+	} else if token.Error() != nil {
+		log.Printf("Failed to publish message: %v", token.Error())
+		return token.Error()
+	}
+
+	return nil
+}
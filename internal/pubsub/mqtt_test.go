@@ -0,0 +1,208 @@
+package pubsub
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// in-process broker speaking just enough MQTT 3.1.1 for the publisher
+type mqttTestBroker struct {
+	ln		net.Listener
+	connack		byte
+
+	mu		sync.Mutex
+	published	[]*packets.PublishPacket
+}
+
+func mqttTestBrokerNew(t *testing.T, connack byte) *mqttTestBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &mqttTestBroker { ln: ln, connack: connack }
+	go b.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return b
+}
+
+func (b *mqttTestBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *mqttTestBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *mqttTestBroker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = b.connack
+			ack.Write(conn)
+			if b.connack != packets.Accepted {
+				return
+			}
+
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.published = append(b.published, p)
+			b.mu.Unlock()
+
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *mqttTestBroker) messages() []*packets.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]*packets.PublishPacket(nil), b.published...)
+}
+
+func mqttTestConf(broker string, qos int, retain bool) PubsubIntfConf {
+	return PubsubIntfConf {
+		DriverMqtt:	PubsubIntfConfDrvMqtt {
+					Brokers:	[]string{broker},
+					Clientid:	"mistwsrecvd-test",
+					Qos:		qos,
+					Retain:		retain,
+					Timeout:	2,
+				},
+		Datasource:	[]PubsubIntfTarget {
+					{ Channel: "/sites/s1/stats/clients", Topic: "mist/clients" },
+				},
+	}
+}
+
+func TestMqttNewValidation(t *testing.T) {
+	broker := mqttTestBrokerNew(t, packets.Accepted)
+
+	tests := []struct {
+		name	string
+		modify	func(*PubsubIntfConf)
+	}{
+		{ "no broker", func(c *PubsubIntfConf) { c.DriverMqtt.Brokers = nil } },
+		{ "bad qos", func(c *PubsubIntfConf) { c.DriverMqtt.Qos = 3 } },
+		{ "no timeout", func(c *PubsubIntfConf) { c.DriverMqtt.Timeout = 0 } },
+		{ "no client id", func(c *PubsubIntfConf) { c.DriverMqtt.Clientid = "" } },
+		{ "header", func(c *PubsubIntfConf) { c.Datasource[0].Header = []GenericKV{{ Key: "site", Value: "s1" }} } },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mqttTestConf(broker.url(), 1, false)
+			tt.modify(&cfg)
+
+			r, err := pubsubIntfMqttNew(cfg)
+			if err == nil {
+				r.Close()
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestMqttConnectFailure(t *testing.T) {
+	// listener closed right away, nothing accepts connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "tcp://" + ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name	string
+		broker	string
+	}{
+		{ "unreachable", closed },
+		{ "not authorized", mqttTestBrokerNew(t, packets.ErrRefusedNotAuthorised).url() },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			r, err := pubsubIntfMqttNew(mqttTestConf(tt.broker, 1, false))
+			if err == nil {
+				r.Close()
+				t.Fatalf("expected startup to fail")
+			} else if time.Since(start) > 5 * time.Second {
+				t.Errorf("startup took %v to fail", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestMqttPublish(t *testing.T) {
+	tests := []struct {
+		qos	int
+		retain	bool
+	}{
+		{ 0, false },
+		{ 1, false },
+		{ 1, true },
+	}
+
+	for _, tt := range tests {
+		broker := mqttTestBrokerNew(t, packets.Accepted)
+
+		r, err := pubsubIntfMqttNew(mqttTestConf(broker.url(), tt.qos, tt.retain))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = r.PublishRaw(PubsubIntfTarget { Topic: "mist/clients/s1" }, `{"mac":"a"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+
+		// qos 0 has no ack, wait for broker to read it
+		var msgs []*packets.PublishPacket
+		for n := 0; n < 100 && len(msgs) < 1; n++ {
+			msgs = broker.messages()
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if len(msgs) != 1 {
+			t.Fatalf("qos %d: broker got %d messages, want 1", tt.qos, len(msgs))
+		}
+
+		m := msgs[0]
+		if m.TopicName != "mist/clients/s1" || string(m.Payload) != `{"mac":"a"}` ||
+			int(m.Qos) != tt.qos || m.Retain != tt.retain {
+			t.Errorf("qos %d: unexpected message %v %s", tt.qos, m, m.Payload)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+type PubsubIntfConfDrvNats struct {
+	Servers		[]string
+	Clientid	string
+	CidUseHostname	bool
+	Username	string
+	Password	string
+	Token		string
+	CredsFile	string
+	Tls		PubsubIntfConfTls
+	JetStream	bool
+	Timeout		int
+	FlushWait	int
+}
+
+type pubsubIntfNats struct {
+	cfg		PubsubIntfConfDrvNats
+	debug		bool
+	hostname	string
+	timeout		time.Duration
+	drain		time.Duration
+
+	natsConn	*nats.Conn
+	natsJs		jetstream.JetStream
+}
+
+func pubsubIntfNatsNew(cfg PubsubIntfConf) (*pubsubIntfNats, error) {
+	var err error
+
+	// start building interface
+	r := &pubsubIntfNats {
+		cfg:		cfg.DriverNats,
+		debug:		cfg.Debug,
+		timeout:	time.Duration(cfg.DriverNats.Timeout) * time.Second,
+		drain:		time.Duration(cfg.DriverNats.FlushWait) * time.Second,
+	}
+
+	// check valid parameter
+	if len(r.cfg.Servers) < 1 {
+		return nil, fmt.Errorf("NATS server not specified")
+	}
+
+	if r.timeout <= 0 {
+		return nil, fmt.Errorf("NATS timeout is below 1")
+	}
+
+	// same bound for client side drain and our wait on it
+	if r.drain <= 0 {
+		r.drain = nats.DefaultDrainTimeout
+	}
+
+	// client id, only used as connection name shown by server monitoring
+	r.hostname = r.cfg.Clientid
+	if r.cfg.CidUseHostname {
+		r.hostname, err = os.Hostname()
+		if err != nil {
+			log.Printf("client_id_use_hostname is true but could not get hostname: %v", err)
+			return nil, err
+		}
+	} else if r.hostname == "" {
+		err = fmt.Errorf("client_id_use_hostname is false but client_id is not specified")
+		return nil, err
+	}
+
+	// ready
+	err = r.initNatsClient()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("NATS client ready: %s", r.natsConn.ConnectedUrl())
+
+	return r, nil
+}
+
+func (s *pubsubIntfNats) buildNatsClientOpts() ([]nats.Option, error) {
+	r := []nats.Option {
+		nats.Name(s.hostname),
+		nats.Timeout(s.timeout),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("NATS Event: disconnected from server (%v)", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Printf("NATS Event: reconnected to %s", c.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Printf("NATS Event: generic client error occured (%v)", err)
+		}),
+		nats.DrainTimeout(s.drain),
+	}
+
+	if s.cfg.Username != "" {
+		r = append(r, nats.UserInfo(s.cfg.Username, s.cfg.Password))
+	}
+	if s.cfg.Token != "" {
+		r = append(r, nats.Token(s.cfg.Token))
+	}
+	if s.cfg.CredsFile != "" {
+		r = append(r, nats.UserCredentials(s.cfg.CredsFile))
+	}
+
+	if s.cfg.Tls.Enabled {
+		t, err := pubsubTlsConf(s.cfg.Tls)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, nats.Secure(t))
+	}
+
+	return r, nil
+}
+
+func (s *pubsubIntfNats) initNatsClient() error {
+	opts, err := s.buildNatsClientOpts()
+	if err != nil {
+		return err
+	}
+
+	s.natsConn, err = nats.Connect(strings.Join(s.cfg.Servers, ","), opts...)
+	if err != nil {
+		return err
+	}
+
+	// acknowledged publishing, subjects must be bound to a stream on server side
+	if s.cfg.JetStream {
+		s.natsJs, err = jetstream.New(s.natsConn)
+		if err != nil {
+			s.natsConn.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *pubsubIntfNats) Close() error {
+	// drain flushes outstanding messages, bounded by drain timeout
+	err := s.natsConn.Drain()
+	if err != nil {
+		log.Printf("Failed to drain NATS connection: %v", err)
+		s.natsConn.Close()
+		return err
+	}
+
+	deadline := time.Now().Add(s.drain)
+	for !s.natsConn.IsClosed() {
+		if time.Now().After(deadline) {
+			log.Printf("Giving up on drain after %v..", s.drain)
+			s.natsConn.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// value is one subject token, separators and wildcards would change or invalidate the subject
+func (s *pubsubIntfNats) CheckTopicValue(v string) error {
+	if v == "" || strings.ContainsAny(v, ".*>") || strings.IndexFunc(v, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Value %q is not valid in a NATS subject", v)
+	}
+
+	return nil
+}
+
+func (s *pubsubIntfNats) PublishRaw(target PubsubIntfTarget, data string) error {
+	if s.debug {
+		log.Printf("Publish data %s to target %v", data, target)
+	}
+
+	// build message
+	msg := nats.NewMsg(target.Topic)
+	msg.Data = []byte(data)
+	for _, v := range(target.Header) {
+		msg.Header.Add(v.Key, v.Value)
+	}
+
+	// send
+	if s.cfg.JetStream {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+
+		ack, err := s.natsJs.PublishMsg(ctx, msg)
+		if err != nil {
+			log.Printf("Failed to publish message: %v", err)
+			return err
+		} else if s.debug {
+			log.Printf("NATS Event: Delivered message to stream %s at sequence %d", ack.Stream, ack.Sequence)
+		}
+	} else {
+		err := s.natsConn.PublishMsg(msg)
+		if err != nil {
+			log.Printf("Failed to publish message: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
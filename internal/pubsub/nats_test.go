@@ -0,0 +1,223 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// in-process server speaking just enough of the NATS text protocol for the publisher
+type natsTestServer struct {
+	ln		net.Listener
+
+	mu		sync.Mutex
+	published	[]*nats.Msg
+}
+
+func natsTestServerNew(t *testing.T) *natsTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &natsTestServer { ln: ln }
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return s
+}
+
+func (s *natsTestServer) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+func (s *natsTestServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *natsTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,\"max_payload\":1048576}\r\n")
+
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		args := strings.Fields(line)
+		if len(args) < 1 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+
+		case "PUB", "HPUB":
+			// PUB <subject> [reply] <size>, HPUB <subject> [reply] <header size> <total size>
+			hdrLen := 0
+			total, _ := strconv.Atoi(args[len(args) - 1])
+			if args[0] == "HPUB" {
+				hdrLen, _ = strconv.Atoi(args[len(args) - 2])
+			}
+
+			buf := make([]byte, total + 2)
+			_, err = io.ReadFull(rd, buf)
+			if err != nil {
+				return
+			}
+
+			msg := nats.NewMsg(args[1])
+			msg.Data = buf[hdrLen:total]
+			for _, v := range(strings.Split(string(buf[:hdrLen]), "\r\n")[1:]) {
+				kv := strings.SplitN(v, ":", 2)
+				if len(kv) == 2 {
+					msg.Header.Add(kv[0], strings.TrimSpace(kv[1]))
+				}
+			}
+
+			s.mu.Lock()
+			s.published = append(s.published, msg)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *natsTestServer) messages() []*nats.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*nats.Msg(nil), s.published...)
+}
+
+func natsTestConf(server string, flushWait int) PubsubIntfConf {
+	return PubsubIntfConf {
+		DriverNats:	PubsubIntfConfDrvNats {
+					Servers:	[]string{server},
+					Clientid:	"mistwsrecvd-test",
+					Timeout:	2,
+					FlushWait:	flushWait,
+				},
+	}
+}
+
+func TestNatsNew(t *testing.T) {
+	srv := natsTestServerNew(t)
+
+	// listener closed right away, nothing accepts connections
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "nats://" + ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name	string
+		modify	func(*PubsubIntfConf)
+	}{
+		{ "no server", func(c *PubsubIntfConf) { c.DriverNats.Servers = nil } },
+		{ "no timeout", func(c *PubsubIntfConf) { c.DriverNats.Timeout = 0 } },
+		{ "no client id", func(c *PubsubIntfConf) { c.DriverNats.Clientid = "" } },
+		{ "unreachable", func(c *PubsubIntfConf) { c.DriverNats.Servers = []string{closed} } },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := natsTestConf(srv.url(), 1)
+			tt.modify(&cfg)
+
+			r, err := pubsubIntfNatsNew(cfg)
+			if err == nil {
+				r.Close()
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestNatsDrainTimeout(t *testing.T) {
+	srv := natsTestServerNew(t)
+
+	tests := []struct {
+		flushWait	int
+		want		time.Duration
+	}{
+		{ 0, nats.DefaultDrainTimeout },
+		{ 3, 3 * time.Second },
+	}
+
+	for _, tt := range tests {
+		r, err := pubsubIntfNatsNew(natsTestConf(srv.url(), tt.flushWait))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// client gives up on drain at the same point as Close does
+		if r.drain != tt.want || r.natsConn.Opts.DrainTimeout != tt.want {
+			t.Errorf("flush wait %d: drain %v, client drain timeout %v, want %v", tt.flushWait, r.drain, r.natsConn.Opts.DrainTimeout, tt.want)
+		}
+		r.Close()
+	}
+}
+
+func TestNatsPublish(t *testing.T) {
+	srv := natsTestServerNew(t)
+
+	r, err := pubsubIntfNatsNew(natsTestConf(srv.url(), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target	PubsubIntfTarget
+		data	string
+	}{
+		{ PubsubIntfTarget { Topic: "mist.clients" }, `{"mac":"a"}` },
+		{ PubsubIntfTarget { Topic: "mist.clients.s1", Header: []GenericKV{{ Key: "site", Value: "s1" }} }, `{"mac":"b"}` },
+	}
+
+	for _, tt := range tests {
+		err = r.PublishRaw(tt.target, tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// drain flushes everything before the connection closes
+	r.Close()
+
+	msgs := srv.messages()
+	if len(msgs) != len(tests) {
+		t.Fatalf("server got %d messages, want %d", len(msgs), len(tests))
+	}
+
+	for n, tt := range tests {
+		m := msgs[n]
+		if m.Subject != tt.target.Topic || string(m.Data) != tt.data {
+			t.Errorf("message %d: got %s %s, want %s %s", n, m.Subject, m.Data, tt.target.Topic, tt.data)
+		}
+		for _, v := range(tt.target.Header) {
+			if m.Header.Get(v.Key) != v.Value {
+				t.Errorf("message %d: header %s is %q, want %q", n, v.Key, m.Header.Get(v.Key), v.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// separator between values of a key built from several payload fields
+const PAYLOAD_KEY_SEPARATOR = "/"
+
+// top-level fields of a JSON payload, numbers are kept as in the message
+type pubsubPayload map[string]interface{}
+
+func pubsubPayloadNew(data string) (pubsubPayload, error) {
+	r := make(pubsubPayload)
+
+	d := json.NewDecoder(strings.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("Payload is not a JSON object: %v", err)
+	}
+
+	return r, nil
+}
+
+func (p pubsubPayload) GetAsStr(key string) (string, error) {
+	v, ok := p[key]
+	if !ok || v == nil {
+		return "", fmt.Errorf("JSON key %s does not exist", key)
+	}
+
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	}
+
+	// nested values are used as compact JSON
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// joins values of the key fields, so all updates of one entity share the same key
+func (p pubsubPayload) Key(fields []string) ([]byte, error) {
+	var kv []string
+	for _, k := range(fields) {
+		v, err := p.GetAsStr(k)
+		if err != nil {
+			return nil, err
+		}
+		kv = append(kv, v)
+	}
+
+	return []byte(strings.Join(kv, PAYLOAD_KEY_SEPARATOR)), nil
+}
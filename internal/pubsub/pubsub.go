@@ -3,13 +3,16 @@ package pubsub
 import (
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 
 	"github.com/yumyudai/misttools/internal/common"
+	"github.com/yumyudai/misttools/internal/privacy"
 )
 
 type pubsubIntfBackend interface {
 	PublishRaw(PubsubIntfTarget, string) error
+	CheckTopicValue(string) error
 	Close() error
 }
 
@@ -17,6 +20,10 @@ type PubsubIntfConf struct {
 	Debug			bool				`mapstructure:"debug",default:false`
 	Driver			string				`mapstructure:"driver",default:"kafka"`
 	DriverKafka		PubsubIntfConfDrvKafka		`mapstructure:"kafka"`
+	DriverMqtt		PubsubIntfConfDrvMqtt		`mapstructure:"mqtt"`
+	DriverNats		PubsubIntfConfDrvNats		`mapstructure:"nats"`
+	DriverRedis		PubsubIntfConfDrvRedis		`mapstructure:"redis"`
+	Privacy			*privacy.Privacy
 	Datasource		[]PubsubIntfTarget
 	DataInChannel		chan common.MistApiData
 }
@@ -30,6 +37,10 @@ type PubsubIntfTarget struct {
 	Channel		string
 	Topic		string
 	Header		[]GenericKV
+	Keys		[]string
+
+	// decoded message, only set at publish time when templates or keys need it
+	payload		pubsubPayload
 }
 
 type PubsubIntf struct {
@@ -38,14 +49,20 @@ type PubsubIntf struct {
 	dataIn		chan common.MistApiData
 	wg		*sync.WaitGroup
 	topicMap	map[string]PubsubIntfTarget
+	wildcards	[]PubsubIntfTarget
+	tmplMap		map[string]pubsubTargetTemplate
 }
 
+// channel segment matching any single segment of the origin channel
+const CHANNEL_WILDCARD = "*"
+
 func New(cfg PubsubIntfConf) (*PubsubIntf, error) {
 	var err error
 	r := &PubsubIntf {
 		cfg:		cfg,
 		dataIn:		cfg.DataInChannel,
 		topicMap:	make(map[string]PubsubIntfTarget),
+		tmplMap:	make(map[string]pubsubTargetTemplate),
 	}
 
 	for i := 0; i < len(cfg.Datasource); i++ {
@@ -55,7 +72,21 @@ func New(cfg PubsubIntfConf) (*PubsubIntf, error) {
 			return nil, fmt.Errorf("Missing topic for channel %s", cfg.Datasource[i].Channel)
 		}
 
-		r.topicMap[cfg.Datasource[i].Channel] = cfg.Datasource[i]
+		for _, k := range(cfg.Datasource[i].Keys) {
+			if k == "" {
+				return nil, fmt.Errorf("Empty key field for channel %s", cfg.Datasource[i].Channel)
+			}
+		}
+
+		tgt, err := r.buildTarget(cfg.Datasource[i])
+		if err != nil {
+			return nil, err
+		}
+
+		r.topicMap[cfg.Datasource[i].Channel] = tgt
+		if pubsubChannelWildcard(tgt.Channel) {
+			r.wildcards = append(r.wildcards, tgt)
+		}
 	}
 
 	// Init Backend Driver
@@ -66,6 +97,24 @@ func New(cfg PubsubIntfConf) (*PubsubIntf, error) {
 			return nil, err
 		}
 
+	case "mqtt":
+		r.backend, err = pubsubIntfMqttNew(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+	case "nats":
+		r.backend, err = pubsubIntfNatsNew(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+	case "redis":
+		r.backend, err = pubsubIntfRedisNew(cfg)
+		if err != nil {
+			return nil, err
+		}
+
 	case "dummy":
 		r.backend, err = pubsubIntfDummyNew(cfg)
 		if err != nil {
@@ -79,6 +128,114 @@ func New(cfg PubsubIntfConf) (*PubsubIntf, error) {
 	return r, nil
 }
 
+func pubsubChannelWildcard(channel string) bool {
+	for _, v := range(strings.Split(channel, "/")) {
+		if v == CHANNEL_WILDCARD {
+			return true
+		}
+	}
+
+	return false
+}
+
+func pubsubChannelMatch(pattern string, channel string) bool {
+	p := strings.Split(strings.Trim(pattern, "/"), "/")
+	c := strings.Split(strings.Trim(channel, "/"), "/")
+	if len(p) != len(c) {
+		return false
+	}
+
+	for j := 0; j < len(p); j++ {
+		if p[j] != CHANNEL_WILDCARD && p[j] != c[j] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// datasource of the origin channel, an exact one before the first matching wildcard one in config order
+func (i *PubsubIntf) lookupTarget(channel string) (PubsubIntfTarget, bool) {
+	tgt, ok := i.topicMap[channel]
+	if ok {
+		return tgt, true
+	}
+
+	for _, v := range(i.wildcards) {
+		if pubsubChannelMatch(v.Channel, channel) {
+			return v, true
+		}
+	}
+
+	return tgt, false
+}
+
+// templates are parsed once, those with placeholders are kept for publish time
+func (i *PubsubIntf) buildTarget(tgt PubsubIntfTarget) (PubsubIntfTarget, error) {
+	var tmpl pubsubTargetTemplate
+	dynamic := false
+
+	t, err := pubsubTemplateNew(tgt.Topic, tgt.Channel)
+	if err != nil {
+		return tgt, fmt.Errorf("Invalid topic for channel %s: %v", tgt.Channel, err)
+	} else if t.Static() {
+		tgt.Topic, _ = t.Render(tgt.Channel, nil, nil)
+	} else {
+		dynamic = true
+	}
+	tmpl.topic = t
+
+	var hdr []GenericKV
+	for _, v := range(tgt.Header) {
+		t, err := pubsubTemplateNew(v.Value, tgt.Channel)
+		if err != nil {
+			return tgt, fmt.Errorf("Invalid header %s for channel %s: %v", v.Key, tgt.Channel, err)
+		} else if t.Static() {
+			v.Value, _ = t.Render(tgt.Channel, nil, nil)
+		} else {
+			dynamic = true
+		}
+
+		hdr = append(hdr, v)
+		tmpl.header = append(tmpl.header, t)
+	}
+	tgt.Header = hdr
+
+	if dynamic {
+		i.tmplMap[tgt.Channel] = tmpl
+	}
+
+	return tgt, nil
+}
+
+// channel is the origin of the message, values put into the topic must be valid for the driver
+func (i *PubsubIntf) renderTarget(tgt PubsubIntfTarget, channel string, payload pubsubPayload) (PubsubIntfTarget, error) {
+	var err error
+
+	tmpl, ok := i.tmplMap[tgt.Channel]
+	if !ok {
+		return tgt, nil
+	}
+
+	tgt.Topic, err = tmpl.topic.Render(channel, payload, i.backend.CheckTopicValue)
+	if err != nil {
+		return tgt, fmt.Errorf("Could not build topic for channel %s: %v", channel, err)
+	}
+
+	// copy, header slice is shared with configured target
+	hdr := make([]GenericKV, len(tgt.Header))
+	for j, v := range(tgt.Header) {
+		v.Value, err = tmpl.header[j].Render(channel, payload, nil)
+		if err != nil {
+			return tgt, fmt.Errorf("Could not build header %s for channel %s: %v", v.Key, channel, err)
+		}
+		hdr[j] = v
+	}
+	tgt.Header = hdr
+
+	return tgt, nil
+}
+
 func (i *PubsubIntf) Run(wg *sync.WaitGroup, killSig chan struct{}) error {
 	var err error
 
@@ -105,12 +262,31 @@ func (i *PubsubIntf) Run(wg *sync.WaitGroup, killSig chan struct{}) error {
 }
 
 func (i *PubsubIntf) processData(channel string, data string) error {
-	tgt, e := i.topicMap[channel]
+	tgt, e := i.lookupTarget(channel)
 	if !e {
 		return fmt.Errorf("Data received on channel %s, but topic not defined", channel)
 	}
-		
-	err := i.backend.PublishRaw(tgt, data)
+
+	// privacy rules are set per configured channel, same as datasources
+	data, err := i.cfg.Privacy.Apply(tgt.Channel, data)
+	if err != nil {
+		return err
+	}
+
+	// decoded once, shared by templates and message key
+	if tmpl, ok := i.tmplMap[tgt.Channel]; (ok && tmpl.UsesPayload()) || len(tgt.Keys) > 0 {
+		tgt.payload, err = pubsubPayloadNew(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	tgt, err = i.renderTarget(tgt, channel, tgt.payload)
+	if err != nil {
+		return err
+	}
+
+	err = i.backend.PublishRaw(tgt, data)
 	return err
 }
 
@@ -0,0 +1,154 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type PubsubIntfConfDrvRedis struct {
+	Addr		string
+	Username	string
+	Password	string
+	Db		int
+	Tls		PubsubIntfConfTls
+	MaxLen		int64
+	MaxLenExact	bool
+	Timeout		int
+}
+
+// stream field holding the message payload, headers are stored as fields next to it
+const REDIS_DATA_FIELD = "data"
+
+type pubsubIntfRedis struct {
+	cfg		PubsubIntfConfDrvRedis
+	debug		bool
+	timeout		time.Duration
+
+	redisClient	*redis.Client
+}
+
+func pubsubIntfRedisNew(cfg PubsubIntfConf) (*pubsubIntfRedis, error) {
+	var err error
+
+	// start building interface
+	r := &pubsubIntfRedis {
+		cfg:		cfg.DriverRedis,
+		debug:		cfg.Debug,
+		timeout:	time.Duration(cfg.DriverRedis.Timeout) * time.Second,
+	}
+
+	// check valid parameter
+	if r.cfg.Addr == "" {
+		return nil, fmt.Errorf("Redis address not specified")
+	}
+
+	if r.cfg.MaxLen < 0 {
+		return nil, fmt.Errorf("Redis stream max length is negative")
+	}
+
+	if r.timeout <= 0 {
+		return nil, fmt.Errorf("Redis timeout is below 1")
+	}
+
+	// header with payload field name would overwrite the payload in the stream entry
+	for _, v := range(cfg.Datasource) {
+		for _, h := range(v.Header) {
+			if h.Key == REDIS_DATA_FIELD {
+				return nil, fmt.Errorf("Redis header key %s is reserved for payload, rename header on channel %s", REDIS_DATA_FIELD, v.Channel)
+			}
+		}
+	}
+
+	// ready
+	err = r.initRedisClient()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Redis client ready: %s", r.cfg.Addr)
+
+	return r, nil
+}
+
+func (s *pubsubIntfRedis) initRedisClient() error {
+	opts := &redis.Options {
+		Addr:		s.cfg.Addr,
+		Username:	s.cfg.Username,
+		Password:	s.cfg.Password,
+		DB:		s.cfg.Db,
+		DialTimeout:	s.timeout,
+		ReadTimeout:	s.timeout,
+		WriteTimeout:	s.timeout,
+	}
+
+	if s.cfg.Tls.Enabled {
+		t, err := pubsubTlsConf(s.cfg.Tls)
+		if err != nil {
+			return err
+		}
+		opts.TLSConfig = t
+	}
+
+	s.redisClient = redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	err := s.redisClient.Ping(ctx).Err()
+	if err != nil {
+		s.redisClient.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (s *pubsubIntfRedis) Close() error {
+	return s.redisClient.Close()
+}
+
+// stream keys are binary safe
+func (s *pubsubIntfRedis) CheckTopicValue(v string) error {
+	return nil
+}
+
+func (s *pubsubIntfRedis) PublishRaw(target PubsubIntfTarget, data string) error {
+	if s.debug {
+		log.Printf("Publish data %s to target %v", data, target)
+	}
+
+	// build message
+	var values []interface{}
+	for _, v := range(target.Header) {
+		values = append(values, v.Key, v.Value)
+	}
+	values = append(values, REDIS_DATA_FIELD, data)
+
+	// approximate trimming lets redis drop whole nodes, which is much cheaper
+	// ref. https://redis.io/docs/latest/commands/xadd/
+	args := &redis.XAddArgs {
+		Stream:		target.Topic,
+		Values:		values,
+	}
+	if s.cfg.MaxLen > 0 {
+		args.MaxLen = s.cfg.MaxLen
+		args.Approx = !s.cfg.MaxLenExact
+	}
+
+	// send
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	id, err := s.redisClient.XAdd(ctx, args).Result()
+	if err != nil {
+		log.Printf("Failed to publish message: %v", err)
+		return err
+	} else if s.debug {
+		log.Printf("Redis Event: Added message to stream %s with id %s", target.Topic, id)
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// in-process server speaking just enough RESP2 for the publisher, every command is recorded
+// ref. https://redis.io/docs/latest/develop/reference/protocol-spec/
+type redisTestServer struct {
+	ln		net.Listener
+
+	mu		sync.Mutex
+	commands	[][]string
+}
+
+func redisTestServerNew(t *testing.T) *redisTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &redisTestServer { ln: ln }
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+
+	return s
+}
+
+func (s *redisTestServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *redisTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	rd := bufio.NewReader(conn)
+	for seq := 1; ; seq++ {
+		args, err := redisTestReadCommand(rd)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+
+		// HELLO is refused so the client stays on RESP2
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "+PONG\r\n")
+		case "XADD":
+			id := fmt.Sprintf("1700000000000-%d", seq)
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(id), id)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// reads one command sent as array of bulk strings
+func redisTestReadCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	} else if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err = rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size + 2)
+		_, err = io.ReadFull(rd, buf)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+
+	return args, nil
+}
+
+func (s *redisTestServer) xadds() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var r [][]string
+	for _, v := range(s.commands) {
+		if strings.ToUpper(v[0]) == "XADD" {
+			r = append(r, v)
+		}
+	}
+
+	return r
+}
+
+func redisTestConf(addr string) PubsubIntfConf {
+	return PubsubIntfConf {
+		DriverRedis:	PubsubIntfConfDrvRedis {
+					Addr:		addr,
+					Timeout:	2,
+				},
+	}
+}
+
+func TestRedisNewValidation(t *testing.T) {
+	tests := []struct {
+		name	string
+		modify	func(*PubsubIntfConf)
+	}{
+		{ "no address", func(c *PubsubIntfConf) { c.DriverRedis.Addr = "" } },
+		{ "negative max length", func(c *PubsubIntfConf) { c.DriverRedis.MaxLen = -1 } },
+		{ "no timeout", func(c *PubsubIntfConf) { c.DriverRedis.Timeout = 0 } },
+		{ "header on payload field", func(c *PubsubIntfConf) { c.Datasource[1].Header = []GenericKV{{ Key: REDIS_DATA_FIELD, Value: "x" }} } },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := PubsubIntfConf {
+				DriverRedis:	PubsubIntfConfDrvRedis {
+							Addr:		"127.0.0.1:6379",
+							Timeout:	1,
+						},
+				Datasource:	[]PubsubIntfTarget {
+							{ Channel: "/sites/s1/stats/clients", Topic: "clients", Header: []GenericKV{{ Key: "site", Value: "s1" }} },
+							{ Channel: "/sites/s1/stats/devices", Topic: "devices" },
+						},
+			}
+			tt.modify(&cfg)
+
+			// rejected before any connection attempt
+			r, err := pubsubIntfRedisNew(cfg)
+			if err == nil {
+				r.Close()
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestRedisPublish(t *testing.T) {
+	srv := redisTestServerNew(t)
+
+	target := PubsubIntfTarget {
+		Topic:	"mist:clients",
+		Header:	[]GenericKV {
+				{ Key: "site", Value: "s1" },
+				{ Key: "source", Value: "mist" },
+			},
+	}
+
+	tests := []struct {
+		name	string
+		maxLen	int64
+		exact	bool
+		target	PubsubIntfTarget
+		want	string
+	}{
+		{
+			name:	"approximate trimming",
+			maxLen:	1000,
+			target:	target,
+			want:	`xadd mist:clients maxlen ~ 1000 * site s1 source mist data {"mac":"a"}`,
+		},
+		{
+			name:	"exact trimming",
+			maxLen:	1000,
+			exact:	true,
+			target:	target,
+			want:	`xadd mist:clients maxlen 1000 * site s1 source mist data {"mac":"a"}`,
+		},
+		{
+			name:	"no trimming without headers",
+			target:	PubsubIntfTarget { Topic: "mist:devices" },
+			want:	`xadd mist:devices * data {"mac":"a"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		cfg := redisTestConf(srv.ln.Addr().String())
+		cfg.DriverRedis.MaxLen = tt.maxLen
+		cfg.DriverRedis.MaxLenExact = tt.exact
+
+		r, err := pubsubIntfRedisNew(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := len(srv.xadds())
+		err = r.PublishRaw(tt.target, `{"mac":"a"}`)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// headers go first as their own fields, payload is always the last field
+		xadds := srv.xadds()
+		if len(xadds) != before + 1 {
+			t.Fatalf("%s: server got %d XADD, want %d", tt.name, len(xadds) - before, 1)
+		}
+		got := strings.Join(xadds[before], " ")
+		if got != tt.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package pubsub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// placeholder prefix referring to a segment of the channel path, counted from 1
+const TEMPLATE_CHANNEL_PREFIX = "channel."
+
+// topic or header value with {field} placeholders taken from the payload
+// and {channel.N} placeholders taken from the channel the message arrived on
+type pubsubTemplate struct {
+	parts		[]pubsubTemplatePart
+}
+
+type pubsubTemplatePart struct {
+	literal		string
+	field		string
+	segment		int
+}
+
+// per channel templates, only kept for targets referring to payload fields
+type pubsubTargetTemplate struct {
+	topic		*pubsubTemplate
+	header		[]*pubsubTemplate
+}
+
+// channel is the configured one, a wildcard segment matches exactly one segment of the origin
+// so placeholder positions can be checked here and filled in at publish time
+func pubsubTemplateNew(s string, channel string) (*pubsubTemplate, error) {
+	r := &pubsubTemplate{}
+	segments := strings.Split(strings.Trim(channel, "/"), "/")
+
+	var literal string
+	for len(s) > 0 {
+		start := strings.IndexAny(s, "{}")
+		if start < 0 {
+			literal += s
+			break
+		} else if s[start] == '}' {
+			return nil, fmt.Errorf("Unexpected } in template")
+		}
+
+		end := strings.IndexAny(s[start + 1:], "{}")
+		if end < 0 || s[start + 1 + end] != '}' {
+			return nil, fmt.Errorf("Unclosed { in template")
+		}
+
+		literal += s[:start]
+		name := s[start + 1 : start + 1 + end]
+		s = s[start + 1 + end + 1:]
+
+		if name == "" {
+			return nil, fmt.Errorf("Empty placeholder in template")
+		} else if strings.HasPrefix(name, TEMPLATE_CHANNEL_PREFIX) {
+			n, err := strconv.Atoi(strings.TrimPrefix(name, TEMPLATE_CHANNEL_PREFIX))
+			if err != nil || n < 1 || n > len(segments) {
+				return nil, fmt.Errorf("Placeholder {%s} does not match a segment of channel %s", name, channel)
+			}
+
+			r.parts = append(r.parts, pubsubTemplatePart { literal: literal }, pubsubTemplatePart { segment: n })
+			literal = ""
+			continue
+		}
+
+		r.parts = append(r.parts, pubsubTemplatePart { literal: literal }, pubsubTemplatePart { field: name })
+		literal = ""
+	}
+
+	if literal != "" {
+		r.parts = append(r.parts, pubsubTemplatePart { literal: literal })
+	}
+
+	return r, nil
+}
+
+func (t *pubsubTemplate) Static() bool {
+	for _, p := range(t.parts) {
+		if p.field != "" || p.segment > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *pubsubTemplate) UsesPayload() bool {
+	for _, p := range(t.parts) {
+		if p.field != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check is applied to every substituted value, literal parts are taken as configured
+func (t *pubsubTemplate) Render(channel string, payload pubsubPayload, check func(string) error) (string, error) {
+	segments := strings.Split(strings.Trim(channel, "/"), "/")
+
+	var b strings.Builder
+	for _, p := range(t.parts) {
+		var v string
+		var err error
+
+		if p.segment > 0 {
+			if p.segment > len(segments) {
+				return "", fmt.Errorf("Channel %s has no segment %d", channel, p.segment)
+			}
+			v = segments[p.segment - 1]
+		} else if p.field != "" {
+			v, err = payload.GetAsStr(p.field)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			b.WriteString(p.literal)
+			continue
+		}
+
+		if check != nil {
+			err = check(v)
+			if err != nil {
+				return "", err
+			}
+		}
+		b.WriteString(v)
+	}
+
+	return b.String(), nil
+}
+
+func (t pubsubTargetTemplate) UsesPayload() bool {
+	if t.topic.UsesPayload() {
+		return true
+	}
+
+	for _, v := range(t.header) {
+		if v.UsesPayload() {
+			return true
+		}
+	}
+
+	return false
+}
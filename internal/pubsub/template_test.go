@@ -0,0 +1,243 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+func TestTemplateNew(t *testing.T) {
+	channel := "/sites/s1/stats/clients"
+	tests := []struct {
+		name	string
+		tmpl	string
+		static	bool
+		want	string
+		err	bool
+	}{
+		{ name: "literal", tmpl: "clients", static: true, want: "clients" },
+		{ name: "channel segments", tmpl: "mist.{channel.2}.{channel.4}", want: "mist.s1.clients" },
+		{ name: "payload field", tmpl: "mist.{channel.2}.{mac}", want: "mist.s1.aabbcc" },
+		{ name: "adjacent fields", tmpl: "{map_id}{mac}", want: "m1aabbcc" },
+		{ name: "number field", tmpl: "ap/{rssi}", want: "ap/-61" },
+		{ name: "segment out of range", tmpl: "{channel.5}", err: true },
+		{ name: "segment zero", tmpl: "{channel.0}", err: true },
+		{ name: "segment not a number", tmpl: "{channel.x}", err: true },
+		{ name: "empty placeholder", tmpl: "a.{}", err: true },
+		{ name: "unclosed", tmpl: "a.{mac", err: true },
+		{ name: "nested", tmpl: "a.{m{ac}}", err: true },
+		{ name: "stray close", tmpl: "a}", err: true },
+	}
+
+	payload, err := pubsubPayloadNew(`{"mac":"aabbcc","map_id":"m1","rssi":-61}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		tmpl, err := pubsubTemplateNew(tt.tmpl, channel)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		} else if tt.err {
+			continue
+		}
+
+		if tmpl.Static() != tt.static {
+			t.Errorf("%s: static is %v, want %v", tt.name, tmpl.Static(), tt.static)
+		}
+
+		got, err := tmpl.Render(channel, payload, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: rendered %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTarget(t *testing.T) {
+	channel := "/sites/s1/stats/clients"
+	tests := []struct {
+		name	string
+		target	PubsubIntfTarget
+		data	string
+		topic	string
+		header	string
+		err	bool
+	}{
+		{
+			name:	"channel segments",
+			target:	PubsubIntfTarget { Channel: channel, Topic: "mist.{channel.2}", Header: []GenericKV{{ Key: "site", Value: "{channel.2}" }} },
+			data:	`{"mac":"a"}`,
+			topic:	"mist.s1",
+			header:	"s1",
+		},
+		{
+			name:	"payload fields",
+			target:	PubsubIntfTarget { Channel: channel, Topic: "mist.{channel.2}.{mac}", Header: []GenericKV{{ Key: "map", Value: "{map_id}" }} },
+			data:	`{"mac":"a","map_id":"m1"}`,
+			topic:	"mist.s1.a",
+			header:	"m1",
+		},
+		{
+			name:	"missing topic field",
+			target:	PubsubIntfTarget { Channel: channel, Topic: "mist.{mac}" },
+			data:	`{"map_id":"m1"}`,
+			err:	true,
+		},
+		{
+			name:	"missing header field",
+			target:	PubsubIntfTarget { Channel: channel, Topic: "mist", Header: []GenericKV{{ Key: "map", Value: "{map_id}" }} },
+			data:	`{"mac":"a"}`,
+			err:	true,
+		},
+		{
+			name:	"invalid payload",
+			target:	PubsubIntfTarget { Channel: channel, Topic: "mist.{mac}" },
+			data:	`not json`,
+			err:	true,
+		},
+	}
+
+	for _, tt := range tests {
+		i, err := New(PubsubIntfConf {
+			Driver:		"dummy",
+			Datasource:	[]PubsubIntfTarget{tt.target},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b := &pubsubTestBackend{}
+		i.backend = b
+
+		err = i.processData(channel, tt.data)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		} else if tt.err {
+			continue
+		}
+
+		got := b.targets[0]
+		if got.Topic != tt.topic {
+			t.Errorf("%s: topic %q, want %q", tt.name, got.Topic, tt.topic)
+		}
+		if len(got.Header) != 1 || got.Header[0].Value != tt.header {
+			t.Errorf("%s: header %v, want %q", tt.name, got.Header, tt.header)
+		}
+
+		// configured target keeps its templates for the next message
+		if _, ok := i.tmplMap[channel]; ok && i.topicMap[channel].Header[0].Value != tt.target.Header[0].Value {
+			t.Errorf("%s: rendered header leaked into configured target", tt.name)
+		}
+	}
+}
+
+func TestBuildTargetInvalid(t *testing.T) {
+	tests := []PubsubIntfTarget {
+		{ Channel: "/sites/s1/stats/clients", Topic: "mist.{channel.9}" },
+		{ Channel: "/sites/s1/stats/clients", Topic: "mist", Header: []GenericKV{{ Key: "site", Value: "{site" }} },
+	}
+
+	for _, tt := range tests {
+		_, err := New(PubsubIntfConf { Driver: "dummy", Datasource: []PubsubIntfTarget{tt} })
+		if err == nil {
+			t.Errorf("%s %v: expected error", tt.Topic, tt.Header)
+		}
+	}
+}
+
+func TestWildcardChannel(t *testing.T) {
+	i, err := New(PubsubIntfConf {
+		Driver:		"dummy",
+		Datasource:	[]PubsubIntfTarget {
+					{ Channel: "/sites/*/stats/clients", Topic: "client.{channel.2}", Header: []GenericKV{{ Key: "site", Value: "{channel.2}" }} },
+					{ Channel: "/sites/s3/stats/clients", Topic: "client.special" },
+					{ Channel: "/sites/*/stats/*", Topic: "{channel.4}.{channel.2}" },
+				},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pubsubTestBackend{}
+	i.backend = b
+
+	tests := []struct {
+		channel		string
+		topic		string
+		err		bool
+	}{
+		{ channel: "/sites/s1/stats/clients", topic: "client.s1" },
+		{ channel: "/sites/s2/stats/clients", topic: "client.s2" },
+		{ channel: "/sites/s3/stats/clients", topic: "client.special" },
+		{ channel: "/sites/s1/stats/devices", topic: "devices.s1" },
+		{ channel: "/sites/s1/stats/clients/extra", err: true },
+		{ channel: "/orgs/o1/stats/clients", err: true },
+	}
+
+	for _, tt := range tests {
+		before := len(b.targets)
+		err := i.processData(tt.channel, `{"mac":"a"}`)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.channel, err)
+			continue
+		} else if tt.err {
+			continue
+		}
+
+		if len(b.targets) != before + 1 {
+			t.Fatalf("%s: nothing published", tt.channel)
+		}
+		got := b.targets[before]
+		if got.Topic != tt.topic {
+			t.Errorf("%s: topic %q, want %q", tt.channel, got.Topic, tt.topic)
+		}
+	}
+
+	// one datasource, a topic per site, header filled in the same way
+	if b.targets[0].Header[0].Value != "s1" || b.targets[1].Header[0].Value != "s2" {
+		t.Errorf("unexpected headers %v and %v", b.targets[0].Header, b.targets[1].Header)
+	}
+}
+
+func TestTopicValueCheck(t *testing.T) {
+	tests := []struct {
+		name	string
+		check	func(string) error
+		topic	string
+		data	string
+		err	bool
+	}{
+		{ name: "mqtt level", check: (&pubsubIntfMqtt{}).CheckTopicValue, topic: "mist/{channel.2}/{mac}", data: `{"mac":"a-b.c"}` },
+		{ name: "mqtt single level wildcard", check: (&pubsubIntfMqtt{}).CheckTopicValue, topic: "mist/{mac}", data: `{"mac":"a+b"}`, err: true },
+		{ name: "mqtt multi level wildcard", check: (&pubsubIntfMqtt{}).CheckTopicValue, topic: "mist/{mac}", data: `{"mac":"#"}`, err: true },
+		{ name: "nats token", check: (&pubsubIntfNats{}).CheckTopicValue, topic: "mist.{channel.2}.{mac}", data: `{"mac":"a-b_c"}` },
+		{ name: "nats separator", check: (&pubsubIntfNats{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":"a.b"}`, err: true },
+		{ name: "nats whitespace", check: (&pubsubIntfNats{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":"a b"}`, err: true },
+		{ name: "nats wildcard", check: (&pubsubIntfNats{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":"*"}`, err: true },
+		{ name: "nats full wildcard", check: (&pubsubIntfNats{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":">"}`, err: true },
+		{ name: "nats empty token", check: (&pubsubIntfNats{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":""}`, err: true },
+		{ name: "kafka allowed", check: (&pubsubIntfKafka{}).CheckTopicValue, topic: "mist.{channel.2}.{mac}", data: `{"mac":"A-b_c.9"}` },
+		{ name: "kafka slash", check: (&pubsubIntfKafka{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":"a/b"}`, err: true },
+		{ name: "kafka non ascii", check: (&pubsubIntfKafka{}).CheckTopicValue, topic: "mist.{mac}", data: `{"mac":"café"}`, err: true },
+		{ name: "redis anything", check: (&pubsubIntfRedis{}).CheckTopicValue, topic: "mist:{mac}", data: `{"mac":"a b/#*"}` },
+	}
+
+	for _, tt := range tests {
+		i, err := New(PubsubIntfConf {
+			Driver:		"dummy",
+			Datasource:	[]PubsubIntfTarget{{ Channel: "/sites/*/stats/clients", Topic: tt.topic }},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b := &pubsubTestBackend { check: tt.check }
+		i.backend = b
+
+		err = i.processData("/sites/s1/stats/clients", tt.data)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if tt.err && len(b.targets) > 0 {
+			t.Errorf("%s: message published despite invalid topic", tt.name)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type PubsubIntfConfTls struct {
+	Enabled		bool
+	CaFile		string
+	CertFile	string
+	KeyFile		string
+	SkipVerify	bool
+}
+
+func pubsubTlsConf(cfg PubsubIntfConfTls) (*tls.Config, error) {
+	r := &tls.Config {
+		InsecureSkipVerify:	cfg.SkipVerify,
+	}
+
+	if cfg.CaFile != "" {
+		ca, err := os.ReadFile(cfg.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file: %v", err)
+		}
+
+		r.RootCAs = x509.NewCertPool()
+		if !r.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificate found in CA file %s", cfg.CaFile)
+		}
+	}
+
+	// client certificate authentication
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %v", err)
+		}
+		r.Certificates = []tls.Certificate{cert}
+	}
+
+	return r, nil
+}
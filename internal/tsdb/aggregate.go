@@ -0,0 +1,248 @@
+package tsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TsdbIntfConfDSAggregate struct {
+	Window		int	  `mapstructure:"window_seconds"`
+	Grace		int	  `mapstructure:"grace_seconds"`
+	Functions	[]string  `mapstructure:"functions"`
+}
+
+// in output order, min/max/avg only apply to numeric metrics
+var tsdbAggregateFuncs = []string{"min", "max", "avg", "last", "count"}
+
+type tsdbAggregate struct {
+	window		time.Duration
+	grace		time.Duration
+	funcs		map[string]bool
+	keys		[]string
+	metrics		[]TsdbIntfConfDSMetric
+	groups		map[string]*tsdbAggregateGroup
+	mark		time.Time
+	seen		time.Time
+}
+
+type tsdbAggregateGroup struct {
+	start		time.Time
+	last		tsdbRecord
+	stats		map[string]*tsdbAggregateStat
+}
+
+type tsdbAggregateStat struct {
+	min		float64
+	max		float64
+	sum		float64
+	count		int64
+	last		string
+}
+
+func tsdbAggregateNumeric(t string) bool {
+	switch strings.ToUpper(t) {
+	case "BIGINT", "DOUBLE":
+		return true
+	}
+
+	return false
+}
+
+// builds aggregator and rewrites datasource metrics to the aggregated set
+func tsdbAggregateNew(ds *TsdbIntfConfDS) (*tsdbAggregate, error) {
+	r := &tsdbAggregate {
+		window:		time.Duration(ds.Aggregate.Window) * time.Second,
+		grace:		time.Duration(ds.Aggregate.Grace) * time.Second,
+		funcs:		make(map[string]bool),
+		keys:		ds.Keys,
+		metrics:	ds.Metrics,
+		groups:		make(map[string]*tsdbAggregateGroup),
+	}
+
+	if strings.ToLower(ds.Datalayout) == LAYOUT_RAW {
+		return nil, fmt.Errorf("Aggregation is not supported for raw layout on channel %s", ds.Channel)
+	}
+
+	if len(r.keys) < 1 {
+		return nil, fmt.Errorf("Aggregation on channel %s requires keys", ds.Channel)
+	}
+
+	if ds.Aggregate.Grace < 0 {
+		return nil, fmt.Errorf("Aggregation grace period on channel %s is negative", ds.Channel)
+	}
+
+	for _, f := range ds.Aggregate.Functions {
+		f = strings.ToLower(f)
+		switch f {
+		case "min", "max", "avg", "last", "count":
+		default:
+			return nil, fmt.Errorf("Unknown aggregate function: %s", f)
+		}
+		r.funcs[f] = true
+	}
+
+	if len(r.funcs) < 1 {
+		for _, f := range tsdbAggregateFuncs {
+			r.funcs[f] = true
+		}
+	}
+
+	var metrics []TsdbIntfConfDSMetric
+	for _, m := range ds.Metrics {
+		for _, f := range tsdbAggregateFuncs {
+			if !r.funcs[f] {
+				continue
+			}
+
+			t := m.Type
+			switch f {
+			case "min", "max":
+				if !tsdbAggregateNumeric(m.Type) {
+					continue
+				}
+			case "avg":
+				if !tsdbAggregateNumeric(m.Type) {
+					continue
+				}
+				t = "DOUBLE"
+			case "count":
+				t = "BIGINT"
+			}
+
+			metrics = append(metrics, TsdbIntfConfDSMetric { Key: m.Key + "_" + f, Type: t })
+		}
+	}
+	ds.Metrics = metrics
+
+	return r, nil
+}
+
+// event time watermark, follows newest event time seen and the wall clock while idle
+// so a backfill is windowed by its own timestamps and the last window still closes
+func (a *tsdbAggregate) advance(now time.Time, ts time.Time) time.Time {
+	if !a.seen.IsZero() {
+		a.mark = a.mark.Add(now.Sub(a.seen))
+	}
+	if ts.After(a.mark) {
+		a.mark = ts
+	}
+	a.seen = now
+
+	return a.mark
+}
+
+// adds record to its window, returns false if that window has already been emitted
+func (a *tsdbAggregate) add(now time.Time, rec tsdbRecord) (bool, error) {
+	start := rec.Time.Truncate(a.window)
+	if !start.Add(a.window + a.grace).After(a.advance(now, rec.Time)) {
+		return false, nil
+	}
+
+	// group key from window and configured dimensions
+	kv := []string{strconv.FormatInt(start.UnixNano(), 10)}
+	for _, k := range a.keys {
+		v, err := rec.Data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			return false, fmt.Errorf("JSON key %s does not exist", k)
+		}
+		kv = append(kv, v)
+	}
+	key := strings.Join(kv, "\x00")
+
+	g, ok := a.groups[key]
+	if !ok {
+		g = &tsdbAggregateGroup {
+			start:		start,
+			stats:		make(map[string]*tsdbAggregateStat),
+		}
+		a.groups[key] = g
+	}
+
+	for _, m := range a.metrics {
+		v, err := rec.Data.GetJsonKeyValueAsStr(m.Key)
+		if err != nil {
+			return false, fmt.Errorf("JSON key %s does not exist", m.Key)
+		} else if v == "" {
+			continue
+		}
+
+		s, ok := g.stats[m.Key]
+		if !ok {
+			s = &tsdbAggregateStat{}
+			g.stats[m.Key] = s
+		}
+
+		if tsdbAggregateNumeric(m.Type) {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return false, fmt.Errorf("Metric %s is not numeric: %v", m.Key, err)
+			}
+
+			if s.count == 0 || f < s.min {
+				s.min = f
+			}
+			if s.count == 0 || f > s.max {
+				s.max = f
+			}
+			s.sum += f
+		}
+
+		s.count++
+		s.last = v
+	}
+
+	// dimensions of the emitted record come from the latest sample
+	if !ok || !rec.Time.Before(g.last.Time) {
+		g.last = rec
+	}
+
+	return true, nil
+}
+
+// returns records of windows closed at now, or of all windows if flushing
+func (a *tsdbAggregate) expire(now time.Time, all bool) []tsdbRecord {
+	var r []tsdbRecord
+
+	mark := a.advance(now, time.Time{})
+	for key, g := range a.groups {
+		if !all && g.start.Add(a.window + a.grace).After(mark) {
+			continue
+		}
+		delete(a.groups, key)
+
+		data := tsdbOverlayNew(g.last.Data)
+		for _, m := range a.metrics {
+			// metric absent for whole window is emitted empty, same as in a single sample
+			s, ok := g.stats[m.Key]
+			if !ok {
+				for _, f := range tsdbAggregateFuncs {
+					data.Set(m.Key + "_" + f, "")
+				}
+				data.Set(m.Key + "_count", "0")
+				continue
+			}
+
+			if tsdbAggregateNumeric(m.Type) {
+				data.Set(m.Key + "_min", strconv.FormatFloat(s.min, 'f', -1, 64))
+				data.Set(m.Key + "_max", strconv.FormatFloat(s.max, 'f', -1, 64))
+				data.Set(m.Key + "_avg", strconv.FormatFloat(s.sum / float64(s.count), 'f', -1, 64))
+			}
+			data.Set(m.Key + "_last", s.last)
+			data.Set(m.Key + "_count", strconv.FormatInt(s.count, 10))
+		}
+
+		rec := tsdbRecord {
+			Channel:	g.last.Channel,
+			Time:		g.start,
+			Data:		data,
+			Raw:		g.last.Raw,
+			Size:		g.last.Size,
+		}
+
+		r = append(r, rec)
+	}
+
+	return r
+}
@@ -0,0 +1,154 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+)
+
+func aggregateTestNew(t *testing.T) *tsdbAggregate {
+	ds := TsdbIntfConfDS {
+		Channel:	"/sites/s1/stats/clients",
+		Keys:		[]string{"mac"},
+		Metrics:	[]TsdbIntfConfDSMetric {
+					{ Key: "rssi", Type: "BIGINT" },
+					{ Key: "ssid", Type: "VARCHAR" },
+				},
+		Aggregate:	TsdbIntfConfDSAggregate {
+					Window:	60,
+					Grace:	10,
+				},
+	}
+
+	a, err := tsdbAggregateNew(&ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func aggregateTestRecord(ts time.Time, mac string, rssi string) tsdbRecord {
+	return tsdbRecord {
+		Channel:	"/sites/s1/stats/clients",
+		Time:		ts,
+		Data:		tsdbWalData { "mac": mac, "rssi": rssi, "ssid": "corp" },
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	a := aggregateTestNew(t)
+	base := time.Unix(1700000040, 0).Truncate(time.Minute)
+	now := time.Now()
+
+	for n, v := range []string{"-60", "-70", "", "-50"} {
+		added, err := a.add(now, aggregateTestRecord(base.Add(time.Duration(n) * time.Second), "a", v))
+		if err != nil {
+			t.Fatal(err)
+		} else if !added {
+			t.Fatalf("record %d was not added", n)
+		}
+	}
+
+	recs := a.expire(now, true)
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(recs))
+	} else if !recs[0].Time.Equal(base) {
+		t.Errorf("window start is %v, want %v", recs[0].Time, base)
+	}
+
+	want := map[string]string {
+		"rssi_min":	"-70",
+		"rssi_max":	"-50",
+		"rssi_avg":	"-60",
+		"rssi_last":	"-50",
+		"rssi_count":	"3",
+		"ssid_last":	"corp",
+		"ssid_count":	"4",
+		"mac":		"a",
+	}
+	for k, v := range want {
+		got, err := recs[0].Data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			t.Errorf("%s: %v", k, err)
+		} else if got != v {
+			t.Errorf("%s is %s, want %s", k, got, v)
+		}
+	}
+}
+
+func TestAggregateEventTime(t *testing.T) {
+	// event times are far in the past, as when a backlog is delivered after an outage
+	base := time.Unix(1700000040, 0).Truncate(time.Minute)
+	wall := time.Now()
+
+	type step struct {
+		wall	time.Duration
+		event	time.Duration
+		added	bool
+		expired	int
+	}
+
+	tests := []struct {
+		name	string
+		steps	[]step
+	}{
+		{
+			name:	"backfill is windowed by event time",
+			steps:	[]step {
+					{ 0, 0, true, 0 },
+					{ 0, 30 * time.Second, true, 0 },
+					{ 0, 65 * time.Second, true, 0 },
+					{ 0, 75 * time.Second, true, 1 },
+				},
+		},
+		{
+			name:	"late record for closed window",
+			steps:	[]step {
+					{ 0, 0, true, 0 },
+					{ 0, 80 * time.Second, true, 1 },
+					{ 0, 10 * time.Second, false, 0 },
+				},
+		},
+		{
+			name:	"record within grace",
+			steps:	[]step {
+					{ 0, 0, true, 0 },
+					{ 0, 65 * time.Second, true, 0 },
+					{ 0, 20 * time.Second, true, 0 },
+					{ 0, 70 * time.Second, true, 1 },
+				},
+		},
+		{
+			name:	"idle window closes by wall clock",
+			steps:	[]step {
+					{ 0, 0, true, 0 },
+					{ 69 * time.Second, -1, false, 0 },
+					{ 70 * time.Second, -1, false, 1 },
+				},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := aggregateTestNew(t)
+			for n, s := range tt.steps {
+				now := wall.Add(s.wall)
+
+				// negative event time only runs expiry
+				if s.event >= 0 {
+					added, err := a.add(now, aggregateTestRecord(base.Add(s.event), "a", "-60"))
+					if err != nil {
+						t.Fatal(err)
+					} else if added != s.added {
+						t.Errorf("step %d: added is %v, want %v", n, added, s.added)
+					}
+				}
+
+				got := len(a.expire(now, false))
+				if got != s.expired {
+					t.Errorf("step %d: expired %d windows, want %d", n, got, s.expired)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package tsdb
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -8,8 +9,11 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/timestreamwrite"
 
@@ -18,10 +22,26 @@ import (
 	"github.com/yumyudai/misttools/pkg/mistdatafmt"
 )
 
+// ref. https://docs.aws.amazon.com/timestream/latest/developerguide/ts-limits.html
+const (
+	awsTsMaxVarcharSize	= 2048
+	awsTsDefaultRawChunks	= 16
+)
+
+type TsdbIntfConfDrvAwsTS struct {
+	Region		string
+	Database	string
+	MaxRetries	int
+	RawMaxChunks	int
+}
+
 type tsdbIntfAwsTS struct {
 	debug		bool
 	database	string
+	rawMaxChunks	int
+	deadLetter	tsdbDeadLetterSink
 	dataOut		map[string]tsdbIntfAwsTsDataOut
+	tables		map[string]tsdbIntfAwsTsTable
 
 	awsConfig	*aws.Config
 	awsTransport	*http.Transport
@@ -29,6 +49,15 @@ type tsdbIntfAwsTS struct {
 	tsWrite		*timestreamwrite.TimestreamWrite
 }
 
+type tsdbIntfAwsTsTable struct {
+	Name			string
+	MemoryHours		int64
+	MagneticDays		int64
+	MagneticWrites		*bool
+	PartitionKey		string
+	PartitionKeyRequired	bool
+}
+
 type tsdbIntfAwsTsDataOutMetric struct {
 	Key		string
 	Type		string
@@ -37,11 +66,14 @@ type tsdbIntfAwsTsDataOutMetric struct {
 type tsdbIntfAwsTsDataOut struct {
 	Channel		string
 	Table		string
+	Raw		bool
+	Multi		bool
+	MeasureName	string
 	Keys		[]string
 	Metrics		[]tsdbIntfAwsTsDataOutMetric
 }
 
-func tsdbIntfAwsTsNew(cfg TsdbIntfConf) (*tsdbIntfAwsTS, error) {
+func tsdbIntfAwsTsNew(cfg TsdbIntfConf, deadLetter tsdbDeadLetterSink) (*tsdbIntfAwsTS, error) {
 	var err error 
 
 	// check valid parameter
@@ -57,23 +89,61 @@ func tsdbIntfAwsTsNew(cfg TsdbIntfConf) (*tsdbIntfAwsTS, error) {
 	r := &tsdbIntfAwsTS {
 		debug:		cfg.Debug,
 		database:	cfg.DriverAwsTimeStream.Database,
+		rawMaxChunks:	cfg.DriverAwsTimeStream.RawMaxChunks,
+		deadLetter:	deadLetter,
 		dataOut:	make(map[string]tsdbIntfAwsTsDataOut),
+		tables:		make(map[string]tsdbIntfAwsTsTable),
+	}
+
+	if r.rawMaxChunks < 1 {
+		r.rawMaxChunks = awsTsDefaultRawChunks
 	}
 
 	// build data out
 	for i := 0; i < len(cfg.Datasource); i++ {
+		raw := strings.ToLower(cfg.Datasource[i].Datalayout) == LAYOUT_RAW
+
+		// raw payloads always carry channel as dimension, keys are optional
 		if cfg.Datasource[i].Channel == "" ||
 			cfg.Datasource[i].Table == "" ||
-			len(cfg.Datasource[i].Keys) < 1 {
+			(!raw && len(cfg.Datasource[i].Keys) < 1) {
 			return nil, fmt.Errorf("Missing mandatory data out parameter")
 		}
 
+		err = r.addTable(cfg.Datasource[i])
+		if err != nil {
+			return nil, err
+		}
+
 		dout := tsdbIntfAwsTsDataOut {
 			Channel:	cfg.Datasource[i].Channel,
 			Table:		cfg.Datasource[i].Table,
+			Raw:		raw,
+			MeasureName:	cfg.Datasource[i].MeasureName,
 			Keys:		cfg.Datasource[i].Keys,
 		}
 
+		if raw {
+			if dout.MeasureName == "" {
+				dout.MeasureName = "data"
+			}
+
+			r.dataOut[cfg.Datasource[i].Channel] = dout
+			continue
+		}
+
+		// record type, single-measure (one record per metric) is the default
+		switch strings.ToLower(cfg.Datasource[i].RecordType) {
+		case "", "single":
+		case "multi":
+			dout.Multi = true
+			if dout.MeasureName == "" {
+				dout.MeasureName = dout.Table
+			}
+		default:
+			return nil, fmt.Errorf("Unknown record type: %s", cfg.Datasource[i].RecordType)
+		}
+
 		// check valid type
 		// ref. https://docs.aws.amazon.com/timestream/latest/developerguide/writes.html
 		for j := 0; j < len(cfg.Datasource[i].Metrics); j++ {
@@ -85,9 +155,9 @@ func tsdbIntfAwsTsNew(cfg TsdbIntfConf) (*tsdbIntfAwsTS, error) {
 			case "DOUBLE":
 			case "VARCHAR":
 				
-			// unsupported
+			// not a metric type, multi-measure records are set per datasource
 			case "MULTI":
-				return nil, fmt.Errorf("MULTI data type is not supported")
+				return nil, fmt.Errorf("MULTI is not a metric data type, set record_type to multi instead")
 			default:
 				return nil, fmt.Errorf("Unknown data type: %s", t)
 			}
@@ -97,6 +167,15 @@ func tsdbIntfAwsTsNew(cfg TsdbIntfConf) (*tsdbIntfAwsTS, error) {
 				Type:	t,
 			}
 
+			// measure names within a multi-measure record must not collide with dimensions
+			if dout.Multi {
+				for _, k := range dout.Keys {
+					if k == m.Key {
+						return nil, fmt.Errorf("Metric %s is also used as a key, not allowed for multi record type", k)
+					}
+				}
+			}
+
 			dout.Metrics = append(dout.Metrics, m)
 		}
 		
@@ -135,6 +214,11 @@ func tsdbIntfAwsTsNew(cfg TsdbIntfConf) (*tsdbIntfAwsTS, error) {
 	return r, nil
 }
 
+func (i *tsdbIntfAwsTS) Close() error {
+	i.awsTransport.CloseIdleConnections()
+	return nil
+}
+
 func (i *tsdbIntfAwsTS) initConn() error {
 	var err error 
 
@@ -187,20 +271,23 @@ func (i *tsdbIntfAwsTS) initAws() error {
 	}
 
 	// Describe table.
-	for _, v := range i.dataOut {
+	for _, v := range i.tables {
 		tblDescribe := &timestreamwrite.DescribeTableInput {
 			DatabaseName: aws.String(i.database),
-			TableName:    aws.String(v.Table),
+			TableName:    aws.String(v.Name),
 		}
 
 		tblOut, err := i.tsWrite.DescribeTable(tblDescribe)
 		if err != nil {
 			_, ok := err.(*timestreamwrite.ResourceNotFoundException)
 			if ok {
-				log.Printf("Table %s was not found, attempting to create..", v.Table)
+				log.Printf("Table %s was not found, attempting to create..", v.Name)
 				tblCreate := &timestreamwrite.CreateTableInput {
-					DatabaseName: aws.String(i.database),
-					TableName:    aws.String(v.Table),
+					DatabaseName:			aws.String(i.database),
+					TableName:			aws.String(v.Name),
+					RetentionProperties:		v.retention(nil),
+					MagneticStoreWriteProperties:	v.magneticWrites(),
+					Schema:				v.schema(),
 				}
 				_, err = i.tsWrite.CreateTable(tblCreate)
 
@@ -214,28 +301,241 @@ func (i *tsdbIntfAwsTS) initAws() error {
 			}
 		} else {
 			log.Printf("Got table: %v", tblOut)
+
+			err = i.reconcileTable(v, tblOut.Table)
+			if err != nil {
+				log.Printf("Could not update table: %v", err)
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func (i *tsdbIntfAwsTS) AddRecordStatsClient(channel string, data mistdatafmt.WsMsgClientStat) error {
-	outParams, ok := i.dataOut[channel]
+// collect table settings from datasource, datasources sharing a table must agree
+func (i *tsdbIntfAwsTS) addTable(ds TsdbIntfConfDS) error {
+	t := tsdbIntfAwsTsTable {
+		Name:			ds.Table,
+		MemoryHours:		int64(ds.MemoryRetentionHours),
+		MagneticDays:		int64(ds.MagneticRetentionDays),
+		MagneticWrites:		ds.MagneticStoreWrites,
+		PartitionKey:		ds.PartitionKey,
+		PartitionKeyRequired:	ds.PartitionKeyRequired,
+	}
+
+	if t.MemoryHours < 0 || t.MagneticDays < 0 {
+		return fmt.Errorf("Retention period for table %s is negative", t.Name)
+	}
+
+	prev, ok := i.tables[t.Name]
 	if !ok {
-		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+		i.tables[t.Name] = t
+		return nil
+	}
+
+	if prev.MemoryHours != t.MemoryHours ||
+		prev.MagneticDays != t.MagneticDays ||
+		aws.BoolValue(prev.MagneticWrites) != aws.BoolValue(t.MagneticWrites) ||
+		prev.PartitionKey != t.PartitionKey ||
+		prev.PartitionKeyRequired != t.PartitionKeyRequired {
+		return fmt.Errorf("Datasources sharing table %s have conflicting table settings", t.Name)
+	}
+
+	return nil
+}
+
+// unset values are taken from existing table, or Timestream defaults on creation
+func (t tsdbIntfAwsTsTable) retention(cur *timestreamwrite.RetentionProperties) *timestreamwrite.RetentionProperties {
+	if t.MemoryHours == 0 && t.MagneticDays == 0 {
+		return nil
+	}
+
+	r := &timestreamwrite.RetentionProperties {
+		MemoryStoreRetentionPeriodInHours:	aws.Int64(6),
+		MagneticStoreRetentionPeriodInDays:	aws.Int64(73000),
+	}
+
+	if cur != nil {
+		r.MemoryStoreRetentionPeriodInHours = cur.MemoryStoreRetentionPeriodInHours
+		r.MagneticStoreRetentionPeriodInDays = cur.MagneticStoreRetentionPeriodInDays
+	}
+
+	if t.MemoryHours > 0 {
+		r.MemoryStoreRetentionPeriodInHours = aws.Int64(t.MemoryHours)
+	}
+
+	if t.MagneticDays > 0 {
+		r.MagneticStoreRetentionPeriodInDays = aws.Int64(t.MagneticDays)
+	}
+
+	return r
+}
+
+func (t tsdbIntfAwsTsTable) magneticWrites() *timestreamwrite.MagneticStoreWriteProperties {
+	if t.MagneticWrites == nil {
+		return nil
+	}
+
+	return &timestreamwrite.MagneticStoreWriteProperties {
+		EnableMagneticStoreWrites:	t.MagneticWrites,
+	}
+}
+
+// partition key is a dimension name, or measure_name to partition by measure
+func (t tsdbIntfAwsTsTable) schema() *timestreamwrite.Schema {
+	if t.PartitionKey == "" {
+		return nil
+	}
+
+	k := &timestreamwrite.PartitionKey {
+		Type:			aws.String(timestreamwrite.PartitionKeyTypeDimension),
+		Name:			aws.String(t.PartitionKey),
+		EnforcementInRecord:	aws.String(timestreamwrite.PartitionKeyEnforcementLevelOptional),
+	}
+
+	if t.PartitionKey == "measure_name" {
+		k.Type = aws.String(timestreamwrite.PartitionKeyTypeMeasure)
+		k.Name = nil
+		k.EnforcementInRecord = nil
+	} else if t.PartitionKeyRequired {
+		k.EnforcementInRecord = aws.String(timestreamwrite.PartitionKeyEnforcementLevelRequired)
+	}
+
+	return &timestreamwrite.Schema {
+		CompositePartitionKey:	[]*timestreamwrite.PartitionKey{k},
+	}
+}
+
+func (i *tsdbIntfAwsTS) reconcileTable(t tsdbIntfAwsTsTable, cur *timestreamwrite.Table) error {
+	if cur == nil {
+		return nil
+	}
+
+	tblUpdate := &timestreamwrite.UpdateTableInput {
+		DatabaseName:	aws.String(i.database),
+		TableName:	aws.String(t.Name),
+	}
+	update := false
+
+	ret := t.retention(cur.RetentionProperties)
+	if ret != nil && (cur.RetentionProperties == nil ||
+		aws.Int64Value(ret.MemoryStoreRetentionPeriodInHours) != aws.Int64Value(cur.RetentionProperties.MemoryStoreRetentionPeriodInHours) ||
+		aws.Int64Value(ret.MagneticStoreRetentionPeriodInDays) != aws.Int64Value(cur.RetentionProperties.MagneticStoreRetentionPeriodInDays)) {
+		log.Printf("Retention of table %s differs from config, updating..", t.Name)
+		tblUpdate.RetentionProperties = ret
+		update = true
+	}
+
+	mw := t.magneticWrites()
+	if mw != nil && (cur.MagneticStoreWriteProperties == nil ||
+		aws.BoolValue(mw.EnableMagneticStoreWrites) != aws.BoolValue(cur.MagneticStoreWriteProperties.EnableMagneticStoreWrites)) {
+		log.Printf("Magnetic store writes of table %s differs from config, updating..", t.Name)
+		tblUpdate.MagneticStoreWriteProperties = mw
+		update = true
+	}
+
+	// partition key is fixed once the table exists, only warn about drift
+	sch := t.schema()
+	if sch != nil {
+		want := sch.CompositePartitionKey[0]
+		match := false
+		if cur.Schema != nil && len(cur.Schema.CompositePartitionKey) > 0 {
+			got := cur.Schema.CompositePartitionKey[0]
+			match = aws.StringValue(got.Type) == aws.StringValue(want.Type) &&
+				aws.StringValue(got.Name) == aws.StringValue(want.Name)
+		}
+
+		if !match {
+			log.Printf("Partition key of table %s differs from config and cannot be changed after creation", t.Name)
+		}
 	}
 
+	if !update {
+		return nil
+	}
+
+	_, err := i.tsWrite.UpdateTable(tblUpdate)
+	return err
+}
+
+func (i *tsdbIntfAwsTS) AddRecords(tbl string, records []tsdbRecord) error {
+	var out []*timestreamwrite.Record
+	var src []int
+	var failed int
+
 	if i.debug {
-		log.Printf("Start processing add record for client statistics")
+		log.Printf("Start processing %d records for table %s", len(records), tbl)
+	}
+
+	for n, rec := range records {
+		outParams, ok := i.dataOut[rec.Channel]
+		if !ok {
+			log.Printf("Data out parameters for channel %s was not found", rec.Channel)
+			failed++
+			continue
+		}
+
+		r, err := i.buildRecords(outParams, rec.Time, rec.Data)
+		if err != nil {
+			log.Printf("Failed to build record for channel %s: %v", rec.Channel, err)
+			failed++
+			continue
+		}
+
+		// remember source record of each measure to retry only failed chunks
+		for range r {
+			src = append(src, n)
+		}
+		out = append(out, r...)
+	}
+
+	// WriteRecords accepts up to 100 records per call
+	// a failed chunk is dead-lettered or handed back for retry, keep going with the rest
+	var errs []error
+	var retry []tsdbRecord
+	last := -1
+	counter := 0
+	for start := 0; start < len(out); start += 100 {
+		end := start + 100
+		if end > len(out) {
+			end = len(out)
+		}
+
+		err := i.writeRecords(tbl, out[start:end])
+		if tsdbRetriable(err) {
+			for _, n := range src[start:end] {
+				if n != last {
+					retry = append(retry, records[n])
+					last = n
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		counter += end - start
+		if i.debug {
+			log.Printf("Wrote %d/%d records", counter, len(out))
+		}
+	}
+
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d records could not be built for table %s", failed, len(records), tbl))
 	}
 
+	return tsdbRetryJoin(errs, retry)
+}
+
+func (i *tsdbIntfAwsTS) buildRecords(outParams tsdbIntfAwsTsDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) ([]*timestreamwrite.Record, error) {
 	// build data record
 	var keyDimensions []*timestreamwrite.Dimension
 	for _, v := range outParams.Keys {
 		dval, err := data.GetJsonKeyValueAsStr(v)
 		if err != nil {
-			return fmt.Errorf("JSON key %s does not exist", v)
+			return nil, fmt.Errorf("JSON key %s does not exist", v)
 		} else if dval == "" {
 			continue
 		}
@@ -249,69 +549,193 @@ func (i *tsdbIntfAwsTS) AddRecordStatsClient(channel string, data mistdatafmt.Ws
 	}
 
 	if len(keyDimensions) < 1 {
-		return fmt.Errorf("Key dimentions was empty")
+		return nil, fmt.Errorf("Key dimentions was empty")
 	}
 
-	counter := int64(0)
-	curTime := time.Now().Unix()
-	var records []*timestreamwrite.Record
+	// build measures
+	var measures []*timestreamwrite.MeasureValue
 	for _, v := range outParams.Metrics {
 		rval, err := data.GetJsonKeyValueAsStr(v.Key)
 		if err != nil {
-			return fmt.Errorf("JSON key %s does not exist", v.Key)
+			return nil, fmt.Errorf("JSON key %s does not exist", v.Key)
+		} else if rval == "" && tsdbValueUnset(data, v.Key) {
+			continue
 		} else if rval == "" {
-			return fmt.Errorf("Measurement data is empty for JSON key %s", v.Key)
+			return nil, fmt.Errorf("Measurement data is empty for JSON key %s", v.Key)
 		} 
 
+		m := &timestreamwrite.MeasureValue {
+			Name:	aws.String(v.Key),
+			Value:	aws.String(rval),
+			Type:	aws.String(v.Type),
+		}
+
+		measures = append(measures, m)
+	}
+
+	curTime := ts.UnixMilli()
+	if outParams.Multi {
+		if len(measures) < 1 {
+			return nil, fmt.Errorf("Measures was empty")
+		}
+
 		r := &timestreamwrite.Record {
 			Dimensions:		keyDimensions,
-			MeasureName:		aws.String(v.Key),
-			MeasureValue:		aws.String(rval),
-			MeasureValueType:	aws.String(v.Type),
+			MeasureName:		aws.String(outParams.MeasureName),
+			MeasureValueType:	aws.String("MULTI"),
+			MeasureValues:		measures,
 			Time:			aws.String(strconv.FormatInt(curTime, 10)),
-			TimeUnit:		aws.String("SECONDS"),
+			TimeUnit:		aws.String("MILLISECONDS"),
+		}
+
+		if i.debug {
+			log.Printf("Record: %v", r)
+		}
+
+		return []*timestreamwrite.Record{r}, nil
+	}
+
+	var records []*timestreamwrite.Record
+	for n, m := range measures {
+		r := &timestreamwrite.Record {
+			Dimensions:		keyDimensions,
+			MeasureName:		m.Name,
+			MeasureValue:		m.Value,
+			MeasureValueType:	m.Type,
+			Time:			aws.String(strconv.FormatInt(curTime, 10)),
+			TimeUnit:		aws.String("MILLISECONDS"),
 		}
 
 		records = append(records, r)
-		counter++
 
 		if i.debug {
-			log.Printf("Record#%d: %v", counter, r)
+			log.Printf("Record#%d: %v", n + 1, r)
 		}
+	}
 
-		if counter % 100 == 0 {
-			err := i.writeRecords(outParams.Table, records)
-			if err != nil {
-				return err
+	return records, nil
+}
+
+func (i *tsdbIntfAwsTS) AddRecordRaw(channel string, ts time.Time, data string) error {
+	outParams, ok := i.dataOut[channel]
+	if !ok {
+		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+	} else if !outParams.Raw {
+		return fmt.Errorf("Channel %s is not configured for raw layout", channel)
+	}
+
+	if data == "" {
+		return fmt.Errorf("Raw payload is empty for channel %s", channel)
+	}
+
+	// dimensions, channel plus configured keys extracted from payload
+	keyDimensions := []*timestreamwrite.Dimension {
+		&timestreamwrite.Dimension {
+			Name:	aws.String("channel"),
+			Value:	aws.String(channel),
+		},
+	}
+
+	if len(outParams.Keys) > 0 {
+		jsonData := &tsdbRawData{}
+		err := jsonData.UnmarshalJSON([]byte(data))
+		if err != nil {
+			return fmt.Errorf("Could not parse raw payload for key extraction: %v", err)
+		}
+
+		for _, v := range outParams.Keys {
+			dval, err := jsonData.GetJsonKeyValueAsStr(v)
+			if err != nil || dval == "" {
+				continue
 			}
 
-			records = make([]*timestreamwrite.Record, 0)
-			if i.debug {
-				log.Printf("Flushing record as 100 record limit reached, wrote %d records", counter)
+			d := &timestreamwrite.Dimension {
+				Name:	aws.String(v),
+				Value:	aws.String(dval),
 			}
 
-			counter = 0
+			keyDimensions = append(keyDimensions, d)
 		}
 	}
 
-	if counter > 0 {
-		err := i.writeRecords(outParams.Table, records)
-		if err != nil {
-			return err
+	// split payload to fit VARCHAR measure size limit
+	chunks := awsTsChunkString(data, awsTsMaxVarcharSize)
+	if len(chunks) > i.rawMaxChunks {
+		return fmt.Errorf("Raw payload of %d bytes exceeds %d chunks for channel %s", len(data), i.rawMaxChunks, channel)
+	}
+
+	curTime := strconv.FormatInt(ts.UnixMilli(), 10)
+	var records []*timestreamwrite.Record
+	for n, c := range chunks {
+		dims := keyDimensions
+		if len(chunks) > 1 {
+			dims = append(dims[:len(dims):len(dims)],
+				&timestreamwrite.Dimension {
+					Name:	aws.String("chunk"),
+					Value:	aws.String(strconv.Itoa(n)),
+				},
+				&timestreamwrite.Dimension {
+					Name:	aws.String("chunks"),
+					Value:	aws.String(strconv.Itoa(len(chunks))),
+				},
+			)
 		}
 
-		if i.debug {
-			log.Printf("Wrote %d records", counter)
+		r := &timestreamwrite.Record {
+			Dimensions:		dims,
+			MeasureName:		aws.String(outParams.MeasureName),
+			MeasureValue:		aws.String(c),
+			MeasureValueType:	aws.String("VARCHAR"),
+			Time:			aws.String(curTime),
+			TimeUnit:		aws.String("MILLISECONDS"),
 		}
+
+		records = append(records, r)
 	}
 
-	return nil
+	if i.debug {
+		log.Printf("Writing raw payload for channel %s as %d records", channel, len(records))
+	}
+
+	var errs []error
+	for start := 0; start < len(records); start += 100 {
+		end := start + 100
+		if end > len(records) {
+			end = len(records)
+		}
+
+		err := i.writeRecords(outParams.Table, records[start:end])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// raw payload is retried as a whole
+	err := errors.Join(errs...)
+	if tsdbRetriable(err) {
+		return &tsdbRetryError{err: err}
+	}
+
+	return err
 }
 
-func (i *tsdbIntfAwsTS) AddRecordRaw(channel string, data string) error {
-	log.Printf("Data layout raw is not supported for AWS TimeStream")
+// split string into pieces of at most size bytes without breaking UTF-8 sequences
+func awsTsChunkString(s string, size int) []string {
+	var r []string
+	for len(s) > size {
+		n := size
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		r = append(r, s[:n])
+		s = s[n:]
+	}
 
-	return nil
+	if len(s) > 0 {
+		r = append(r, s)
+	}
+
+	return r
 }
 
 
@@ -325,22 +749,111 @@ func (i *tsdbIntfAwsTS) writeRecords(tbl string, records []*timestreamwrite.Reco
 	}
 
 	_, err = i.tsWrite.WriteRecords(writeRecordsInput)
-	if err != nil {
+	if err != nil && awsTsRetriable(err) {
 		log.Printf("Failed to write record: %v", err)
 
-		// try reconn
-		err = i.initConn()
-		if err != nil {
-			log.Printf("Re-connect failed: %v", err)
-			return err
+		// try reconn, on failure the chunk is handled below with the original error
+		cerr := i.initConn()
+		if cerr != nil {
+			log.Printf("Re-connect failed: %v", cerr)
+		} else {
+			_, err = i.tsWrite.WriteRecords(writeRecordsInput)
+			if err != nil {
+				log.Printf("Failed to write after re-connect: %v", err)
+			}
 		}
+	}
 
-		_, err = i.tsWrite.WriteRecords(writeRecordsInput)
-		if err != nil {
-			log.Printf("Failed to write after re-connect: %v", err)
-			return err
+	if err == nil {
+		return nil
+	}
+
+	// records that were not rejected have been ingested, only dead-letter the rejected ones
+	rejected, ok := err.(*timestreamwrite.RejectedRecordsException)
+	if ok {
+		for _, v := range rejected.RejectedRecords {
+			idx := int(aws.Int64Value(v.RecordIndex))
+			if idx < 0 || idx >= len(records) {
+				continue
+			}
+
+			i.deadLetterRecord(tbl, awsTsRejectReason(v), aws.StringValue(v.Reason), records[idx])
 		}
+
+		return fmt.Errorf("%d of %d records were rejected by table %s", len(rejected.RejectedRecords), len(records), tbl)
 	}
 
-	return nil
+	// caller decides what happens to records which may succeed later
+	if awsTsRetriable(err) {
+		return &tsdbRetryError{err: err}
+	}
+
+	for _, v := range records {
+		i.deadLetterRecord(tbl, "non_retriable", err.Error(), v)
+	}
+
+	return err
+}
+
+func (i *tsdbIntfAwsTS) deadLetterRecord(tbl string, reason string, detail string, record *timestreamwrite.Record) {
+	e := tsdbDeadLetter {
+		Time:		time.Now(),
+		Driver:		"awstimestream",
+		Table:		tbl,
+		Reason:		reason,
+		Detail:		detail,
+		Record:		record,
+	}
+
+	err := i.deadLetter.Write(e)
+	if err != nil {
+		log.Printf("Failed to write dead-letter record: %v", err)
+	}
+}
+
+// throttling, server side and transport errors are worth another attempt
+func awsTsRetriable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return true
+	}
+
+	switch aerr.Code() {
+	case timestreamwrite.ErrCodeThrottlingException:
+		return true
+	case timestreamwrite.ErrCodeInternalServerException:
+		return true
+	case timestreamwrite.ErrCodeInvalidEndpointException:
+		return true
+	case request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+		return true
+	}
+
+	return false
+}
+
+// classify rejected record reason
+// ref. https://docs.aws.amazon.com/timestream/latest/developerguide/API_RejectedRecord.html
+func awsTsRejectReason(r *timestreamwrite.RejectedRecord) string {
+	if r.ExistingVersion != nil {
+		return "version_conflict"
+	}
+
+	reason := strings.ToLower(aws.StringValue(r.Reason))
+	switch {
+	case strings.Contains(reason, "retention") ||
+		strings.Contains(reason, "time range") ||
+		strings.Contains(reason, "timestamp"):
+		return "too_old"
+	case strings.Contains(reason, "same dimensions") ||
+		strings.Contains(reason, "duplicate"):
+		return "version_conflict"
+	case strings.Contains(reason, "measure") ||
+		strings.Contains(reason, "dimension") ||
+		strings.Contains(reason, "invalid") ||
+		strings.Contains(reason, "limit"):
+		return "bad_value"
+	}
+
+	return "unknown"
 }
@@ -0,0 +1,79 @@
+package tsdb
+
+import (
+	"log"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfBatch struct {
+	MaxRecords	int
+	MaxBytes	int
+	MaxLatency	int
+}
+
+// decoded message waiting to be written, raw is the payload it was decoded from
+type tsdbRecord struct {
+	Channel		string
+	Time		time.Time
+	Data		mistdatafmt.MistDataFmtIntf
+	Raw		string
+	Size		int
+}
+
+type tsdbBatch struct {
+	records		[]tsdbRecord
+	size		int
+}
+
+func (i *TsdbIntf) batchEnabled() bool {
+	return i.cfg.Batch.MaxRecords > 0 ||
+		i.cfg.Batch.MaxBytes > 0 ||
+		i.cfg.Batch.MaxLatency > 0
+}
+
+// queue record to table batch, flush if count or size limit has been reached
+func (i *TsdbIntf) batchAdd(tbl string, rec tsdbRecord) error {
+	b, ok := i.batches[tbl]
+	if !ok {
+		b = &tsdbBatch{}
+		i.batches[tbl] = b
+	}
+
+	b.records = append(b.records, rec)
+	b.size += rec.Size
+
+	if !i.batchEnabled() ||
+		(i.cfg.Batch.MaxRecords > 0 && len(b.records) >= i.cfg.Batch.MaxRecords) ||
+		(i.cfg.Batch.MaxBytes > 0 && b.size >= i.cfg.Batch.MaxBytes) {
+		return i.batchFlush(tbl)
+	}
+
+	return nil
+}
+
+func (i *TsdbIntf) batchFlush(tbl string) error {
+	b, ok := i.batches[tbl]
+	if !ok || len(b.records) < 1 {
+		return nil
+	}
+
+	// batch is released regardless of result, backend has already logged the failure
+	delete(i.batches, tbl)
+
+	if i.cfg.Debug {
+		log.Printf("Flushing %d records (%d bytes) for table %s", len(b.records), b.size, tbl)
+	}
+
+	return i.backend.AddRecords(tbl, b.records)
+}
+
+func (i *TsdbIntf) batchFlushAll() {
+	for tbl := range i.batches {
+		err := i.batchFlush(tbl)
+		if err != nil {
+			log.Printf("TSDB driver has thrown error on flush: %v", err)
+		}
+	}
+}
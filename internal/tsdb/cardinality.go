@@ -0,0 +1,272 @@
+package tsdb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TsdbIntfConfCardinality struct {
+	MaxSeries	int
+	Action		string
+	Ttl		int
+	LogInterval	int
+}
+
+// value substituted for the offending dimension in collapse mode
+const CARDINALITY_OTHER = "other"
+
+const (
+	tsdbCardinalityDefaultTtl	= 24
+	tsdbCardinalityDefaultLog	= 300
+	tsdbCardinalityPurgeIntvl	= time.Minute
+	tsdbCardinalityWarnIntvl	= time.Minute
+)
+
+type TsdbCardinalityStat struct {
+	Table		string		`json:"table"`
+	Series		int		`json:"series"`
+	MaxSeries	int		`json:"max_series"`
+	Exceeded	int64		`json:"exceeded"`
+	Dropped		int64		`json:"dropped"`
+	Collapsed	int64		`json:"collapsed"`
+	Dimension	string		`json:"offending_dimension,omitempty"`
+}
+
+// tracks distinct dimension combinations per table, read by stats endpoint from another goroutine
+type tsdbCardinality struct {
+	mu		sync.Mutex
+	max		int
+	action		string
+	ttl		time.Duration
+	keys		map[string][]string
+	tables		map[string]*tsdbCardinalityTable
+	lastPurge	time.Time
+}
+
+type tsdbCardinalityTable struct {
+	series		map[string]time.Time
+	offending	string
+	exceeded	int64
+	dropped		int64
+	collapsed	int64
+	lastWarn	time.Time
+}
+
+func tsdbCardinalityNew(cfg TsdbIntfConfCardinality, dss []TsdbIntfConfDS) (*tsdbCardinality, error) {
+	r := &tsdbCardinality {
+		max:		cfg.MaxSeries,
+		action:		strings.ToLower(cfg.Action),
+		ttl:		time.Duration(cfg.Ttl) * time.Hour,
+		keys:		make(map[string][]string),
+		tables:		make(map[string]*tsdbCardinalityTable),
+		lastPurge:	time.Now(),
+	}
+
+	switch r.action {
+	case "":
+		r.action = "alert"
+	case "alert", "drop", "collapse":
+	default:
+		return nil, fmt.Errorf("Unknown cardinality action: %s", cfg.Action)
+	}
+
+	if r.ttl <= 0 {
+		r.ttl = tsdbCardinalityDefaultTtl * time.Hour
+	}
+
+	for i := 0; i < len(dss); i++ {
+		r.keys[dss[i].Channel] = dss[i].Keys
+	}
+
+	return r, nil
+}
+
+// returns record to write, possibly with a collapsed dimension, or false if it must be dropped
+func (c *tsdbCardinality) check(tbl string, rec tsdbRecord) (tsdbRecord, bool, error) {
+	keys := c.keys[rec.Channel]
+	if len(keys) < 1 {
+		return rec, true, nil
+	}
+
+	vals := make([]string, len(keys))
+	for j, k := range keys {
+		v, err := rec.Data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			return rec, false, fmt.Errorf("JSON key %s does not exist", k)
+		}
+		vals[j] = v
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPurge) > tsdbCardinalityPurgeIntvl {
+		c.purge(now)
+	}
+
+	t, ok := c.tables[tbl]
+	if !ok {
+		t = &tsdbCardinalityTable {
+			series:		make(map[string]time.Time),
+		}
+		c.tables[tbl] = t
+	}
+
+	key := tsdbCardinalityKey(keys, vals)
+	if _, ok := t.series[key]; ok || len(t.series) < c.max {
+		t.series[key] = now
+		return rec, true, nil
+	}
+
+	t.exceeded++
+	warn := now.Sub(t.lastWarn) > tsdbCardinalityWarnIntvl
+	if warn {
+		t.lastWarn = now
+	}
+
+	switch c.action {
+	case "drop":
+		t.dropped++
+		if warn {
+			log.Printf("Table %s reached %d series, dropping records with new dimension values", tbl, c.max)
+		}
+		return rec, false, nil
+
+	case "collapse":
+		if t.offending == "" {
+			t.offending = t.offendingDimension()
+		}
+
+		found := false
+		collapsed := false
+		for j, k := range keys {
+			if k != t.offending {
+				continue
+			}
+
+			found = true
+			if vals[j] != CARDINALITY_OTHER {
+				vals[j] = CARDINALITY_OTHER
+				collapsed = true
+			}
+		}
+
+		// record has no such dimension to collapse, writing it would still add a new series
+		if !found {
+			t.dropped++
+			if warn {
+				log.Printf("Table %s reached %d series, dropping records without dimension %s", tbl, c.max, t.offending)
+			}
+			return rec, false, nil
+		}
+
+		if collapsed {
+			data := tsdbOverlayNew(rec.Data)
+			data.Set(t.offending, CARDINALITY_OTHER)
+			rec.Data = data
+			t.collapsed++
+		}
+
+		if warn {
+			log.Printf("Table %s reached %d series, collapsing dimension %s to %s", tbl, c.max, t.offending, CARDINALITY_OTHER)
+		}
+
+		// collapsed series are bounded by remaining dimensions and always written
+		t.series[tsdbCardinalityKey(keys, vals)] = now
+		return rec, true, nil
+	}
+
+	if warn {
+		log.Printf("Table %s exceeded %d series, now at %d", tbl, c.max, len(t.series) + 1)
+	}
+	t.series[key] = now
+	return rec, true, nil
+}
+
+func tsdbCardinalityKey(keys []string, vals []string) string {
+	var kv []string
+	for j := 0; j < len(keys); j++ {
+		kv = append(kv, keys[j] + "=" + vals[j])
+	}
+
+	return strings.Join(kv, "\x00")
+}
+
+// dimension with most distinct values, the likely cause of the growth
+func (t *tsdbCardinalityTable) offendingDimension() string {
+	distinct := make(map[string]map[string]bool)
+	for key := range t.series {
+		for _, kv := range strings.Split(key, "\x00") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) < 2 {
+				continue
+			}
+
+			if distinct[p[0]] == nil {
+				distinct[p[0]] = make(map[string]bool)
+			}
+			distinct[p[0]][p[1]] = true
+		}
+	}
+
+	r := ""
+	for k, v := range distinct {
+		if r == "" || len(v) > len(distinct[r]) || (len(v) == len(distinct[r]) && k < r) {
+			r = k
+		}
+	}
+
+	return r
+}
+
+// forget series not seen within ttl, caller holds lock
+func (c *tsdbCardinality) purge(now time.Time) {
+	for _, t := range c.tables {
+		for k, v := range t.series {
+			if now.Sub(v) > c.ttl {
+				delete(t.series, k)
+			}
+		}
+
+		if len(t.series) < c.max {
+			t.offending = ""
+		}
+	}
+
+	c.lastPurge = now
+}
+
+func (c *tsdbCardinality) stats() []TsdbCardinalityStat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var r []TsdbCardinalityStat
+	for tbl, t := range c.tables {
+		s := TsdbCardinalityStat {
+			Table:		tbl,
+			Series:		len(t.series),
+			MaxSeries:	c.max,
+			Exceeded:	t.exceeded,
+			Dropped:	t.dropped,
+			Collapsed:	t.collapsed,
+			Dimension:	t.offending,
+		}
+
+		r = append(r, s)
+	}
+
+	sort.Slice(r, func(a, b int) bool { return r[a].Table < r[b].Table })
+	return r
+}
+
+func (c *tsdbCardinality) logStats() {
+	for _, s := range c.stats() {
+		log.Printf("Table %s has %d/%d series (exceeded %d, dropped %d, collapsed %d)",
+			s.Table, s.Series, s.MaxSeries, s.Exceeded, s.Dropped, s.Collapsed)
+	}
+}
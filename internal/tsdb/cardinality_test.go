@@ -0,0 +1,234 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+)
+
+func cardinalityTestNew(t *testing.T, action string) *tsdbCardinality {
+	c, err := tsdbCardinalityNew(TsdbIntfConfCardinality { MaxSeries: 2, Action: action }, []TsdbIntfConfDS {
+		{ Channel: walTestChannelA, Keys: []string{"ssid", "mac"} },
+		{ Channel: walTestChannelB, Keys: []string{"ssid"} },
+		{ Channel: "/sites/s3/stats/clients", Keys: []string{"no_such_key"} },
+		{ Channel: "/sites/s4/stats/clients" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func cardinalityTestRecord(t *testing.T, channel string, ssid string, mac string) tsdbRecord {
+	data, err := tsdbLayoutDecode("stats_client", `{"mac":"` + mac + `","ssid":"` + ssid + `"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tsdbRecord {
+		Channel:	channel,
+		Time:		time.Now(),
+		Data:		data,
+	}
+}
+
+func TestCardinalityCheck(t *testing.T) {
+	type write struct {
+		channel		string
+		ssid		string
+		mac		string
+		keep		bool
+		wantMac		string
+	}
+
+	tests := []struct {
+		name		string
+		action		string
+		writes		[]write
+		series		int
+		stat		TsdbCardinalityStat
+	}{
+		{
+			name:	"alert keeps every record",
+			action:	"",
+			writes:	[]write {
+					{ channel: walTestChannelA, ssid: "corp", mac: "a", keep: true },
+					{ channel: walTestChannelA, ssid: "corp", mac: "b", keep: true },
+					{ channel: walTestChannelA, ssid: "corp", mac: "c", keep: true },
+					{ channel: walTestChannelA, ssid: "corp", mac: "a", keep: true },
+				},
+			series:	3,
+			stat:	TsdbCardinalityStat { Exceeded: 1 },
+		},
+		{
+			name:	"drop refuses new series only",
+			action:	"drop",
+			writes:	[]write {
+					{ channel: walTestChannelA, ssid: "corp", mac: "a", keep: true },
+					{ channel: walTestChannelA, ssid: "corp", mac: "b", keep: true },
+					{ channel: walTestChannelA, ssid: "corp", mac: "c", keep: false },
+					{ channel: walTestChannelA, ssid: "corp", mac: "a", keep: true },
+					{ channel: walTestChannelA, ssid: "guest", mac: "b", keep: false },
+				},
+			series:	2,
+			stat:	TsdbCardinalityStat { Exceeded: 2, Dropped: 2 },
+		},
+		{
+			name:	"collapse replaces dimension with most values",
+			action:	"collapse",
+			writes:	[]write {
+					{ channel: walTestChannelA, ssid: "corp", mac: "a", keep: true, wantMac: "a" },
+					{ channel: walTestChannelA, ssid: "corp", mac: "b", keep: true, wantMac: "b" },
+					{ channel: walTestChannelA, ssid: "corp", mac: "c", keep: true, wantMac: CARDINALITY_OTHER },
+					{ channel: walTestChannelA, ssid: "corp", mac: "d", keep: true, wantMac: CARDINALITY_OTHER },
+				},
+			series:	3,
+			stat:	TsdbCardinalityStat { Exceeded: 2, Collapsed: 2, Dimension: "mac" },
+		},
+		{
+			name:	"collapse drops records without that dimension",
+			action:	"collapse",
+			writes:	[]write {
+					{ channel: walTestChannelA, ssid: "corp", mac: "a", keep: true, wantMac: "a" },
+					{ channel: walTestChannelA, ssid: "corp", mac: "b", keep: true, wantMac: "b" },
+					{ channel: walTestChannelB, ssid: "guest", mac: "c", keep: false },
+				},
+			series:	2,
+			stat:	TsdbCardinalityStat { Exceeded: 1, Dropped: 1, Dimension: "mac" },
+		},
+		{
+			name:	"channel without keys is not tracked",
+			action:	"drop",
+			writes:	[]write {
+					{ channel: "/sites/s4/stats/clients", ssid: "corp", mac: "a", keep: true },
+					{ channel: "/sites/s4/stats/clients", ssid: "corp", mac: "b", keep: true },
+					{ channel: "/sites/s4/stats/clients", ssid: "corp", mac: "c", keep: true },
+				},
+		},
+	}
+
+	for _, tt := range tests {
+		c := cardinalityTestNew(t, tt.action)
+
+		for n, w := range tt.writes {
+			rec, keep, err := c.check("clients", cardinalityTestRecord(t, w.channel, w.ssid, w.mac))
+			if err != nil {
+				t.Fatalf("%s: write %d: %v", tt.name, n, err)
+			} else if keep != w.keep {
+				t.Errorf("%s: write %d: kept %v, want %v", tt.name, n, keep, w.keep)
+				continue
+			}
+
+			if w.wantMac == "" {
+				continue
+			}
+			mac, _ := rec.Data.GetJsonKeyValueAsStr("mac")
+			if mac != w.wantMac {
+				t.Errorf("%s: write %d: mac is %s, want %s", tt.name, n, mac, w.wantMac)
+			}
+		}
+
+		var got TsdbCardinalityStat
+		for _, s := range c.stats() {
+			got = s
+		}
+		if got.Series != tt.series || got.Exceeded != tt.stat.Exceeded || got.Dropped != tt.stat.Dropped ||
+			got.Collapsed != tt.stat.Collapsed || got.Dimension != tt.stat.Dimension {
+			t.Errorf("%s: got stats %+v, want %d series and %+v", tt.name, got, tt.series, tt.stat)
+		}
+	}
+
+	// records missing a key cannot be counted
+	c := cardinalityTestNew(t, "drop")
+	_, _, err := c.check("clients", cardinalityTestRecord(t, "/sites/s3/stats/clients", "corp", "a"))
+	if err == nil {
+		t.Errorf("expected error for missing key")
+	}
+
+	_, err = tsdbCardinalityNew(TsdbIntfConfCardinality { MaxSeries: 2, Action: "sample" }, nil)
+	if err == nil {
+		t.Errorf("expected error for unknown action")
+	}
+}
+
+func TestCardinalityOffendingDimension(t *testing.T) {
+	keys := []string{"ssid", "mac"}
+
+	tests := []struct {
+		name		string
+		series		[][]string
+		want		string
+	}{
+		{
+			name:	"most distinct values",
+			series:	[][]string{{"corp", "a"}, {"corp", "b"}, {"guest", "c"}},
+			want:	"mac",
+		},
+		{
+			name:	"tie goes to name sorting first",
+			series:	[][]string{{"corp", "a"}, {"guest", "b"}},
+			want:	"mac",
+		},
+		{
+			name:	"other dimension",
+			series:	[][]string{{"corp", "a"}, {"guest", "a"}, {"lab", "a"}},
+			want:	"ssid",
+		},
+		{
+			name:	"no series",
+			want:	"",
+		},
+	}
+
+	for _, tt := range tests {
+		tbl := &tsdbCardinalityTable {
+			series:		make(map[string]time.Time),
+		}
+		for _, v := range tt.series {
+			tbl.series[tsdbCardinalityKey(keys, v)] = time.Now()
+		}
+
+		got := tbl.offendingDimension()
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCardinalityPurge(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name		string
+		seen		[]time.Duration
+		series		int
+		offending	string
+	}{
+		{ name: "all expired", seen: []time.Duration{25 * time.Hour, 48 * time.Hour}, series: 0, offending: "" },
+		{ name: "some expired", seen: []time.Duration{time.Hour, 25 * time.Hour, 2 * time.Hour}, series: 2, offending: "mac" },
+		{ name: "none expired", seen: []time.Duration{time.Minute, time.Hour}, series: 2, offending: "mac" },
+	}
+
+	for _, tt := range tests {
+		c := cardinalityTestNew(t, "collapse")
+		tbl := &tsdbCardinalityTable {
+			series:		make(map[string]time.Time),
+			offending:	"mac",
+		}
+		for n, v := range tt.seen {
+			tbl.series[tsdbCardinalityKey([]string{"mac"}, []string{string(rune('a' + n))})] = now.Add(-v)
+		}
+		c.tables["clients"] = tbl
+
+		c.purge(now)
+
+		// offending dimension is chosen again once table is back under its ceiling
+		if len(tbl.series) != tt.series || tbl.offending != tt.offending {
+			t.Errorf("%s: got %d series offending %q, want %d offending %q",
+				tt.name, len(tbl.series), tbl.offending, tt.series, tt.offending)
+		}
+		if !c.lastPurge.Equal(now) {
+			t.Errorf("%s: last purge time not updated", tt.name)
+		}
+	}
+}
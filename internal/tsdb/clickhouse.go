@@ -0,0 +1,450 @@
+package tsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDrvClickHouse struct {
+	Url		string
+	Database	string
+	User		string
+	Password	string
+	Timeout		int
+	TtlDays		int
+}
+
+// keep single insert request at a reasonable size
+const clickhouseMaxRows = 100000
+
+// DateTime64 text format accepted by JSONEachRow input
+const clickhouseTimeFormat = "2006-01-02 15:04:05.000000000"
+
+type tsdbIntfClickHouse struct {
+	debug		bool
+	url		string
+	database	string
+	user		string
+	password	string
+	ttlDays		int
+	dataOut		map[string]tsdbIntfClickHouseDataOut
+	tables		[]string
+	columns		map[string][]tsdbIntfClickHouseColumn
+
+	httpClient	*http.Client
+}
+
+type tsdbIntfClickHouseColumn struct {
+	Key		string
+	Type		string
+}
+
+type tsdbIntfClickHouseDataOut struct {
+	Channel		string
+	Table		string
+	Raw		bool
+	Keys		[]string
+	Metrics		[]tsdbIntfClickHouseColumn
+}
+
+func tsdbIntfClickHouseNew(cfg TsdbIntfConf) (*tsdbIntfClickHouse, error) {
+	// check valid parameter
+	if cfg.DriverClickHouse.Url == "" {
+		return nil, fmt.Errorf("ClickHouse URL not specified")
+	}
+
+	if cfg.DriverClickHouse.Database == "" {
+		return nil, fmt.Errorf("ClickHouse database not specified")
+	}
+
+	if cfg.DriverClickHouse.Timeout < 1 {
+		return nil, fmt.Errorf("ClickHouse timeout is below 1")
+	}
+
+	_, err := url.Parse(cfg.DriverClickHouse.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ClickHouse URL: %v", err)
+	}
+
+	// start building interface
+	r := &tsdbIntfClickHouse {
+		debug:		cfg.Debug,
+		url:		cfg.DriverClickHouse.Url,
+		database:	cfg.DriverClickHouse.Database,
+		user:		cfg.DriverClickHouse.User,
+		password:	cfg.DriverClickHouse.Password,
+		ttlDays:	cfg.DriverClickHouse.TtlDays,
+		dataOut:	make(map[string]tsdbIntfClickHouseDataOut),
+		columns:	make(map[string][]tsdbIntfClickHouseColumn),
+		httpClient:	&http.Client {
+					Timeout: time.Duration(cfg.DriverClickHouse.Timeout) * time.Second,
+				},
+	}
+
+	// build data out
+	for i := 0; i < len(cfg.Datasource); i++ {
+		if cfg.Datasource[i].Channel == "" ||
+			cfg.Datasource[i].Table == "" {
+			return nil, fmt.Errorf("Missing mandatory data out parameter")
+		}
+
+		dout := tsdbIntfClickHouseDataOut {
+			Channel:	cfg.Datasource[i].Channel,
+			Table:		cfg.Datasource[i].Table,
+			Raw:		strings.ToLower(cfg.Datasource[i].Datalayout) == LAYOUT_RAW,
+			Keys:		cfg.Datasource[i].Keys,
+		}
+
+		for j := 0; j < len(cfg.Datasource[i].Metrics); j++ {
+			t := strings.ToUpper(cfg.Datasource[i].Metrics[j].Type)
+			switch t {
+			case "BIGINT":
+			case "BOOLEAN":
+			case "DOUBLE":
+			case "VARCHAR":
+			default:
+				return nil, fmt.Errorf("Unsupported data type for ClickHouse: %s", t)
+			}
+
+			m := tsdbIntfClickHouseColumn {
+				Key:	cfg.Datasource[i].Metrics[j].Key,
+				Type:	t,
+			}
+
+			dout.Metrics = append(dout.Metrics, m)
+		}
+
+		// gather columns per table in config order, first datasource decides sort key
+		if _, ok := r.columns[dout.Table]; !ok {
+			r.tables = append(r.tables, dout.Table)
+		}
+
+		cols := r.columns[dout.Table]
+		if dout.Raw {
+			cols = append(cols,
+				tsdbIntfClickHouseColumn { Key: "channel", Type: "KEY" },
+				tsdbIntfClickHouseColumn { Key: "data", Type: "VARCHAR" },
+			)
+		} else {
+			for _, k := range dout.Keys {
+				cols = append(cols, tsdbIntfClickHouseColumn { Key: k, Type: "KEY" })
+			}
+			cols = append(cols, dout.Metrics...)
+		}
+		r.columns[dout.Table] = cols
+
+		r.dataOut[cfg.Datasource[i].Channel] = dout
+	}
+
+	err = r.initSchema()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("ClickHouse client ready: %s", cfg.DriverClickHouse.Url)
+	return r, nil
+}
+
+// ref. https://clickhouse.com/docs/en/sql-reference/data-types
+func clickhouseColumnType(t string) string {
+	switch t {
+	case "KEY":
+		// dimensions take part in sort key, which does not allow nullable columns
+		return "String"
+	case "BIGINT":
+		return "Nullable(Int64)"
+	case "BOOLEAN":
+		return "Nullable(Bool)"
+	case "DOUBLE":
+		return "Nullable(Float64)"
+	}
+
+	return "Nullable(String)"
+}
+
+func clickhouseQuoteIdentifier(v string) string {
+	return "`" + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), "`", "\\`") + "`"
+}
+
+func (i *tsdbIntfClickHouse) tableName(tbl string) string {
+	return clickhouseQuoteIdentifier(i.database) + "." + clickhouseQuoteIdentifier(tbl)
+}
+
+func (i *tsdbIntfClickHouse) initSchema() error {
+	var err error
+
+	for _, tbl := range i.tables {
+		name := i.tableName(tbl)
+
+		var defs []string
+		var order []string
+		seen := make(map[string]bool)
+		for _, c := range i.columns[tbl] {
+			if seen[c.Key] {
+				continue
+			}
+			seen[c.Key] = true
+
+			defs = append(defs, clickhouseQuoteIdentifier(c.Key) + " " + clickhouseColumnType(c.Type))
+			if c.Type == "KEY" {
+				order = append(order, clickhouseQuoteIdentifier(c.Key))
+			}
+		}
+		order = append(order, "time")
+
+		// partition by month keeps parts manageable and lets TTL drop whole partitions
+		// ref. https://clickhouse.com/docs/en/engines/table-engines/mergetree-family/mergetree
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) " +
+			"ENGINE = MergeTree PARTITION BY toYYYYMM(time) ORDER BY (%s)",
+			name, strings.Join(append([]string{"time DateTime64(9, 'UTC')"}, defs...), ", "), strings.Join(order, ", "))
+		if i.ttlDays > 0 {
+			query += fmt.Sprintf(" TTL toDateTime(time) + INTERVAL %d DAY", i.ttlDays)
+		}
+
+		log.Printf("Ensuring table %s exists..", name)
+		err = i.exec(query, nil)
+		if err != nil {
+			log.Printf("Could not create table: %v", err)
+			return err
+		}
+
+		// add columns that were introduced in config since last start, sort key stays as created
+		for _, d := range defs {
+			err = i.exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", name, d), nil)
+			if err != nil {
+				log.Printf("Could not add column to table %s: %v", name, err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfClickHouse) AddRecords(tbl string, records []tsdbRecord) error {
+	var rows [][]byte
+	var recs []tsdbRecord
+	var failed int
+
+	for _, rec := range records {
+		outParams, ok := i.dataOut[rec.Channel]
+		if !ok {
+			log.Printf("Data out parameters for channel %s was not found", rec.Channel)
+			failed++
+			continue
+		}
+
+		row, err := i.buildRow(outParams, rec.Time, rec.Data)
+		if err != nil {
+			log.Printf("Failed to build row for channel %s: %v", rec.Channel, err)
+			failed++
+			continue
+		}
+
+		rows = append(rows, row)
+		recs = append(recs, rec)
+	}
+
+	// keep going after a failed insert, only failed ones are retried
+	var errs []error
+	var retry []tsdbRecord
+	for start := 0; start < len(rows); start += clickhouseMaxRows {
+		end := start + clickhouseMaxRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		err := i.writeRows(tbl, rows[start:end])
+		if tsdbRetriable(err) {
+			retry = append(retry, recs[start:end]...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d records could not be built for table %s", failed, len(records), tbl))
+	}
+
+	return tsdbRetryJoin(errs, retry)
+}
+
+func (i *tsdbIntfClickHouse) buildRow(outParams tsdbIntfClickHouseDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) ([]byte, error) {
+	row := map[string]interface{} {
+		"time":	ts.UTC().Format(clickhouseTimeFormat),
+	}
+
+	for _, v := range outParams.Keys {
+		kval, err := data.GetJsonKeyValueAsStr(v)
+		if err != nil {
+			return nil, fmt.Errorf("JSON key %s does not exist", v)
+		}
+		row[v] = kval
+	}
+
+	for _, v := range outParams.Metrics {
+		rval, err := data.GetJsonKeyValueAsStr(v.Key)
+		if err != nil {
+			return nil, fmt.Errorf("JSON key %s does not exist", v.Key)
+		}
+
+		// empty measurements are stored as null
+		var fval interface{}
+		if rval != "" {
+			fval, err = tsdbFieldValue(v.Type, rval)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for JSON key %s: %v", v.Key, err)
+			}
+		}
+		row[v.Key] = fval
+	}
+
+	return json.Marshal(row)
+}
+
+func (i *tsdbIntfClickHouse) AddRecordRaw(channel string, ts time.Time, data string) error {
+	outParams, ok := i.dataOut[channel]
+	if !ok {
+		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+	}
+
+	row, err := json.Marshal(map[string]interface{} {
+		"time":		ts.UTC().Format(clickhouseTimeFormat),
+		"channel":	channel,
+		"data":		data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return i.writeRows(outParams.Table, [][]byte{row})
+}
+
+func (i *tsdbIntfClickHouse) writeRows(tbl string, rows [][]byte) error {
+	if len(rows) < 1 {
+		return nil
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", i.tableName(tbl))
+	body := append(bytes.Join(rows, []byte("\n")), '\n')
+
+	if i.debug {
+		log.Printf("Query: %s Rows: %d", query, len(rows))
+	}
+
+	return i.exec(query, body)
+}
+
+// runs query over HTTP interface, insert data is sent as request body
+// ref. https://clickhouse.com/docs/en/interfaces/http
+func (i *tsdbIntfClickHouse) exec(query string, data []byte) error {
+	u, err := url.Parse(i.url)
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	body := []byte(query)
+	if data != nil {
+		q.Set("query", query)
+		body = data
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if i.user != "" {
+		req.Header.Set("X-ClickHouse-User", i.user)
+	}
+	if i.password != "" {
+		req.Header.Set("X-ClickHouse-Key", i.password)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to execute query: %v", err)
+		return &tsdbRetryError{err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("ClickHouse query failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+
+		if clickhouseRetriable(resp.StatusCode, clickhouseExceptionCode(resp.Header, msg)) {
+			return &tsdbRetryError{err: err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// exception codes caused by the query or data itself, sending it again fails the same way
+// ref. https://github.com/ClickHouse/ClickHouse/blob/master/src/Common/ErrorCodes.cpp
+var clickhousePermanentCodes = map[int]bool {
+	6:	true,	// CANNOT_PARSE_TEXT
+	16:	true,	// NO_SUCH_COLUMN_IN_TABLE
+	26:	true,	// CANNOT_PARSE_QUOTED_STRING
+	27:	true,	// CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	36:	true,	// BAD_ARGUMENTS
+	41:	true,	// CANNOT_PARSE_DATETIME
+	44:	true,	// ILLEGAL_COLUMN
+	47:	true,	// UNKNOWN_IDENTIFIER
+	53:	true,	// TYPE_MISMATCH
+	60:	true,	// UNKNOWN_TABLE
+	62:	true,	// SYNTAX_ERROR
+	70:	true,	// CANNOT_CONVERT_TYPE
+	72:	true,	// CANNOT_PARSE_NUMBER
+	81:	true,	// UNKNOWN_DATABASE
+	117:	true,	// INCORRECT_DATA
+	497:	true,	// ACCESS_DENIED
+	516:	true,	// AUTHENTICATION_FAILED
+}
+
+// server sends code in a header, older ones only in the "Code: N. DB::Exception" message
+func clickhouseExceptionCode(h http.Header, msg []byte) int {
+	v := h.Get("X-ClickHouse-Exception-Code")
+	if v == "" {
+		s := strings.TrimSpace(string(msg))
+		if !strings.HasPrefix(s, "Code: ") {
+			return 0
+		}
+		v = strings.SplitN(strings.TrimPrefix(s, "Code: "), ".", 2)[0]
+	}
+
+	code, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return 0
+	}
+
+	return code
+}
+
+// 5xx covers overload and failures of the server or a node behind it, unless the exception blames the request
+func clickhouseRetriable(status int, code int) bool {
+	if clickhousePermanentCodes[code] {
+		return false
+	}
+
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func (i *tsdbIntfClickHouse) Close() error {
+	i.httpClient.CloseIdleConnections()
+	return nil
+}
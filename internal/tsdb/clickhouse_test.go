@@ -0,0 +1,262 @@
+package tsdb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type clickhouseTestRequest struct {
+	query		string
+	body		string
+	user		string
+	key		string
+}
+
+// HTTP interface recording every request, answering with status, exception code and message once set
+type clickhouseTestServer struct {
+	mu		sync.Mutex
+	requests	[]clickhouseTestRequest
+	status		int
+	code		string
+	msg		string
+}
+
+func (s *clickhouseTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	s.requests = append(s.requests, clickhouseTestRequest {
+		query:	r.URL.Query().Get("query"),
+		body:	string(body),
+		user:	r.Header.Get("X-ClickHouse-User"),
+		key:	r.Header.Get("X-ClickHouse-Key"),
+	})
+
+	if s.status != 0 {
+		if s.code != "" {
+			w.Header().Set("X-ClickHouse-Exception-Code", s.code)
+		}
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.msg))
+	}
+}
+
+func (s *clickhouseTestServer) reset(status int, code string, msg string) []clickhouseTestRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.requests
+	s.requests = nil
+	s.status = status
+	s.code = code
+	s.msg = msg
+
+	return r
+}
+
+func clickhouseTestNew(t *testing.T) (*tsdbIntfClickHouse, *clickhouseTestServer) {
+	srv := &clickhouseTestServer{}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	cfg := TsdbIntfConf {
+		DriverClickHouse:	TsdbIntfConfDrvClickHouse {
+						Url:		ts.URL,
+						Database:	"mist",
+						User:		"writer",
+						Password:	"secret",
+						Timeout:	5,
+						TtlDays:	30,
+					},
+		Datasource:		[]TsdbIntfConfDS {
+						{
+							Channel:	"/sites/s1/stats/clients",
+							Datalayout:	"stats_client",
+							Table:		"clients",
+							Keys:		[]string{"mac"},
+							Metrics:	[]TsdbIntfConfDSMetric {
+										{ Key: "rssi", Type: "bigint" },
+										{ Key: "hostname", Type: "VARCHAR" },
+									},
+						},
+						{
+							// shares table, adds its own metric after the first datasource's columns
+							Channel:	"/sites/s2/stats/clients",
+							Datalayout:	"stats_client",
+							Table:		"clients",
+							Keys:		[]string{"mac"},
+							Metrics:	[]TsdbIntfConfDSMetric {
+										{ Key: "rssi", Type: "BIGINT" },
+										{ Key: "dual_band", Type: "BOOLEAN" },
+									},
+						},
+						{
+							Channel:	"/sites/s1/raw",
+							Datalayout:	"raw",
+							Table:		"raw",
+						},
+					},
+	}
+
+	b, err := tsdbIntfClickHouseNew(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, srv
+}
+
+func TestClickHouseInitSchema(t *testing.T) {
+	_, srv := clickhouseTestNew(t)
+
+	want := []string {
+		"CREATE TABLE IF NOT EXISTS `mist`.`clients` (time DateTime64(9, 'UTC'), `mac` String, " +
+			"`rssi` Nullable(Int64), `hostname` Nullable(String), `dual_band` Nullable(Bool)) " +
+			"ENGINE = MergeTree PARTITION BY toYYYYMM(time) ORDER BY (`mac`, time) " +
+			"TTL toDateTime(time) + INTERVAL 30 DAY",
+		"ALTER TABLE `mist`.`clients` ADD COLUMN IF NOT EXISTS `mac` String",
+		"ALTER TABLE `mist`.`clients` ADD COLUMN IF NOT EXISTS `rssi` Nullable(Int64)",
+		"ALTER TABLE `mist`.`clients` ADD COLUMN IF NOT EXISTS `hostname` Nullable(String)",
+		"ALTER TABLE `mist`.`clients` ADD COLUMN IF NOT EXISTS `dual_band` Nullable(Bool)",
+		"CREATE TABLE IF NOT EXISTS `mist`.`raw` (time DateTime64(9, 'UTC'), `channel` String, `data` Nullable(String)) " +
+			"ENGINE = MergeTree PARTITION BY toYYYYMM(time) ORDER BY (`channel`, time) " +
+			"TTL toDateTime(time) + INTERVAL 30 DAY",
+		"ALTER TABLE `mist`.`raw` ADD COLUMN IF NOT EXISTS `channel` String",
+		"ALTER TABLE `mist`.`raw` ADD COLUMN IF NOT EXISTS `data` Nullable(String)",
+	}
+
+	got := srv.reset(0, "", "")
+	if len(got) != len(want) {
+		t.Fatalf("got %d statements, want %d: %v", len(got), len(want), got)
+	}
+
+	// statements without data are sent as body, credentials as headers
+	for n := range want {
+		if got[n].body != want[n] || got[n].query != "" {
+			t.Errorf("statement %d:\ngot  %s\nwant %s", n, got[n].body, want[n])
+		}
+		if got[n].user != "writer" || got[n].key != "secret" {
+			t.Errorf("statement %d: sent credentials %s/%s", n, got[n].user, got[n].key)
+		}
+	}
+}
+
+func TestClickHouseAddRecords(t *testing.T) {
+	b, srv := clickhouseTestNew(t)
+	srv.reset(0, "", "")
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	var records []tsdbRecord
+	for _, v := range []struct {
+		channel		string
+		payload		string
+	}{
+		{ "/sites/s1/stats/clients", `{"mac":"a","rssi":-61,"hostname":"laptop"}` },
+		{ "/sites/s2/stats/clients", `{"mac":"b","rssi":-70,"dual_band":true}` },
+		// empty measurements are written as null
+		{ "/sites/s1/stats/clients", `{"mac":"c"}` },
+	} {
+		data, err := tsdbLayoutDecode("stats_client", v.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, tsdbRecord { Channel: v.channel, Time: ts, Data: data })
+	}
+
+	err := b.AddRecords("clients", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.AddRecordRaw("/sites/s1/raw", ts, `not "json"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []clickhouseTestRequest {
+		{
+			query:	"INSERT INTO `mist`.`clients` FORMAT JSONEachRow",
+			body:	`{"hostname":"laptop","mac":"a","rssi":-61,"time":"2024-01-02 03:04:05.000000006"}` + "\n" +
+				`{"dual_band":true,"mac":"b","rssi":-70,"time":"2024-01-02 03:04:05.000000006"}` + "\n" +
+				`{"hostname":null,"mac":"c","rssi":null,"time":"2024-01-02 03:04:05.000000006"}` + "\n",
+		},
+		{
+			query:	"INSERT INTO `mist`.`raw` FORMAT JSONEachRow",
+			body:	`{"channel":"/sites/s1/raw","data":"not \"json\"","time":"2024-01-02 03:04:05.000000006"}` + "\n",
+		},
+	}
+
+	got := srv.reset(0, "", "")
+	if len(got) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(got), len(want))
+	}
+	for n := range want {
+		if got[n].query != want[n].query || got[n].body != want[n].body {
+			t.Errorf("request %d:\ngot  %s\n%s\nwant %s\n%s", n, got[n].query, got[n].body, want[n].query, want[n].body)
+		}
+	}
+
+	// invalid values are not sent, the rest of the batch is
+	data, err := tsdbLayoutDecode("stats_client", `{"mac":"d","hostname":"x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.dataOut["/sites/s1/stats/clients"].Metrics[1].Type = "DOUBLE"
+	err = b.AddRecords("clients", []tsdbRecord {
+		records[1],
+		{ Channel: "/sites/s1/stats/clients", Time: ts, Data: data },
+	})
+	if err == nil || tsdbRetriable(err) {
+		t.Errorf("got error %v, want non-retriable error", err)
+	}
+	if got := srv.reset(0, "", ""); len(got) != 1 || strings.Count(got[0].body, "\n") != 1 {
+		t.Errorf("unexpected requests %v", got)
+	}
+}
+
+func TestClickHouseErrors(t *testing.T) {
+	b, srv := clickhouseTestNew(t)
+
+	tests := []struct {
+		name		string
+		status		int
+		code		string
+		msg		string
+		retry		bool
+	}{
+		{ name: "too many requests", status: http.StatusTooManyRequests, retry: true },
+		{ name: "service unavailable", status: http.StatusServiceUnavailable, retry: true },
+		{ name: "server error", status: http.StatusInternalServerError, msg: "Code: 241. DB::Exception: Memory limit exceeded", retry: true },
+		{ name: "too many parts", status: http.StatusInternalServerError, code: "252", retry: true },
+		{ name: "syntax error", status: http.StatusInternalServerError, code: "62" },
+		{ name: "bad data in message only", status: http.StatusInternalServerError, msg: "Code: 27. DB::Exception: Cannot parse input" },
+		{ name: "unknown table", status: http.StatusNotFound, code: "60" },
+		{ name: "authentication", status: http.StatusUnauthorized, code: "516" },
+		{ name: "bad request", status: http.StatusBadRequest },
+	}
+
+	for _, tt := range tests {
+		srv.reset(tt.status, tt.code, tt.msg)
+
+		err := b.AddRecordRaw("/sites/s1/raw", time.Now(), "{}")
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		} else if tsdbRetriable(err) != tt.retry {
+			t.Errorf("%s: retriable is %v, want %v (%v)", tt.name, tsdbRetriable(err), tt.retry, err)
+		}
+	}
+
+	// server which cannot be reached is retried
+	srv.reset(0, "", "")
+	b.url = "http://127.0.0.1:1"
+	err := b.AddRecordRaw("/sites/s1/raw", time.Now(), "{}")
+	if !tsdbRetriable(err) {
+		t.Errorf("got error %v, want retriable error", err)
+	}
+}
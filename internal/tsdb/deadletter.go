@@ -0,0 +1,134 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yumyudai/misttools/internal/common"
+)
+
+// origin used for dead-letter messages sent to pubsub
+const DEADLETTER_ORIGIN = "tsdb/deadletter"
+
+type TsdbIntfConfDeadLetter struct {
+	Driver		string
+	Path		string
+	DataOutChannel	chan common.MistApiData
+}
+
+type tsdbDeadLetter struct {
+	Time		time.Time	`json:"time"`
+	Driver		string		`json:"driver"`
+	Table		string		`json:"table"`
+	Reason		string		`json:"reason"`
+	Detail		string		`json:"detail"`
+	Record		interface{}	`json:"record"`
+}
+
+// one sink is shared by every driver and write-ahead buffer, closed on shutdown
+type tsdbDeadLetterSink interface {
+	Write(tsdbDeadLetter) error
+	Close() error
+}
+
+func tsdbDeadLetterNew(cfg TsdbIntfConfDeadLetter) (tsdbDeadLetterSink, error) {
+	switch cfg.Driver {
+	case "":
+		return &tsdbDeadLetterLog{}, nil
+
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("Dead-letter file path not specified")
+		}
+
+		f, err := os.OpenFile(cfg.Path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tsdbDeadLetterFile{f: f}, nil
+
+	case "pubsub":
+		if cfg.DataOutChannel == nil {
+			return nil, fmt.Errorf("Dead-letter output to pubsub requires pubsub to be enabled")
+		}
+
+		return &tsdbDeadLetterPubsub{out: cfg.DataOutChannel}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown dead-letter driver: %s", cfg.Driver)
+}
+
+// default sink, records are only logged
+type tsdbDeadLetterLog struct{}
+
+func (s *tsdbDeadLetterLog) Write(e tsdbDeadLetter) error {
+	log.Printf("Dropping record for table %s (%s: %s): %v", e.Table, e.Reason, e.Detail, e.Record)
+	return nil
+}
+
+func (s *tsdbDeadLetterLog) Close() error {
+	return nil
+}
+
+// appends one JSON document per line
+type tsdbDeadLetterFile struct {
+	mu		sync.Mutex
+	f		*os.File
+}
+
+func (s *tsdbDeadLetterFile) Write(e tsdbDeadLetter) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+func (s *tsdbDeadLetterFile) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// hands record to pubsub interface, which routes DEADLETTER_ORIGIN to the configured topic
+type tsdbDeadLetterPubsub struct {
+	out		chan common.MistApiData
+}
+
+func (s *tsdbDeadLetterPubsub) Write(e tsdbDeadLetter) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	msg := common.MistApiData {
+		Origin:		DEADLETTER_ORIGIN,
+		Data:		string(b),
+		RecvTime:	e.Time,
+	}
+
+	// never block the writer on a stalled pubsub
+	select {
+	case s.out <- msg:
+	default:
+		return fmt.Errorf("Pubsub channel is full, dead-letter record for table %s was dropped", e.Table)
+	}
+
+	return nil
+}
+
+// channel belongs to pubsub interface, it is not closed here
+func (s *tsdbDeadLetterPubsub) Close() error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package tsdb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterSharedSink(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := walTestConf("")
+	cfg.Backends = []TsdbIntfConfBackend {
+		{ Name: "first", Driver: "dummy" },
+		{ Name: "second", Driver: "dummy" },
+	}
+	cfg.DeadLetter.Driver = "file"
+	cfg.DeadLetter.Path = filepath.Join(dir, "deadletter.jsonl")
+
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every write-ahead buffer writes through the sink built once in New
+	for _, m := range r.backend.(*tsdbFanout).members {
+		if m.backend.(*tsdbWalNone).deadLetter != r.deadLetter {
+			t.Errorf("backend %s has its own dead-letter sink", m.name)
+		}
+	}
+
+	err = r.deadLetter.Write(tsdbDeadLetter { Time: time.Now(), Table: "clients", Reason: "test" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sink is closed with the interface
+	r.finish()
+	err = r.deadLetter.Write(tsdbDeadLetter { Time: time.Now(), Table: "clients", Reason: "test" })
+	if err == nil {
+		t.Errorf("dead-letter file still open after shutdown")
+	}
+
+	content, err := os.ReadFile(cfg.DeadLetter.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(content), "\n") != 1 {
+		t.Errorf("unexpected dead-letter content:\n%s", content)
+	}
+}
+
+func TestDeadLetterNew(t *testing.T) {
+	tests := []struct {
+		name	string
+		cfg	TsdbIntfConfDeadLetter
+		err	bool
+	}{
+		{ name: "log", cfg: TsdbIntfConfDeadLetter{} },
+		{ name: "file without path", cfg: TsdbIntfConfDeadLetter { Driver: "file" }, err: true },
+		{ name: "pubsub without channel", cfg: TsdbIntfConfDeadLetter { Driver: "pubsub" }, err: true },
+		{ name: "unknown", cfg: TsdbIntfConfDeadLetter { Driver: "s3" }, err: true },
+	}
+
+	for _, tt := range tests {
+		s, err := tsdbDeadLetterNew(tt.cfg)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		} else if err == nil {
+			s.Close()
+		}
+	}
+}
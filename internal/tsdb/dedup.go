@@ -0,0 +1,131 @@
+package tsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDSDedup struct {
+	Window		int	  `mapstructure:"window_seconds"`
+	Heartbeat	int	  `mapstructure:"heartbeat_minutes"`
+	UseTtl		bool	  `mapstructure:"use_ttl"`
+}
+
+// payload key holding the sender's own validity period in seconds
+const tsdbDedupTtlKey = "_ttl"
+
+const tsdbDedupPurgeIntvl = time.Minute
+
+type tsdbDedup struct {
+	window		time.Duration
+	heartbeat	time.Duration
+	useTtl		bool
+	keys		[]string
+	metrics		[]string
+	state		map[string]*tsdbDedupState
+	lastPurge	time.Time
+}
+
+type tsdbDedupState struct {
+	values		string
+	written		time.Time
+	window		time.Duration
+	seen		time.Time
+}
+
+func tsdbDedupNew(ds *TsdbIntfConfDS) (*tsdbDedup, error) {
+	r := &tsdbDedup {
+		window:		time.Duration(ds.Dedup.Window) * time.Second,
+		heartbeat:	time.Duration(ds.Dedup.Heartbeat) * time.Minute,
+		useTtl:		ds.Dedup.UseTtl,
+		keys:		ds.Keys,
+		state:		make(map[string]*tsdbDedupState),
+		lastPurge:	time.Now(),
+	}
+
+	if strings.ToLower(ds.Datalayout) == LAYOUT_RAW {
+		return nil, fmt.Errorf("Deduplication is not supported for raw layout on channel %s", ds.Channel)
+	}
+
+	if len(r.keys) < 1 {
+		return nil, fmt.Errorf("Deduplication on channel %s requires keys", ds.Channel)
+	}
+
+	if ds.Dedup.Window < 0 || ds.Dedup.Heartbeat < 0 {
+		return nil, fmt.Errorf("Deduplication window or heartbeat on channel %s is negative", ds.Channel)
+	}
+
+	// compares what would be written, so derived metrics are included
+	for _, m := range ds.Metrics {
+		r.metrics = append(r.metrics, m.Key)
+	}
+
+	return r, nil
+}
+
+// returns false if record repeats previous values of its dimension set and can be skipped
+func (d *tsdbDedup) apply(ts time.Time, data mistdatafmt.MistDataFmtIntf) (bool, error) {
+	now := time.Now()
+	if now.Sub(d.lastPurge) > tsdbDedupPurgeIntvl {
+		for k, v := range d.state {
+			// past its window the next sample is written anyway
+			if now.Sub(v.seen) > v.window && now.Sub(v.seen) > d.heartbeat {
+				delete(d.state, k)
+			}
+		}
+		d.lastPurge = now
+	}
+
+	var kv []string
+	for _, k := range d.keys {
+		v, err := data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			return false, fmt.Errorf("JSON key %s does not exist", k)
+		}
+		kv = append(kv, v)
+	}
+	key := strings.Join(kv, "\x00")
+
+	var mv []string
+	for _, m := range d.metrics {
+		v, err := data.GetJsonKeyValueAsStr(m)
+		if err != nil {
+			return false, fmt.Errorf("JSON key %s does not exist", m)
+		}
+		mv = append(mv, v)
+	}
+	values := strings.Join(mv, "\x00")
+
+	window := d.window
+	if d.useTtl {
+		v, err := data.GetJsonKeyValueAsStr(tsdbDedupTtlKey)
+		if err == nil && v != "" {
+			ttl, err := strconv.ParseFloat(v, 64)
+			if err == nil && ttl > 0 {
+				window = time.Duration(ttl * float64(time.Second))
+			}
+		}
+	}
+
+	// window counts from last written sample, so unchanged values are still written once per window
+	prev, ok := d.state[key]
+	if ok && prev.values == values && ts.Sub(prev.written) <= window &&
+		(d.heartbeat <= 0 || ts.Sub(prev.written) < d.heartbeat) {
+		prev.window = window
+		prev.seen = now
+		return false, nil
+	}
+
+	d.state[key] = &tsdbDedupState {
+		values:		values,
+		written:	ts,
+		window:		window,
+		seen:		now,
+	}
+
+	return true, nil
+}
@@ -0,0 +1,121 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupNew(t *testing.T) {
+	tests := []struct {
+		name	string
+		ds	TsdbIntfConfDS
+	}{
+		{ "raw layout", TsdbIntfConfDS { Datalayout: "raw", Keys: []string{"mac"}, Dedup: TsdbIntfConfDSDedup { Window: 60 } } },
+		{ "no keys", TsdbIntfConfDS { Dedup: TsdbIntfConfDSDedup { Window: 60 } } },
+		{ "negative window", TsdbIntfConfDS { Keys: []string{"mac"}, Dedup: TsdbIntfConfDSDedup { Window: -1 } } },
+		{ "negative heartbeat", TsdbIntfConfDS { Keys: []string{"mac"}, Dedup: TsdbIntfConfDSDedup { Heartbeat: -1 } } },
+	}
+
+	for _, tt := range tests {
+		_, err := tsdbDedupNew(&tt.ds)
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestDedupApply(t *testing.T) {
+	type step struct {
+		sec	int
+		mac	string
+		rssi	string
+		ttl	string
+		write	bool
+	}
+
+	tests := []struct {
+		name		string
+		window		int
+		heartbeat	int
+		useTtl		bool
+		steps		[]step
+	}{
+		{
+			name:	"unchanged within window",
+			window:	60,
+			steps:	[]step {
+					{ 0, "a", "-60", "", true },
+					{ 30, "a", "-60", "", false },
+					{ 31, "b", "-60", "", true },
+					{ 40, "a", "-61", "", true },
+					{ 50, "a", "-61", "", false },
+				},
+		},
+		{
+			name:	"steady client is written once per window",
+			window:	60,
+			steps:	[]step {
+					{ 0, "a", "-60", "", true },
+					{ 30, "a", "-60", "", false },
+					{ 60, "a", "-60", "", false },
+					{ 90, "a", "-60", "", true },
+					{ 120, "a", "-60", "", false },
+					{ 151, "a", "-60", "", true },
+				},
+		},
+		{
+			name:		"heartbeat shorter than window",
+			window:		600,
+			heartbeat:	1,
+			steps:		[]step {
+						{ 0, "a", "-60", "", true },
+						{ 30, "a", "-60", "", false },
+						{ 60, "a", "-60", "", true },
+						{ 90, "a", "-60", "", false },
+					},
+		},
+		{
+			name:	"ttl from payload",
+			window:	600,
+			useTtl:	true,
+			steps:	[]step {
+					{ 0, "a", "-60", "20", true },
+					{ 10, "a", "-60", "20", false },
+					{ 25, "a", "-60", "20", true },
+					{ 30, "a", "-60", "", false },
+				},
+		},
+	}
+
+	base := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := TsdbIntfConfDS {
+				Keys:		[]string{"mac"},
+				Metrics:	[]TsdbIntfConfDSMetric {
+							{ Key: "rssi", Type: "BIGINT" },
+						},
+				Dedup:		TsdbIntfConfDSDedup {
+							Window:		tt.window,
+							Heartbeat:	tt.heartbeat,
+							UseTtl:		tt.useTtl,
+						},
+			}
+
+			d, err := tsdbDedupNew(&ds)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for n, s := range tt.steps {
+				data := tsdbWalData { "mac": s.mac, "rssi": s.rssi, "_ttl": s.ttl }
+				write, err := d.apply(base.Add(time.Duration(s.sec) * time.Second), data)
+				if err != nil {
+					t.Fatalf("step %d: %v", n, err)
+				} else if write != s.write {
+					t.Errorf("step %d: write is %v, want %v", n, write, s.write)
+				}
+			}
+		})
+	}
+}
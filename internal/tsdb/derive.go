@@ -0,0 +1,197 @@
+package tsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDSDerive struct {
+	Counters	[]string  `mapstructure:"counters"`
+	Mode		string	  `mapstructure:"mode"`
+	KeepRaw		bool	  `mapstructure:"keep_raw"`
+	ResetKey	string	  `mapstructure:"reset_key"`
+}
+
+// state of entities not seen for this long is forgotten
+const (
+	tsdbDeriveStateTtl	= time.Hour
+	tsdbDerivePurgeIntvl	= time.Minute
+)
+
+type tsdbDerive struct {
+	counters	[]string
+	delta		bool
+	rate		bool
+	keepRaw		bool
+	resetKey	string
+	keys		[]string
+	state		map[string]*tsdbDeriveState
+	lastPurge	time.Time
+}
+
+type tsdbDeriveState struct {
+	time		time.Time
+	reset		string
+	values		map[string]float64
+	seen		time.Time
+}
+
+// builds deriver and rewrites datasource metrics to the derived set
+func tsdbDeriveNew(ds *TsdbIntfConfDS) (*tsdbDerive, error) {
+	r := &tsdbDerive {
+		counters:	ds.Derive.Counters,
+		keepRaw:	ds.Derive.KeepRaw,
+		resetKey:	ds.Derive.ResetKey,
+		keys:		ds.Keys,
+		state:		make(map[string]*tsdbDeriveState),
+		lastPurge:	time.Now(),
+	}
+
+	switch strings.ToLower(ds.Derive.Mode) {
+	case "", "rate":
+		r.rate = true
+	case "delta":
+		r.delta = true
+	case "both":
+		r.delta = true
+		r.rate = true
+	default:
+		return nil, fmt.Errorf("Unknown derive mode: %s", ds.Derive.Mode)
+	}
+
+	if len(r.keys) < 1 {
+		return nil, fmt.Errorf("Counter derivation on channel %s requires keys", ds.Channel)
+	}
+
+	isCounter := make(map[string]bool)
+	for _, c := range r.counters {
+		isCounter[c] = true
+	}
+
+	var metrics []TsdbIntfConfDSMetric
+	for _, m := range ds.Metrics {
+		if isCounter[m.Key] && !ds.Derive.KeepRaw {
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+
+	for _, c := range r.counters {
+		if r.delta {
+			metrics = append(metrics, TsdbIntfConfDSMetric { Key: c + "_delta", Type: "BIGINT" })
+		}
+		if r.rate {
+			metrics = append(metrics, TsdbIntfConfDSMetric { Key: c + "_rate", Type: "DOUBLE" })
+		}
+	}
+	ds.Metrics = metrics
+
+	return r, nil
+}
+
+// returns data with derived metrics, or false if there is nothing to write yet
+// first sample of an entity is only written with keep_raw, without derived values
+func (d *tsdbDerive) apply(ts time.Time, data mistdatafmt.MistDataFmtIntf) (mistdatafmt.MistDataFmtIntf, bool, error) {
+	now := time.Now()
+	if now.Sub(d.lastPurge) > tsdbDerivePurgeIntvl {
+		for k, v := range d.state {
+			if now.Sub(v.seen) > tsdbDeriveStateTtl {
+				delete(d.state, k)
+			}
+		}
+		d.lastPurge = now
+	}
+
+	// entity key from configured dimensions
+	var kv []string
+	for _, k := range d.keys {
+		v, err := data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			return nil, false, fmt.Errorf("JSON key %s does not exist", k)
+		}
+		kv = append(kv, v)
+	}
+	key := strings.Join(kv, "\x00")
+
+	cur := &tsdbDeriveState {
+		time:		ts,
+		values:		make(map[string]float64),
+		seen:		now,
+	}
+
+	if d.resetKey != "" {
+		v, err := data.GetJsonKeyValueAsStr(d.resetKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("JSON key %s does not exist", d.resetKey)
+		}
+		cur.reset = v
+	}
+
+	for _, c := range d.counters {
+		v, err := data.GetJsonKeyValueAsStr(c)
+		if err != nil {
+			return nil, false, fmt.Errorf("JSON key %s does not exist", c)
+		} else if v == "" {
+			return nil, false, fmt.Errorf("Counter data is empty for JSON key %s", c)
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("Counter %s is not numeric: %v", c, err)
+		}
+		cur.values[c] = f
+	}
+
+	prev, ok := d.state[key]
+	if ok && !ts.After(prev.time) {
+		// duplicate or out of order sample, keep newer state
+		return nil, false, nil
+	}
+
+	d.state[key] = cur
+	if !ok && !d.keepRaw {
+		return nil, false, nil
+	} else if !ok {
+		// raw counters are still written, derived metrics stay empty until next sample
+		r := tsdbOverlayNew(data)
+		for _, c := range d.counters {
+			if d.delta {
+				r.Set(c + "_delta", "")
+			}
+			if d.rate {
+				r.Set(c + "_rate", "")
+			}
+		}
+		return r, true, nil
+	}
+
+	// counters restart from zero on reassociation, or if they went backwards
+	reset := d.resetKey != "" && cur.reset != prev.reset
+	for _, c := range d.counters {
+		if cur.values[c] < prev.values[c] {
+			reset = true
+		}
+	}
+
+	elapsed := ts.Sub(prev.time).Seconds()
+	r := tsdbOverlayNew(data)
+	for _, c := range d.counters {
+		delta := cur.values[c] - prev.values[c]
+		if reset {
+			delta = cur.values[c]
+		}
+
+		if d.delta {
+			r.Set(c + "_delta", strconv.FormatInt(int64(delta), 10))
+		}
+		if d.rate {
+			r.Set(c + "_rate", strconv.FormatFloat(delta / elapsed, 'f', -1, 64))
+		}
+	}
+
+	return r, true, nil
+}
@@ -0,0 +1,163 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+)
+
+func deriveTestDs(mode string, keepRaw bool) TsdbIntfConfDS {
+	return TsdbIntfConfDS {
+		Channel:	"/sites/s1/stats/clients",
+		Keys:		[]string{"mac"},
+		Metrics:	[]TsdbIntfConfDSMetric {
+					{ Key: "rssi", Type: "BIGINT" },
+					{ Key: "tx_bytes", Type: "BIGINT" },
+				},
+		Derive:		TsdbIntfConfDSDerive {
+					Counters:	[]string{"tx_bytes"},
+					Mode:		mode,
+					KeepRaw:	keepRaw,
+					ResetKey:	"assoc_time",
+				},
+	}
+}
+
+func TestDeriveNewMetrics(t *testing.T) {
+	tests := []struct {
+		mode	string
+		keepRaw	bool
+		want	[]string
+		err	bool
+	}{
+		{ "", false, []string{"rssi", "tx_bytes_rate"}, false },
+		{ "delta", false, []string{"rssi", "tx_bytes_delta"}, false },
+		{ "both", true, []string{"rssi", "tx_bytes", "tx_bytes_delta", "tx_bytes_rate"}, false },
+		{ "sum", false, nil, true },
+	}
+
+	for _, tt := range tests {
+		ds := deriveTestDs(tt.mode, tt.keepRaw)
+		_, err := tsdbDeriveNew(&ds)
+		if (err != nil) != tt.err {
+			t.Errorf("mode %s: unexpected error %v", tt.mode, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		var got []string
+		for _, m := range ds.Metrics {
+			got = append(got, m.Key)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("mode %s: got metrics %v, want %v", tt.mode, got, tt.want)
+			continue
+		}
+		for n := range got {
+			if got[n] != tt.want[n] {
+				t.Errorf("mode %s: got metrics %v, want %v", tt.mode, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDeriveApply(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	sample := func(sec int, tx string, assoc string) (time.Time, tsdbWalData) {
+		return base.Add(time.Duration(sec) * time.Second), tsdbWalData {
+			"mac":		"5c5b35000001",
+			"rssi":		"-60",
+			"tx_bytes":	tx,
+			"assoc_time":	assoc,
+		}
+	}
+
+	type step struct {
+		sec	int
+		tx	string
+		assoc	string
+		derived	bool
+		delta	string
+		rate	string
+	}
+
+	tests := []struct {
+		name	string
+		keepRaw	bool
+		steps	[]step
+	}{
+		{
+			name:	"first sample dropped",
+			steps:	[]step {
+					{ 0, "1000", "1", false, "", "" },
+					{ 10, "1500", "1", true, "500", "50" },
+				},
+		},
+		{
+			name:		"first sample kept raw",
+			keepRaw:	true,
+			steps:		[]step {
+						{ 0, "1000", "1", true, "", "" },
+						{ 10, "1500", "1", true, "500", "50" },
+					},
+		},
+		{
+			name:	"counter went backwards",
+			steps:	[]step {
+					{ 0, "1000", "1", false, "", "" },
+					{ 10, "200", "1", true, "200", "20" },
+				},
+		},
+		{
+			name:	"reassociation",
+			steps:	[]step {
+					{ 0, "1000", "1", false, "", "" },
+					{ 10, "3000", "2", true, "3000", "300" },
+				},
+		},
+		{
+			name:	"out of order",
+			steps:	[]step {
+					{ 10, "1000", "1", false, "", "" },
+					{ 5, "900", "1", false, "", "" },
+					{ 20, "1100", "1", true, "100", "10" },
+				},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := deriveTestDs("both", tt.keepRaw)
+			d, err := tsdbDeriveNew(&ds)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for n, s := range tt.steps {
+				ts, data := sample(s.sec, s.tx, s.assoc)
+				r, derived, err := d.apply(ts, data)
+				if err != nil {
+					t.Fatalf("step %d: %v", n, err)
+				} else if derived != s.derived {
+					t.Fatalf("step %d: derived is %v, want %v", n, derived, s.derived)
+				} else if !derived {
+					continue
+				}
+
+				for k, want := range map[string]string{"tx_bytes_delta": s.delta, "tx_bytes_rate": s.rate, "tx_bytes": s.tx} {
+					got, err := r.GetJsonKeyValueAsStr(k)
+					if err != nil {
+						t.Errorf("step %d: %v", n, err)
+					} else if got != want {
+						t.Errorf("step %d: %s is %s, want %s", n, k, got, want)
+					}
+				}
+
+				if s.delta == "" && !tsdbValueUnset(r, "tx_bytes_rate") {
+					t.Errorf("step %d: rate of first sample should be unset", n)
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,7 @@ package tsdb
 
 import (
 	"log"
-
-	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+	"time"
 )
 
 type tsdbIntfDummy struct{}
@@ -13,13 +12,18 @@ func tsdbIntfDummyNew(cfg TsdbIntfConf) (*tsdbIntfDummy, error) {
 	return r, nil
 }
 
-func (i *tsdbIntfDummy) AddRecordStatsClient(channel string, data mistdatafmt.WsMsgClientStat) error {
-	log.Printf("[TSDB] AddRecordStatsClient Channel %s Data %v", channel, data)	
+func (i *tsdbIntfDummy) AddRecords(tbl string, records []tsdbRecord) error {
+	for _, v := range records {
+		log.Printf("[TSDB] AddRecords Table %s Channel %s Time %v Data %v", tbl, v.Channel, v.Time, v.Data)	
+	}
 	return nil
 }
 
-func (i *tsdbIntfDummy) AddRecordRaw(channel string, data string) error {
-	log.Printf("[TSDB] AddRecordRaw Channel %s Data %s", channel, data)	
+func (i *tsdbIntfDummy) AddRecordRaw(channel string, ts time.Time, data string) error {
+	log.Printf("[TSDB] AddRecordRaw Channel %s Time %v Data %s", channel, ts, data)	
 	return nil
 }
 
+func (i *tsdbIntfDummy) Close() error {
+	return nil
+}
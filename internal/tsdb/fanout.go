@@ -0,0 +1,229 @@
+package tsdb
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TsdbIntfConfBackend struct {
+	Name			string
+	Driver			string
+	DriverAwsTimeStream	TsdbIntfConfDrvAwsTS
+	DriverInfluxDB		TsdbIntfConfDrvInfluxDB
+	DriverTimescaleDB	TsdbIntfConfDrvTimescaleDB
+	DriverFile		TsdbIntfConfDrvFile
+	DriverClickHouse	TsdbIntfConfDrvClickHouse
+	DriverOpenSearch	TsdbIntfConfDrvOpenSearch
+	Channels		[]string
+	QueueSize		int
+}
+
+// pending writes per backend before new ones go to its write-ahead buffer
+const tsdbFanoutDefaultQueue = 64
+
+// writes every batch to several backends, each from its own goroutine
+type tsdbFanout struct {
+	members		[]*tsdbFanoutMember
+	wg		sync.WaitGroup
+}
+
+type tsdbFanoutMember struct {
+	name		string
+	backend		tsdbWalBackend
+	channels	map[string]bool
+	queue		chan tsdbFanoutJob
+}
+
+type tsdbFanoutJob struct {
+	table		string
+	records		[]tsdbRecord
+	channel		string
+	time		time.Time
+	raw		string
+}
+
+func tsdbFanoutNew(cfg TsdbIntfConf, deadLetter tsdbDeadLetterSink) (*tsdbFanout, error) {
+	r := &tsdbFanout{}
+
+	known := make(map[string]bool)
+	for i := 0; i < len(cfg.Datasource); i++ {
+		known[cfg.Datasource[i].Channel] = true
+	}
+
+	for i := 0; i < len(cfg.Backends); i++ {
+		b := cfg.Backends[i]
+
+		qsize := b.QueueSize
+		if qsize < 1 {
+			qsize = tsdbFanoutDefaultQueue
+		}
+
+		m := &tsdbFanoutMember {
+			name:		b.Name,
+			queue:		make(chan tsdbFanoutJob, qsize),
+		}
+
+		if m.name == "" {
+			m.name = fmt.Sprintf("%s#%d", b.Driver, i)
+		}
+
+		// each backend is built as if it was the only driver, seeing only its datasources
+		bcfg := cfg
+		bcfg.Driver = b.Driver
+		bcfg.DriverAwsTimeStream = b.DriverAwsTimeStream
+		bcfg.DriverInfluxDB = b.DriverInfluxDB
+		bcfg.DriverTimescaleDB = b.DriverTimescaleDB
+		bcfg.DriverFile = b.DriverFile
+		bcfg.DriverClickHouse = b.DriverClickHouse
+		bcfg.DriverOpenSearch = b.DriverOpenSearch
+		bcfg.Backends = nil
+
+		if len(b.Channels) > 0 {
+			m.channels = make(map[string]bool)
+			bcfg.Datasource = nil
+
+			for _, c := range b.Channels {
+				if !known[c] {
+					r.Close()
+					return nil, fmt.Errorf("Backend %s refers to unknown channel %s", m.name, c)
+				}
+				m.channels[c] = true
+			}
+
+			for j := 0; j < len(cfg.Datasource); j++ {
+				if m.channels[cfg.Datasource[j].Channel] {
+					bcfg.Datasource = append(bcfg.Datasource, cfg.Datasource[j])
+				}
+			}
+		}
+
+		backend, err := tsdbBackendNew(bcfg, deadLetter)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("Failed to init backend %s: %v", m.name, err)
+		}
+
+		// every backend buffers its own failed writes
+		m.backend, err = tsdbWalNew(bcfg, m.name, backend, deadLetter)
+		if err != nil {
+			backend.Close()
+			r.Close()
+			return nil, fmt.Errorf("Failed to init write-ahead buffer for backend %s: %v", m.name, err)
+		}
+
+		r.members = append(r.members, m)
+		r.wg.Add(1)
+		go r.worker(m)
+
+		log.Printf("TSDB backend %s ready (%s)", m.name, b.Driver)
+	}
+
+	return r, nil
+}
+
+func (f *tsdbFanout) worker(m *tsdbFanoutMember) {
+	defer f.wg.Done()
+
+	for job := range m.queue {
+		var err error
+		if job.records != nil {
+			err = m.backend.AddRecords(job.table, job.records)
+		} else {
+			err = m.backend.AddRecordRaw(job.channel, job.time, job.raw)
+		}
+
+		if err != nil {
+			log.Printf("TSDB backend %s has thrown error: %v", m.name, err)
+		}
+	}
+}
+
+// hands job to backend without waiting, a stalled backend defers writes to its own buffer
+func (m *tsdbFanoutMember) enqueue(job tsdbFanoutJob) error {
+	select {
+	case m.queue <- job:
+		return nil
+	default:
+	}
+
+	reason := fmt.Sprintf("queue of %d writes is full", cap(m.queue))
+	if job.records != nil {
+		return m.backend.deferRecords(job.table, job.records, reason)
+	}
+
+	return m.backend.deferRaw(job.channel, job.time, job.raw, reason)
+}
+
+func (f *tsdbFanout) AddRecords(tbl string, records []tsdbRecord) error {
+	var errs []string
+
+	for _, m := range f.members {
+		recs := records
+		if m.channels != nil {
+			recs = nil
+			for _, rec := range records {
+				if m.channels[rec.Channel] {
+					recs = append(recs, rec)
+				}
+			}
+		}
+
+		if len(recs) < 1 {
+			continue
+		}
+
+		err := m.enqueue(tsdbFanoutJob { table: tbl, records: recs })
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	return tsdbFanoutError(errs)
+}
+
+func (f *tsdbFanout) AddRecordRaw(channel string, ts time.Time, data string) error {
+	var errs []string
+
+	for _, m := range f.members {
+		if m.channels != nil && !m.channels[channel] {
+			continue
+		}
+
+		err := m.enqueue(tsdbFanoutJob { table: channel, channel: channel, time: ts, raw: data })
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	return tsdbFanoutError(errs)
+}
+
+func tsdbFanoutError(errs []string) error {
+	if len(errs) < 1 {
+		return nil
+	}
+
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// drains queued writes, then closes every backend
+func (f *tsdbFanout) Close() error {
+	for _, m := range f.members {
+		close(m.queue)
+	}
+	f.wg.Wait()
+
+	var lastErr error
+	for _, m := range f.members {
+		err := m.backend.Close()
+		if err != nil {
+			log.Printf("TSDB backend %s has thrown error on close: %v", m.name, err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
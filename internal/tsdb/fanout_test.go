@@ -0,0 +1,230 @@
+package tsdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// backend which holds every write until its gate is opened
+type fanoutTestBackend struct {
+	walTestBackend
+	gate		chan struct{}
+}
+
+func (b *fanoutTestBackend) AddRecords(tbl string, records []tsdbRecord) error {
+	<-b.gate
+	return b.walTestBackend.AddRecords(tbl, records)
+}
+
+func (b *fanoutTestBackend) AddRecordRaw(channel string, ts time.Time, data string) error {
+	<-b.gate
+	return b.walTestBackend.AddRecordRaw(channel, ts, data)
+}
+
+// dead-letter sink which keeps records in memory
+type fanoutTestSink struct {
+	mu		sync.Mutex
+	letters		[]tsdbDeadLetter
+}
+
+func (s *fanoutTestSink) Write(e tsdbDeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters = append(s.letters, e)
+	return nil
+}
+
+func (s *fanoutTestSink) Close() error {
+	return nil
+}
+
+func (s *fanoutTestSink) count(reason string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := 0
+	for _, v := range s.letters {
+		if v.Reason == reason {
+			r++
+		}
+	}
+
+	return r
+}
+
+func fanoutTestMember(t *testing.T, cfg TsdbIntfConf, name string, backend tsdbIntfBackend, qsize int, dl tsdbDeadLetterSink, channels ...string) *tsdbFanoutMember {
+	m := &tsdbFanoutMember {
+		name:		name,
+		queue:		make(chan tsdbFanoutJob, qsize),
+	}
+
+	if len(channels) > 0 {
+		m.channels = make(map[string]bool)
+		for _, v := range channels {
+			m.channels[v] = true
+		}
+	}
+
+	var err error
+	m.backend, err = tsdbWalNew(cfg, name, backend, dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func fanoutTestNew(members ...*tsdbFanoutMember) *tsdbFanout {
+	f := &tsdbFanout{}
+	for _, m := range members {
+		f.members = append(f.members, m)
+		f.wg.Add(1)
+		go f.worker(m)
+	}
+
+	return f
+}
+
+func TestFanoutChannels(t *testing.T) {
+	cfg := walTestConf("")
+	dl := &fanoutTestSink{}
+
+	all := &walTestBackend{}
+	onlyA := &walTestBackend{}
+	f := fanoutTestNew(
+		fanoutTestMember(t, cfg, "all", all, tsdbFanoutDefaultQueue, dl),
+		fanoutTestMember(t, cfg, "a", onlyA, tsdbFanoutDefaultQueue, dl, walTestChannelA),
+	)
+
+	err := f.AddRecords("clients", []tsdbRecord {
+		walTestRecord(t, walTestChannelA, "a"),
+		walTestRecord(t, walTestChannelB, "b"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.AddRecordRaw(walTestChannelB, time.Now(), `{"raw":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name		string
+		backend		*walTestBackend
+		written		int
+		raw		int
+	}{
+		{ name: "all", backend: all, written: 2, raw: 1 },
+		{ name: "a", backend: onlyA, written: 1, raw: 0 },
+	}
+
+	for _, tt := range tests {
+		written, raw := tt.backend.count()
+		if written != tt.written || raw != tt.raw {
+			t.Errorf("%s: got %d records and %d raw, want %d and %d", tt.name, written, raw, tt.written, tt.raw)
+		}
+	}
+
+	if onlyA.written[0].Channel != walTestChannelA {
+		t.Errorf("backend a got record of channel %s", onlyA.written[0].Channel)
+	}
+
+	// filter on a channel no datasource provides is a configuration error
+	cfg.Backends = []TsdbIntfConfBackend {
+		{ Name: "first", Driver: "dummy" },
+		{ Name: "second", Driver: "dummy", Channels: []string{"/sites/s3/stats/clients"} },
+	}
+	_, err = tsdbFanoutNew(cfg, dl)
+	if err == nil {
+		t.Errorf("expected error for unknown channel")
+	}
+}
+
+func TestFanoutSlowMember(t *testing.T) {
+	const batches = 5
+
+	tests := []struct {
+		name		string
+		wal		bool
+	}{
+		{ name: "spooled to write-ahead buffer", wal: true },
+		{ name: "dead-lettered without write-ahead buffer" },
+	}
+
+	for _, tt := range tests {
+		dir := ""
+		if tt.wal {
+			dir = t.TempDir()
+		}
+		dl := &fanoutTestSink{}
+
+		fast := &walTestBackend{}
+		down := &walTestBackend{}
+		down.set(true)
+		slow := &fanoutTestBackend { gate: make(chan struct{}) }
+
+		f := fanoutTestNew(
+			fanoutTestMember(t, walTestConf(""), "fast", fast, tsdbFanoutDefaultQueue, dl),
+			fanoutTestMember(t, walTestConf(""), "down", down, tsdbFanoutDefaultQueue, dl),
+			fanoutTestMember(t, walTestConf(dir), "slow", slow, 1, dl),
+		)
+
+		// writes must not wait for the stalled backend
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for n := 0; n < batches; n++ {
+				f.AddRecords("clients", []tsdbRecord{walTestRecord(t, walTestChannelA, "a")})
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: writes blocked by slow backend", tt.name)
+		}
+
+		// other backends, failing or not, go on unaffected
+		walTestWait(t, func() bool {
+			written, _ := fast.count()
+			return written == batches && dl.count("write_failed") == batches
+		})
+
+		// one batch is held by the worker, at most one more is queued
+		deferred := dl.count("deferred")
+		if tt.wal {
+			deferred = 0
+			for _, e := range walTestEntries(t, dir) {
+				deferred += len(e.Records)
+			}
+			if dl.count("deferred") > 0 {
+				t.Errorf("%s: deferred writes dead-lettered despite write-ahead buffer", tt.name)
+			}
+		}
+		if deferred < batches - 2 {
+			t.Errorf("%s: got %d deferred records, want at least %d", tt.name, deferred, batches - 2)
+		}
+
+		// buffered writes reach the backend once it is responsive again, dead-lettered ones do not
+		want := batches
+		if !tt.wal {
+			want = batches - deferred
+		}
+
+		close(slow.gate)
+		walTestWait(t, func() bool {
+			written, _ := slow.count()
+			return written == want
+		})
+
+		f.Close()
+	}
+}
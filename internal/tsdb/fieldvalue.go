@@ -0,0 +1,23 @@
+package tsdb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// converts string value read from payload to go type of the measure type,
+// for drivers which encode rows themselves (file, ClickHouse, OpenSearch)
+func tsdbFieldValue(t string, v string) (interface{}, error) {
+	switch t {
+	case "BIGINT":
+		return strconv.ParseInt(v, 10, 64)
+	case "DOUBLE":
+		return strconv.ParseFloat(v, 64)
+	case "BOOLEAN":
+		return strconv.ParseBool(v)
+	case "VARCHAR":
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("Unknown data type: %s", t)
+}
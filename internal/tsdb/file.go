@@ -0,0 +1,561 @@
+package tsdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDrvFile struct {
+	Path		string
+	Format		string
+	Rotate		string
+	MaxBytes	int64
+	Gzip		bool
+	Retention	int
+}
+
+type tsdbIntfFile struct {
+	debug		bool
+	dir		string
+	format		string
+	period		string
+	periodRe	string
+	maxBytes	int64
+	gzip		bool
+	retention	int
+	dataOut		map[string]tsdbIntfFileDataOut
+	columns		map[string][]string
+	files		map[string]*tsdbIntfFileOut
+}
+
+type tsdbIntfFileDataOutField struct {
+	Key		string
+	Type		string
+}
+
+type tsdbIntfFileDataOut struct {
+	Channel		string
+	Table		string
+	Raw		bool
+	Keys		[]string
+	Fields		[]tsdbIntfFileDataOutField
+}
+
+// currently open file of a table
+type tsdbIntfFileOut struct {
+	period		string
+	seq		int
+	path		string
+	f		*os.File
+	size		int64
+}
+
+func tsdbIntfFileNew(cfg TsdbIntfConf) (*tsdbIntfFile, error) {
+	// check valid parameter
+	if cfg.DriverFile.Path == "" {
+		return nil, fmt.Errorf("File output directory not specified")
+	}
+
+	r := &tsdbIntfFile {
+		debug:		cfg.Debug,
+		dir:		cfg.DriverFile.Path,
+		format:		strings.ToLower(cfg.DriverFile.Format),
+		maxBytes:	cfg.DriverFile.MaxBytes,
+		gzip:		cfg.DriverFile.Gzip,
+		retention:	cfg.DriverFile.Retention,
+		dataOut:	make(map[string]tsdbIntfFileDataOut),
+		columns:	make(map[string][]string),
+		files:		make(map[string]*tsdbIntfFileOut),
+	}
+
+	switch r.format {
+	case "", "json":
+		r.format = "json"
+	case "csv":
+	default:
+		return nil, fmt.Errorf("Unknown file format: %s", cfg.DriverFile.Format)
+	}
+
+	// period string is also the timestamp layout used in file names
+	switch strings.ToLower(cfg.DriverFile.Rotate) {
+	case "", "hourly":
+		r.period = "20060102T15"
+		r.periodRe = `\d{8}T\d{2}`
+	case "daily":
+		r.period = "20060102"
+		r.periodRe = `\d{8}`
+	default:
+		return nil, fmt.Errorf("Unknown file rotation: %s", cfg.DriverFile.Rotate)
+	}
+
+	// build data out
+	for i := 0; i < len(cfg.Datasource); i++ {
+		if cfg.Datasource[i].Channel == "" ||
+			cfg.Datasource[i].Table == "" {
+			return nil, fmt.Errorf("Missing mandatory data out parameter")
+		}
+
+		dout := tsdbIntfFileDataOut {
+			Channel:	cfg.Datasource[i].Channel,
+			Table:		cfg.Datasource[i].Table,
+			Raw:		strings.ToLower(cfg.Datasource[i].Datalayout) == LAYOUT_RAW,
+			Keys:		cfg.Datasource[i].Keys,
+		}
+
+		for j := 0; j < len(cfg.Datasource[i].Metrics); j++ {
+			t := strings.ToUpper(cfg.Datasource[i].Metrics[j].Type)
+			switch t {
+			case "BIGINT":
+			case "BOOLEAN":
+			case "DOUBLE":
+			case "VARCHAR":
+			default:
+				return nil, fmt.Errorf("Unsupported data type for file output: %s", t)
+			}
+
+			f := tsdbIntfFileDataOutField {
+				Key:	cfg.Datasource[i].Metrics[j].Key,
+				Type:	t,
+			}
+
+			dout.Fields = append(dout.Fields, f)
+		}
+
+		// csv files have a single header, tables shared by channels must agree on it
+		cols := dout.columns()
+		if cur, ok := r.columns[dout.Table]; ok && strings.Join(cur, ",") != strings.Join(cols, ",") {
+			if r.format == "csv" {
+				return nil, fmt.Errorf("Channels writing to table %s have different columns, not supported with csv format", dout.Table)
+			}
+		}
+		r.columns[dout.Table] = cols
+
+		r.dataOut[cfg.Datasource[i].Channel] = dout
+	}
+
+	err := os.MkdirAll(r.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("File output ready: %s", r.dir)
+	return r, nil
+}
+
+func (o tsdbIntfFileDataOut) columns() []string {
+	cols := []string{"time", "channel"}
+	if o.Raw {
+		return append(cols, "data")
+	}
+
+	cols = append(cols, o.Keys...)
+	for _, v := range o.Fields {
+		cols = append(cols, v.Key)
+	}
+
+	return cols
+}
+
+func (i *tsdbIntfFile) AddRecords(tbl string, records []tsdbRecord) error {
+	var buf bytes.Buffer
+	var failed int
+
+	for _, rec := range records {
+		outParams, ok := i.dataOut[rec.Channel]
+		if !ok {
+			log.Printf("Data out parameters for channel %s was not found", rec.Channel)
+			failed++
+			continue
+		}
+
+		err := i.buildRecord(&buf, outParams, rec.Time, rec.Data)
+		if err != nil {
+			log.Printf("Failed to build record for channel %s: %v", rec.Channel, err)
+			failed++
+			continue
+		}
+	}
+
+	err := i.write(tbl, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records could not be built for table %s", failed, len(records), tbl)
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfFile) buildRecord(w io.Writer, outParams tsdbIntfFileDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) error {
+	var names []string
+	var values []interface{}
+
+	for _, v := range outParams.Keys {
+		kval, err := data.GetJsonKeyValueAsStr(v)
+		if err != nil {
+			return fmt.Errorf("JSON key %s does not exist", v)
+		}
+
+		names = append(names, v)
+		values = append(values, kval)
+	}
+
+	for _, v := range outParams.Fields {
+		rval, err := data.GetJsonKeyValueAsStr(v.Key)
+		if err != nil {
+			return fmt.Errorf("JSON key %s does not exist", v.Key)
+		}
+
+		// empty measurements are kept as null so rows stay aligned
+		var fval interface{}
+		if rval != "" {
+			fval, err = tsdbFieldValue(v.Type, rval)
+			if err != nil {
+				return fmt.Errorf("Invalid value for JSON key %s: %v", v.Key, err)
+			}
+		}
+
+		names = append(names, v.Key)
+		values = append(values, fval)
+	}
+
+	return i.encode(w, ts, outParams.Channel, names, values)
+}
+
+func (i *tsdbIntfFile) AddRecordRaw(channel string, ts time.Time, data string) error {
+	outParams, ok := i.dataOut[channel]
+	if !ok {
+		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+	}
+
+	// raw payload is embedded as is in json if it is valid json, otherwise as a string
+	var v interface{} = data
+	if i.format == "json" && json.Valid([]byte(data)) {
+		v = json.RawMessage(data)
+	}
+
+	var buf bytes.Buffer
+	err := i.encode(&buf, ts, channel, []string{"data"}, []interface{}{v})
+	if err != nil {
+		return err
+	}
+
+	return i.write(outParams.Table, buf.Bytes())
+}
+
+func (i *tsdbIntfFile) encode(w io.Writer, ts time.Time, channel string, names []string, values []interface{}) error {
+	tstr := ts.UTC().Format(time.RFC3339Nano)
+
+	if i.format == "csv" {
+		row := []string{tstr, channel}
+		for _, v := range values {
+			if v == nil {
+				row = append(row, "")
+			} else {
+				row = append(row, fmt.Sprintf("%v", v))
+			}
+		}
+
+		cw := csv.NewWriter(w)
+		cw.Write(row)
+		cw.Flush()
+		return cw.Error()
+	}
+
+	// build object by hand to keep column order stable
+	names = append([]string{"time", "channel"}, names...)
+	values = append([]interface{}{tstr, channel}, values...)
+
+	var b bytes.Buffer
+	for j := 0; j < len(names); j++ {
+		k, err := json.Marshal(names[j])
+		if err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(values[j])
+		if err != nil {
+			return err
+		}
+
+		if j == 0 {
+			b.WriteString("{")
+		} else {
+			b.WriteString(",")
+		}
+		b.Write(k)
+		b.WriteString(":")
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// appends data to current file of the table, rotating first if needed
+func (i *tsdbIntfFile) write(tbl string, data []byte) error {
+	if len(data) < 1 {
+		return nil
+	}
+
+	out, err := i.open(tbl, int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	n, err := out.f.Write(data)
+	out.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("Failed to write to %s: %v", out.path, err)
+	}
+
+	if i.debug {
+		log.Printf("Wrote %d bytes to %s", n, out.path)
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfFile) open(tbl string, size int64) (*tsdbIntfFileOut, error) {
+	period := time.Now().UTC().Format(i.period)
+
+	out, ok := i.files[tbl]
+	if ok {
+		full := i.maxBytes > 0 && out.size > 0 && out.size + size > i.maxBytes
+		if out.period == period && !full {
+			return out, nil
+		}
+
+		seq := 0
+		if out.period == period {
+			seq = out.seq + 1
+		}
+
+		i.rotate(tbl, out)
+		return i.create(tbl, period, seq)
+	}
+
+	return i.create(tbl, period, 0)
+}
+
+func (i *tsdbIntfFile) create(tbl string, period string, seq int) (*tsdbIntfFileOut, error) {
+	ext := ".jsonl"
+	if i.format == "csv" {
+		ext = ".csv"
+	}
+
+	// skip over files left by a previous run which were already closed or are full
+	var path string
+	var size int64
+	for {
+		path = filepath.Join(i.dir, fmt.Sprintf("%s-%s-%03d%s", fileTableName(tbl), period, seq, ext))
+
+		_, err := os.Stat(path + ".gz")
+		if err == nil {
+			seq++
+			continue
+		}
+
+		st, err := os.Stat(path)
+		if err == nil && i.maxBytes > 0 && st.Size() >= i.maxBytes {
+			seq++
+			continue
+		} else if err == nil {
+			size = st.Size()
+		}
+
+		break
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &tsdbIntfFileOut {
+		period:		period,
+		seq:		seq,
+		path:		path,
+		f:		f,
+		size:		size,
+	}
+
+	if i.format == "csv" && size == 0 {
+		cw := csv.NewWriter(f)
+		cw.Write(i.columns[tbl])
+		cw.Flush()
+		if cw.Error() != nil {
+			f.Close()
+			return nil, cw.Error()
+		}
+
+		st, err := f.Stat()
+		if err == nil {
+			out.size = st.Size()
+		}
+	}
+
+	i.files[tbl] = out
+	log.Printf("Opened output file %s", path)
+
+	return out, nil
+}
+
+// closes table file, compresses it and removes files beyond retention
+func (i *tsdbIntfFile) rotate(tbl string, out *tsdbIntfFileOut) error {
+	delete(i.files, tbl)
+
+	err := out.f.Close()
+	if err != nil {
+		log.Printf("Failed to close %s: %v", out.path, err)
+		return err
+	}
+
+	if i.gzip {
+		err = fileCompress(out.path)
+		if err != nil {
+			log.Printf("Failed to compress %s: %v", out.path, err)
+			return err
+		}
+	}
+
+	if i.retention < 1 {
+		return nil
+	}
+
+	// oldest first, current file is not created yet
+	matches, err := i.tableFiles(tbl)
+	if err != nil {
+		log.Printf("Failed to list files for table %s: %v", tbl, err)
+		return nil
+	}
+
+	for j := 0; j < len(matches) - i.retention; j++ {
+		err = os.Remove(matches[j])
+		if err != nil {
+			log.Printf("Failed to remove %s: %v", matches[j], err)
+			continue
+		}
+
+		if i.debug {
+			log.Printf("Removed expired file %s", matches[j])
+		}
+	}
+
+	return nil
+}
+
+// files written for exactly this table in write order, a prefix match would include tables named tbl-*
+func (i *tsdbIntfFile) tableFiles(tbl string) ([]string, error) {
+	re, err := regexp.Compile("^" + regexp.QuoteMeta(fileTableName(tbl)) + "-(" + i.periodRe + `)-(\d{3,})\.(jsonl|csv)(\.gz)?$`)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(i.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type tableFile struct {
+		path		string
+		period		string
+		seq		int
+	}
+
+	var files []tableFile
+	for _, e := range entries {
+		m := re.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+
+		seq, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		files = append(files, tableFile { path: filepath.Join(i.dir, e.Name()), period: m[1], seq: seq })
+	}
+
+	// sequence is compared as number, name order breaks once it outgrows its zero padding
+	sort.Slice(files, func(a, b int) bool {
+		if files[a].period != files[b].period {
+			return files[a].period < files[b].period
+		}
+		return files[a].seq < files[b].seq
+	})
+
+	var r []string
+	for _, f := range files {
+		r = append(r, f.path)
+	}
+
+	return r, nil
+}
+
+func fileCompress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path + ".gz", os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// table names may contain characters not wanted in file names
+func fileTableName(tbl string) string {
+	r := strings.NewReplacer("/", "_", "\\", "_", "*", "_", "?", "_", "[", "_")
+	return r.Replace(tbl)
+}
+
+// open files are finalized the same way as on rotation
+func (i *tsdbIntfFile) Close() error {
+	var lastErr error
+	for tbl, out := range i.files {
+		err := i.rotate(tbl, out)
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
@@ -0,0 +1,281 @@
+package tsdb
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileTestConf(dir string, format string) TsdbIntfConf {
+	return TsdbIntfConf {
+		DriverFile:	TsdbIntfConfDrvFile {
+					Path:		dir,
+					Format:		format,
+				},
+		Datasource:	[]TsdbIntfConfDS {
+					{
+						Channel:	"/sites/s1/stats/clients",
+						Table:		"clients",
+						Keys:		[]string{"mac"},
+						Metrics:	[]TsdbIntfConfDSMetric {
+									{ Key: "rssi", Type: "BIGINT" },
+									{ Key: "ssid", Type: "VARCHAR" },
+								},
+					},
+					{
+						Channel:	"/sites/s1/raw",
+						Datalayout:	"raw",
+						Table:		"raw",
+					},
+				},
+	}
+}
+
+func fileTestList(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r []string
+	for _, e := range entries {
+		r = append(r, e.Name())
+	}
+	sort.Strings(r)
+
+	return r
+}
+
+func fileTestRead(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestFileEncode(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := tsdbWalData { "mac": "5c5b35000001", "rssi": "-61", "ssid": "" }
+
+	tests := []struct {
+		format	string
+		raw	string
+		want	string
+	}{
+		{
+			format:	"json",
+			want:	`{"time":"2024-01-02T03:04:05Z","channel":"/sites/s1/stats/clients","mac":"5c5b35000001","rssi":-61,"ssid":null}` + "\n",
+		},
+		{
+			format:	"json",
+			raw:	`{"a":1}`,
+			want:	`{"time":"2024-01-02T03:04:05Z","channel":"/sites/s1/raw","data":{"a":1}}` + "\n",
+		},
+		{
+			format:	"json",
+			raw:	`not json`,
+			want:	`{"time":"2024-01-02T03:04:05Z","channel":"/sites/s1/raw","data":"not json"}` + "\n",
+		},
+		{
+			format:	"csv",
+			want:	"time,channel,mac,rssi,ssid\n2024-01-02T03:04:05Z,/sites/s1/stats/clients,5c5b35000001,-61,\n",
+		},
+		{
+			format:	"csv",
+			raw:	`{"a":1}`,
+			want:	"time,channel,data\n2024-01-02T03:04:05Z,/sites/s1/raw,\"{\"\"a\"\":1}\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		b, err := tsdbIntfFileNew(fileTestConf(dir, tt.format))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.raw != "" {
+			err = b.AddRecordRaw("/sites/s1/raw", ts, tt.raw)
+		} else {
+			err = b.AddRecords("clients", []tsdbRecord{{ Channel: "/sites/s1/stats/clients", Time: ts, Data: data }})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var path string
+		for _, out := range b.files {
+			path = out.path
+		}
+		got := fileTestRead(t, path)
+		b.Close()
+
+		if got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestFileRotateAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	cfg := fileTestConf(dir, "json")
+	cfg.DriverFile.MaxBytes = 1
+	cfg.DriverFile.Gzip = true
+	cfg.DriverFile.Retention = 2
+
+	// files of another table sharing the name prefix must survive retention
+	period := time.Now().UTC().Format("20060102T15")
+	others := []string {
+		"clients-old-" + period + "-000.jsonl.gz",
+		"clients-2-" + period + "-000.jsonl",
+		"clients.bak",
+	}
+	for _, v := range others {
+		err := os.WriteFile(filepath.Join(dir, v), []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := tsdbIntfFileNew(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every write exceeds max bytes so each record starts a new file
+	data := tsdbWalData { "mac": "5c5b35000001", "rssi": "-61", "ssid": "corp" }
+	for n := 0; n < 4; n++ {
+		rec := tsdbRecord { Channel: "/sites/s1/stats/clients", Time: time.Now(), Data: data }
+		err = b.AddRecords("clients", []tsdbRecord{rec})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]string {
+		"clients-" + period + "-002.jsonl.gz",
+		"clients-" + period + "-003.jsonl.gz",
+	}, others...)
+	sort.Strings(want)
+
+	got := fileTestList(t, dir)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got files %v, want %v", got, want)
+	}
+
+	// last file was finalized on close
+	content := fileTestRead(t, filepath.Join(dir, "clients-" + period + "-003.jsonl.gz"))
+	if !strings.Contains(content, `"ssid":"corp"`) {
+		t.Errorf("unexpected content %s", content)
+	}
+}
+
+func TestFileTableFiles(t *testing.T) {
+	tests := []struct {
+		rotate	string
+		name	string
+		match	bool
+	}{
+		{ "hourly", "a-20240102T03-000.jsonl", true },
+		{ "hourly", "a-20240102T03-012.csv.gz", true },
+		{ "hourly", "a-20240102T03-1000.jsonl", true },
+		{ "hourly", "a-20240102-000.jsonl", false },
+		{ "hourly", "a-b-20240102T03-000.jsonl", false },
+		{ "hourly", "a-20240102T03-000.jsonl.tmp", false },
+		{ "daily", "a-20240102-000.jsonl", true },
+		{ "daily", "a-20240102-20240102-000.jsonl", false },
+		{ "daily", "a-20240102T03-000.jsonl", false },
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, tt.name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := fileTestConf(dir, "json")
+		cfg.DriverFile.Rotate = tt.rotate
+		b, err := tsdbIntfFileNew(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := b.tableFiles("a")
+		if err != nil {
+			t.Fatal(err)
+		} else if (len(got) == 1) != tt.match {
+			t.Errorf("%s %s: matched %v, want %v", tt.rotate, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestFileTableFilesOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	// created out of order, sequence past 999 is wider than its padding
+	names := []string {
+		"a-20240102T04-000.jsonl",
+		"a-20240102T03-1000.jsonl.gz",
+		"a-20240102T03-999.jsonl.gz",
+		"a-20240102T03-002.jsonl.gz",
+		"a-20240102T03-10000.jsonl",
+	}
+	for _, v := range names {
+		err := os.WriteFile(filepath.Join(dir, v), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := tsdbIntfFileNew(fileTestConf(dir, "json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := b.tableFiles("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string {
+		"a-20240102T03-002.jsonl.gz",
+		"a-20240102T03-999.jsonl.gz",
+		"a-20240102T03-1000.jsonl.gz",
+		"a-20240102T03-10000.jsonl",
+		"a-20240102T04-000.jsonl",
+	}
+	for n := range want {
+		want[n] = filepath.Join(dir, want[n])
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got order\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,343 @@
+package tsdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDrvInfluxDB struct {
+	Url		string
+	Org		string
+	Bucket		string
+	Token		string
+	Timeout		int
+}
+
+// ref. https://docs.influxdata.com/influxdb/v2/write-data/best-practices/optimize-writes/
+const influxMaxLines = 5000
+
+type tsdbIntfInfluxDB struct {
+	debug		bool
+	writeUrl	string
+	token		string
+	dataOut		map[string]tsdbIntfInfluxDBDataOut
+
+	httpClient	*http.Client
+}
+
+type tsdbIntfInfluxDBDataOutField struct {
+	Key		string
+	Type		string
+}
+
+type tsdbIntfInfluxDBDataOut struct {
+	Channel		string
+	Measurement	string
+	Tags		[]string
+	Fields		[]tsdbIntfInfluxDBDataOutField
+}
+
+func tsdbIntfInfluxDBNew(cfg TsdbIntfConf) (*tsdbIntfInfluxDB, error) {
+	// check valid parameter
+	if cfg.DriverInfluxDB.Url == "" {
+		return nil, fmt.Errorf("InfluxDB URL not specified")
+	}
+
+	if cfg.DriverInfluxDB.Org == "" || cfg.DriverInfluxDB.Bucket == "" {
+		return nil, fmt.Errorf("InfluxDB organization or bucket not specified")
+	}
+
+	if cfg.DriverInfluxDB.Timeout < 1 {
+		return nil, fmt.Errorf("InfluxDB timeout is below 1")
+	}
+
+	// build write endpoint
+	// ref. https://docs.influxdata.com/influxdb/v2/api/#operation/PostWrite
+	u, err := url.Parse(cfg.DriverInfluxDB.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid InfluxDB URL: %v", err)
+	}
+	u = u.JoinPath("/api/v2/write")
+
+	q := u.Query()
+	q.Set("org", cfg.DriverInfluxDB.Org)
+	q.Set("bucket", cfg.DriverInfluxDB.Bucket)
+	q.Set("precision", "ns")
+	u.RawQuery = q.Encode()
+
+	// start building interface
+	r := &tsdbIntfInfluxDB {
+		debug:		cfg.Debug,
+		writeUrl:	u.String(),
+		token:		cfg.DriverInfluxDB.Token,
+		dataOut:	make(map[string]tsdbIntfInfluxDBDataOut),
+		httpClient:	&http.Client {
+					Timeout: time.Duration(cfg.DriverInfluxDB.Timeout) * time.Second,
+				},
+	}
+
+	// build data out
+	for i := 0; i < len(cfg.Datasource); i++ {
+		if cfg.Datasource[i].Channel == "" ||
+			cfg.Datasource[i].Table == "" {
+			return nil, fmt.Errorf("Missing mandatory data out parameter")
+		}
+
+		dout := tsdbIntfInfluxDBDataOut {
+			Channel:	cfg.Datasource[i].Channel,
+			Measurement:	cfg.Datasource[i].Table,
+			Tags:		cfg.Datasource[i].Keys,
+		}
+
+		// raw payloads are tagged with channel only, decoded ones need at least one tag
+		if strings.ToLower(cfg.Datasource[i].Datalayout) != LAYOUT_RAW && len(dout.Tags) < 1 {
+			return nil, fmt.Errorf("Tag keys for channel %s was empty", dout.Channel)
+		}
+
+		for _, v := range dout.Tags {
+			if v == "" {
+				return nil, fmt.Errorf("Empty tag key for channel %s", dout.Channel)
+			}
+		}
+
+		// map timestream style types to line protocol field types
+		// ref. https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/#data-types-and-format
+		for j := 0; j < len(cfg.Datasource[i].Metrics); j++ {
+			t := strings.ToUpper(cfg.Datasource[i].Metrics[j].Type)
+			switch t {
+			case "BIGINT":
+			case "BOOLEAN":
+			case "DOUBLE":
+			case "VARCHAR":
+			default:
+				return nil, fmt.Errorf("Unsupported data type for InfluxDB: %s", t)
+			}
+
+			f := tsdbIntfInfluxDBDataOutField {
+				Key:	cfg.Datasource[i].Metrics[j].Key,
+				Type:	t,
+			}
+
+			dout.Fields = append(dout.Fields, f)
+		}
+
+		r.dataOut[cfg.Datasource[i].Channel] = dout
+	}
+
+	log.Printf("InfluxDB client ready: %s", cfg.DriverInfluxDB.Url)
+	return r, nil
+}
+
+func (i *tsdbIntfInfluxDB) AddRecords(tbl string, records []tsdbRecord) error {
+	var lines []string
+	var failed int
+
+	for _, rec := range records {
+		outParams, ok := i.dataOut[rec.Channel]
+		if !ok {
+			log.Printf("Data out parameters for channel %s was not found", rec.Channel)
+			failed++
+			continue
+		}
+
+		line, err := i.buildLine(outParams, rec.Time, rec.Data)
+		if err != nil {
+			log.Printf("Failed to build line for channel %s: %v", rec.Channel, err)
+			failed++
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	// keep each request within recommended batch size
+	for start := 0; start < len(lines); start += influxMaxLines {
+		end := start + influxMaxLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		err := i.writeLines(lines[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records could not be built for measurement %s", failed, len(records), tbl)
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfInfluxDB) buildLine(outParams tsdbIntfInfluxDBDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) (string, error) {
+	if len(outParams.Tags) < 1 {
+		return "", fmt.Errorf("Tag keys for channel %s was empty", outParams.Channel)
+	}
+
+	// tags
+	var tags []string
+	for _, v := range outParams.Tags {
+		tval, err := data.GetJsonKeyValueAsStr(v)
+		if err != nil {
+			return "", fmt.Errorf("JSON key %s does not exist", v)
+		} else if tval == "" {
+			// line protocol does not allow empty tag values
+			continue
+		}
+
+		tags = append(tags, influxEscapeKey(v) + "=" + influxEscapeKey(tval))
+	}
+
+	if len(tags) < 1 {
+		return "", fmt.Errorf("Tags was empty")
+	}
+
+	// fields
+	var fields []string
+	for _, v := range outParams.Fields {
+		rval, err := data.GetJsonKeyValueAsStr(v.Key)
+		if err != nil {
+			return "", fmt.Errorf("JSON key %s does not exist", v.Key)
+		} else if rval == "" && tsdbValueUnset(data, v.Key) {
+			continue
+		} else if rval == "" {
+			return "", fmt.Errorf("Measurement data is empty for JSON key %s", v.Key)
+		}
+
+		fval, err := influxFieldValue(v.Type, rval)
+		if err != nil {
+			return "", fmt.Errorf("Invalid value for JSON key %s: %v", v.Key, err)
+		}
+
+		fields = append(fields, influxEscapeKey(v.Key) + "=" + fval)
+	}
+
+	if len(fields) < 1 {
+		return "", fmt.Errorf("Fields was empty")
+	}
+
+	line := influxEscapeMeasurement(outParams.Measurement) + "," +
+		strings.Join(tags, ",") + " " +
+		strings.Join(fields, ",") + " " +
+		strconv.FormatInt(ts.UnixNano(), 10)
+
+	if i.debug {
+		log.Printf("Line: %s", line)
+	}
+
+	return line, nil
+}
+
+func (i *tsdbIntfInfluxDB) AddRecordRaw(channel string, ts time.Time, data string) error {
+	outParams, ok := i.dataOut[channel]
+	if !ok {
+		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+	}
+
+	// raw payload is stored as a string field tagged with the channel
+	line := influxEscapeMeasurement(outParams.Measurement) + "," +
+		"channel=" + influxEscapeKey(channel) + " " +
+		"data=" + influxFieldString(data) + " " +
+		strconv.FormatInt(ts.UnixNano(), 10)
+
+	if i.debug {
+		log.Printf("Line: %s", line)
+	}
+
+	return i.writeLines([]string{line})
+}
+
+func (i *tsdbIntfInfluxDB) writeLines(lines []string) error {
+	body := strings.Join(lines, "\n")
+
+	req, err := http.NewRequest(http.MethodPost, i.writeUrl, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.token != "" {
+		req.Header.Set("Authorization", "Token " + i.token)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to write record: %v", err)
+		return &tsdbRetryError{err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("InfluxDB write failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+
+		// rate limited or server side trouble, request itself was fine
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return &tsdbRetryError{err: err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfInfluxDB) Close() error {
+	i.httpClient.CloseIdleConnections()
+	return nil
+}
+
+func influxFieldValue(t string, v string) (string, error) {
+	switch t {
+	case "BIGINT":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(n, 10) + "i", nil
+
+	case "DOUBLE":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+
+	case "BOOLEAN":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b), nil
+
+	case "VARCHAR":
+		return influxFieldString(v), nil
+	}
+
+	return "", fmt.Errorf("Unknown data type: %s", t)
+}
+
+// line protocol has no escape for newlines, they are written as literal \n so a value never splits a line
+func influxFieldString(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func influxEscapeMeasurement(v string) string {
+	r := strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`, "\r", `\r`)
+	return r.Replace(v)
+}
+
+func influxEscapeKey(v string) string {
+	r := strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`, "\r", `\r`)
+	return r.Replace(v)
+}
@@ -0,0 +1,224 @@
+package tsdb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func influxTestConf(url string) TsdbIntfConf {
+	return TsdbIntfConf {
+		DriverInfluxDB:	TsdbIntfConfDrvInfluxDB {
+					Url:		url,
+					Org:		"org",
+					Bucket:		"bucket",
+					Token:		"secret",
+					Timeout:	5,
+				},
+		Datasource:	[]TsdbIntfConfDS {
+					{
+						Channel:	"/sites/s1/stats/clients",
+						Datalayout:	"stats_client",
+						Table:		"client stats",
+						Keys:		[]string{"mac", "hostname"},
+						Metrics:	[]TsdbIntfConfDSMetric {
+									{ Key: "rssi", Type: "BIGINT" },
+									{ Key: "snr", Type: "DOUBLE" },
+									{ Key: "ssid", Type: "VARCHAR" },
+								},
+					},
+					{
+						Channel:	"/sites/s1/raw",
+						Datalayout:	"raw",
+						Table:		"raw",
+					},
+				},
+	}
+}
+
+func TestInfluxEscape(t *testing.T) {
+	tests := []struct {
+		name	string
+		fn	func(string) string
+		in	string
+		want	string
+	}{
+		{ "key plain", influxEscapeKey, "mac", "mac" },
+		{ "key special", influxEscapeKey, "a,b=c d", `a\,b\=c\ d` },
+		{ "key newline", influxEscapeKey, "a\nb\rc", `a\nb\rc` },
+		{ "measurement", influxEscapeMeasurement, "a,b c=d", `a\,b\ c=d` },
+		{ "measurement newline", influxEscapeMeasurement, "a\nb", `a\nb` },
+		{ "string", influxFieldString, `say "hi" \o/`, `"say \"hi\" \\o/"` },
+		{ "string newline", influxFieldString, "line1\nline2", `"line1\nline2"` },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.fn(tt.in)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if strings.ContainsAny(got, "\n\r") {
+				t.Errorf("escaped value %q still contains a line break", got)
+			}
+		})
+	}
+}
+
+func TestInfluxFieldValue(t *testing.T) {
+	tests := []struct {
+		typ	string
+		in	string
+		want	string
+		err	bool
+	}{
+		{ "BIGINT", "-42", "-42i", false },
+		{ "BIGINT", "1.5", "", true },
+		{ "DOUBLE", "1.50", "1.5", false },
+		{ "DOUBLE", "x", "", true },
+		{ "BOOLEAN", "true", "true", false },
+		{ "VARCHAR", "a\"b", `"a\"b"`, false },
+		{ "TIMESTAMP", "1", "", true },
+	}
+
+	for _, tt := range tests {
+		got, err := influxFieldValue(tt.typ, tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%s %s: unexpected error %v", tt.typ, tt.in, err)
+		} else if got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.typ, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxDBNewValidation(t *testing.T) {
+	tests := []struct {
+		name	string
+		modify	func(*TsdbIntfConf)
+	}{
+		{ "no url", func(c *TsdbIntfConf) { c.DriverInfluxDB.Url = "" } },
+		{ "no bucket", func(c *TsdbIntfConf) { c.DriverInfluxDB.Bucket = "" } },
+		{ "no timeout", func(c *TsdbIntfConf) { c.DriverInfluxDB.Timeout = 0 } },
+		{ "no tags", func(c *TsdbIntfConf) { c.Datasource[0].Keys = nil } },
+		{ "empty tag", func(c *TsdbIntfConf) { c.Datasource[0].Keys = []string{"mac", ""} } },
+		{ "bad type", func(c *TsdbIntfConf) { c.Datasource[0].Metrics[0].Type = "TIMESTAMP" } },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := influxTestConf("http://127.0.0.1:1")
+			tt.modify(&cfg)
+
+			_, err := tsdbIntfInfluxDBNew(cfg)
+			if err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestInfluxDBWrite(t *testing.T) {
+	var body string
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "bucket" ||
+			r.URL.Query().Get("precision") != "ns" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("unexpected authorization %s", r.Header.Get("Authorization"))
+		}
+
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	b, err := tsdbIntfInfluxDBNew(influxTestConf(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	data, err := tsdbLayoutDecode("stats_client", `{"mac":"5c5b35000001","hostname":"host a","rssi":-61,"snr":30.5,"ssid":"corp\nnet"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 5)
+	rec := tsdbRecord { Channel: "/sites/s1/stats/clients", Time: ts, Data: data }
+
+	tests := []struct {
+		name		string
+		status		int
+		add		func() error
+		want		string
+		retriable	bool
+	}{
+		{
+			name:	"record",
+			status:	http.StatusNoContent,
+			add:	func() error { return b.AddRecords("client stats", []tsdbRecord{rec}) },
+			want:	`client\ stats,mac=5c5b35000001,hostname=host\ a rssi=-61i,snr=30.5,ssid="corp\nnet" 1700000000000000005`,
+		},
+		{
+			name:	"raw",
+			status:	http.StatusNoContent,
+			add:	func() error { return b.AddRecordRaw("/sites/s1/raw", ts, "{\"a\":\n\"b\"}") },
+			want:	`raw,channel=/sites/s1/raw data="{\"a\":\n\"b\"}" 1700000000000000005`,
+		},
+		{
+			name:		"unavailable",
+			status:		http.StatusServiceUnavailable,
+			add:		func() error { return b.AddRecords("client stats", []tsdbRecord{rec}) },
+			retriable:	true,
+		},
+		{
+			name:	"rejected",
+			status:	http.StatusBadRequest,
+			add:	func() error { return b.AddRecords("client stats", []tsdbRecord{rec}) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			err := tt.add()
+
+			if tt.status >= 300 {
+				if err == nil {
+					t.Fatalf("expected error for status %d", tt.status)
+				} else if tsdbRetriable(err) != tt.retriable {
+					t.Errorf("retriable is %v, want %v", tsdbRetriable(err), tt.retriable)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			} else if body != tt.want {
+				t.Errorf("got line\n%s\nwant\n%s", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfluxDBTransportError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	b, err := tsdbIntfInfluxDBNew(influxTestConf(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.AddRecordRaw("/sites/s1/raw", time.Now(), "{}")
+	if !tsdbRetriable(err) {
+		t.Errorf("transport error should be retriable, got %v", err)
+	}
+}
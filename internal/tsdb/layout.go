@@ -0,0 +1,44 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+// raw payloads are not decoded and are passed to backend as is
+const LAYOUT_RAW = "raw"
+
+type tsdbLayoutNewFunc func() mistdatafmt.MistDataFmtIntf
+
+// registry of decodable data layouts, add new WebSocket message formats here
+var tsdbLayouts = map[string]tsdbLayoutNewFunc {
+	"stats_client":	func() mistdatafmt.MistDataFmtIntf { return &mistdatafmt.WsMsgClientStat{} },
+	"map_clients":	func() mistdatafmt.MistDataFmtIntf { return &mistdatafmt.WsMsgMapClient{} },
+	"map_assets":	func() mistdatafmt.MistDataFmtIntf { return &mistdatafmt.WsMsgMapBleAsset{} },
+}
+
+func tsdbLayoutExists(layout string) bool {
+	if layout == LAYOUT_RAW {
+		return true
+	}
+
+	_, ok := tsdbLayouts[layout]
+	return ok
+}
+
+func tsdbLayoutDecode(layout string, data string) (mistdatafmt.MistDataFmtIntf, error) {
+	newFunc, ok := tsdbLayouts[layout]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported layout %s", layout)
+	}
+
+	r := newFunc()
+	err := json.Unmarshal([]byte(data), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
@@ -0,0 +1,557 @@
+package tsdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDrvOpenSearch struct {
+	Url		string
+	User		string
+	Password	string
+	Timeout		int
+	MaxRetries	int
+	IndexDate	string
+}
+
+const (
+	opensearchDefaultIndexDate	= "2006.01.02"
+	opensearchRetryBackoff		= time.Second
+	opensearchTimeField		= "@timestamp"
+	// layouts carry a radio "channel" field, so websocket channel goes under its own name
+	opensearchChannelField		= "mist_channel"
+)
+
+type tsdbIntfOpenSearch struct {
+	debug		bool
+	url		*url.URL
+	user		string
+	password	string
+	indexDate	string
+	maxRetries	int
+	backoff		time.Duration
+	deadLetter	tsdbDeadLetterSink
+	dataOut		map[string]tsdbIntfOpenSearchDataOut
+
+	httpClient	*http.Client
+}
+
+type tsdbIntfOpenSearchDataOut struct {
+	Channel		string
+	Index		string
+	Raw		bool
+	Fields		[]string
+	Keys		[]string
+	Metrics		[]TsdbIntfConfDSMetric
+}
+
+// one document of a bulk request, rec is its index in the written batch
+type tsdbIntfOpenSearchDoc struct {
+	index		string
+	id		string
+	body		[]byte
+	rec		int
+}
+
+type opensearchBulkResponse struct {
+	Errors		bool					`json:"errors"`
+	Items		[]map[string]opensearchBulkItem		`json:"items"`
+}
+
+type opensearchBulkItem struct {
+	Status		int			`json:"status"`
+	Error		json.RawMessage		`json:"error"`
+}
+
+func tsdbIntfOpenSearchNew(cfg TsdbIntfConf, deadLetter tsdbDeadLetterSink) (*tsdbIntfOpenSearch, error) {
+	var err error
+
+	// check valid parameter
+	if cfg.DriverOpenSearch.Url == "" {
+		return nil, fmt.Errorf("OpenSearch URL not specified")
+	}
+
+	if cfg.DriverOpenSearch.Timeout < 1 {
+		return nil, fmt.Errorf("OpenSearch timeout is below 1")
+	}
+
+	if cfg.DriverOpenSearch.MaxRetries < 0 {
+		return nil, fmt.Errorf("OpenSearch max retries is below 0")
+	}
+
+	u, err := url.Parse(cfg.DriverOpenSearch.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OpenSearch URL: %v", err)
+	}
+
+	// start building interface
+	r := &tsdbIntfOpenSearch {
+		debug:		cfg.Debug,
+		url:		u,
+		user:		cfg.DriverOpenSearch.User,
+		password:	cfg.DriverOpenSearch.Password,
+		indexDate:	cfg.DriverOpenSearch.IndexDate,
+		maxRetries:	cfg.DriverOpenSearch.MaxRetries,
+		backoff:	opensearchRetryBackoff,
+		deadLetter:	deadLetter,
+		dataOut:	make(map[string]tsdbIntfOpenSearchDataOut),
+		httpClient:	&http.Client {
+					Timeout: time.Duration(cfg.DriverOpenSearch.Timeout) * time.Second,
+				},
+	}
+
+	if r.indexDate == "" {
+		r.indexDate = opensearchDefaultIndexDate
+	}
+
+	// build data out, index templates are generated per table from layout and metrics
+	templates := make(map[string]map[string]interface{})
+	for i := 0; i < len(cfg.Datasource); i++ {
+		if cfg.Datasource[i].Channel == "" ||
+			cfg.Datasource[i].Table == "" {
+			return nil, fmt.Errorf("Missing mandatory data out parameter")
+		}
+
+		layout := strings.ToLower(cfg.Datasource[i].Datalayout)
+		dout := tsdbIntfOpenSearchDataOut {
+			Channel:	cfg.Datasource[i].Channel,
+			Index:		strings.ToLower(cfg.Datasource[i].Table),
+			Raw:		layout == LAYOUT_RAW,
+			Keys:		cfg.Datasource[i].Keys,
+			Metrics:	cfg.Datasource[i].Metrics,
+		}
+
+		props, ok := templates[dout.Index]
+		if !ok {
+			props = map[string]interface{} {
+				opensearchTimeField:	map[string]string{"type": "date"},
+				opensearchChannelField:	map[string]string{"type": "keyword"},
+			}
+			templates[dout.Index] = props
+		}
+
+		fields := tsdbLayoutFields(layout)
+		for k, t := range fields {
+			dout.Fields = append(dout.Fields, k)
+			if _, ok := props[k]; !ok {
+				props[k] = opensearchFieldMapping(t)
+			}
+		}
+
+		for _, k := range dout.Keys {
+			props[k] = map[string]string{"type": "keyword"}
+		}
+
+		for _, m := range dout.Metrics {
+			props[m.Key] = opensearchMetricMapping(m.Type)
+		}
+
+		r.dataOut[cfg.Datasource[i].Channel] = dout
+	}
+
+	for index, props := range templates {
+		err = r.putTemplate(index, props)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("OpenSearch client ready: %s", cfg.DriverOpenSearch.Url)
+	return r, nil
+}
+
+// ref. https://opensearch.org/docs/latest/field-types/
+func opensearchFieldMapping(t reflect.Type) interface{} {
+	if t == tsdbJsonNumberType {
+		return map[string]string{"type": "double"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]string{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]string{"type": "long"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]string{"type": "double"}
+	case reflect.Struct, reflect.Map, reflect.Slice:
+		return map[string]string{"type": "object"}
+	}
+
+	// hostnames and addresses are searched by exact value
+	return map[string]string{"type": "keyword"}
+}
+
+func opensearchMetricMapping(t string) interface{} {
+	switch strings.ToUpper(t) {
+	case "BIGINT":
+		return map[string]string{"type": "long"}
+	case "DOUBLE":
+		return map[string]string{"type": "double"}
+	case "BOOLEAN":
+		return map[string]string{"type": "boolean"}
+	}
+
+	return map[string]string{"type": "keyword"}
+}
+
+// composable template applied to every dated index of the table
+// ref. https://opensearch.org/docs/latest/im-plugin/index-templates/
+func (i *tsdbIntfOpenSearch) putTemplate(index string, props map[string]interface{}) error {
+	tmpl := map[string]interface{} {
+		"index_patterns":	[]string{index + "-*"},
+		"template":		map[string]interface{} {
+						"mappings":	map[string]interface{} {
+									"properties":	props,
+								},
+					},
+	}
+
+	body, err := json.Marshal(tmpl)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Ensuring index template %s exists..", index)
+	_, err = i.request(http.MethodPut, "/_index_template/" + url.PathEscape(index), body)
+	if err != nil {
+		log.Printf("Could not put index template: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfOpenSearch) indexName(outParams tsdbIntfOpenSearchDataOut, ts time.Time) string {
+	return outParams.Index + "-" + ts.UTC().Format(i.indexDate)
+}
+
+func (i *tsdbIntfOpenSearch) AddRecords(tbl string, records []tsdbRecord) error {
+	var docs []tsdbIntfOpenSearchDoc
+	var failed int
+
+	for n, rec := range records {
+		outParams, ok := i.dataOut[rec.Channel]
+		if !ok {
+			log.Printf("Data out parameters for channel %s was not found", rec.Channel)
+			failed++
+			continue
+		}
+
+		body, err := i.buildDoc(outParams, rec.Time, rec.Data)
+		if err != nil {
+			log.Printf("Failed to build document for channel %s: %v", rec.Channel, err)
+			failed++
+			continue
+		}
+
+		d := tsdbIntfOpenSearchDoc {
+			index:	i.indexName(outParams, rec.Time),
+			id:	i.docId(outParams, rec.Time, rec.Data),
+			body:	body,
+			rec:	n,
+		}
+		docs = append(docs, d)
+	}
+
+	var errs []error
+	temp, err := i.writeDocs(tbl, docs)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// documents still rejected for transient reasons go back to the caller
+	var retry []tsdbRecord
+	for _, d := range temp {
+		retry = append(retry, records[d.rec])
+	}
+
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d records could not be built for table %s", failed, len(records), tbl))
+	}
+
+	return tsdbRetryJoin(errs, retry)
+}
+
+// same record always gets the same id, so a replayed write overwrites instead of adding a copy
+func (i *tsdbIntfOpenSearch) docId(outParams tsdbIntfOpenSearchDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) string {
+	parts := []string{outParams.Channel, strconv.FormatInt(ts.UnixNano(), 10)}
+	for _, k := range outParams.Keys {
+		v, _ := data.GetJsonKeyValueAsStr(k)
+		parts = append(parts, k + "=" + v)
+	}
+
+	return opensearchDocId(parts)
+}
+
+func opensearchDocId(parts []string) string {
+	h := sha256.New()
+	for _, v := range parts {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (i *tsdbIntfOpenSearch) buildDoc(outParams tsdbIntfOpenSearchDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) ([]byte, error) {
+	doc := map[string]interface{} {
+		opensearchTimeField:	ts.UTC().Format(time.RFC3339Nano),
+		opensearchChannelField:	outParams.Channel,
+	}
+
+	// whole decoded message is indexed so it can be searched by any field
+	for _, k := range outParams.Fields {
+		v, err := data.GetJsonKeyValue(k)
+		if err != nil {
+			continue
+		}
+
+		switch t := v.(type) {
+		case string:
+			if t == "" {
+				continue
+			}
+		case json.Number:
+			if t == "" {
+				continue
+			}
+		}
+		doc[k] = v
+	}
+
+	for _, k := range outParams.Keys {
+		v, err := data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			return nil, fmt.Errorf("JSON key %s does not exist", k)
+		} else if v != "" {
+			doc[k] = v
+		}
+	}
+
+	// metrics may be derived and not part of the layout
+	for _, m := range outParams.Metrics {
+		v, err := data.GetJsonKeyValueAsStr(m.Key)
+		if err != nil {
+			return nil, fmt.Errorf("JSON key %s does not exist", m.Key)
+		} else if v == "" {
+			continue
+		}
+
+		fval, err := tsdbFieldValue(strings.ToUpper(m.Type), v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for JSON key %s: %v", m.Key, err)
+		}
+		doc[m.Key] = fval
+	}
+
+	return json.Marshal(doc)
+}
+
+func (i *tsdbIntfOpenSearch) AddRecordRaw(channel string, ts time.Time, data string) error {
+	outParams, ok := i.dataOut[channel]
+	if !ok {
+		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+	}
+
+	// objects are indexed as they are, anything else is wrapped
+	doc := make(map[string]interface{})
+	err := json.Unmarshal([]byte(data), &doc)
+	if err != nil {
+		doc = map[string]interface{} {
+			"data":		data,
+		}
+	}
+	doc[opensearchTimeField] = ts.UTC().Format(time.RFC3339Nano)
+	doc[opensearchChannelField] = channel
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	d := tsdbIntfOpenSearchDoc {
+		index:	i.indexName(outParams, ts),
+		id:	opensearchDocId([]string{channel, strconv.FormatInt(ts.UnixNano(), 10), data}),
+		body:	body,
+	}
+
+	temp, err := i.writeDocs(outParams.Index, []tsdbIntfOpenSearchDoc{d})
+	if len(temp) > 0 {
+		return &tsdbRetryError{err: err}
+	}
+
+	return err
+}
+
+// sends bulk request, resending only documents rejected for transient reasons with backoff
+// returns documents still rejected temporarily once retries are used up, or all left if request failed as a whole
+// ids only depend on the record, so a document indexed twice is overwritten rather than copied
+func (i *tsdbIntfOpenSearch) writeDocs(tbl string, docs []tsdbIntfOpenSearchDoc) ([]tsdbIntfOpenSearchDoc, error) {
+	var errs []error
+
+	backoff := i.backoff
+	for attempt := 0; len(docs) > 0; attempt++ {
+		if attempt > 0 {
+			log.Printf("%d documents for table %s were rejected temporarily, retrying in %v", len(docs), tbl, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		temp, err := i.bulk(tbl, docs)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if tsdbRetriable(err) {
+			return docs, errors.Join(errs...)
+		} else if len(temp) > 0 && attempt >= i.maxRetries {
+			errs = append(errs, fmt.Errorf("%d documents were rejected temporarily for table %s", len(temp), tbl))
+			return temp, errors.Join(errs...)
+		}
+		docs = temp
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// sends bulk request once, returns documents rejected for transient reasons
+// permanently rejected ones are dead-lettered, all of them if the request itself is refused
+// ref. https://opensearch.org/docs/latest/api-reference/document-apis/bulk/
+func (i *tsdbIntfOpenSearch) bulk(tbl string, docs []tsdbIntfOpenSearchDoc) ([]tsdbIntfOpenSearchDoc, error) {
+
+	var buf bytes.Buffer
+	for _, d := range docs {
+		meta, err := json.Marshal(map[string]interface{} {
+			"index":	map[string]string{"_index": d.index, "_id": d.id},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(meta)
+		buf.WriteByte('\n')
+		buf.Write(d.body)
+		buf.WriteByte('\n')
+	}
+
+	resp, err := i.request(http.MethodPost, "/_bulk", buf.Bytes())
+	if err != nil && !tsdbRetriable(err) {
+		for _, d := range docs {
+			i.deadLetterDoc(tbl, err.Error(), d)
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result opensearchBulkResponse
+	err = json.Unmarshal(resp, &result)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse bulk response: %v", err)
+	} else if !result.Errors {
+		return nil, nil
+	}
+
+	var rejected int
+	var temp []tsdbIntfOpenSearchDoc
+	for n, item := range result.Items {
+		if n >= len(docs) {
+			break
+		}
+
+		for _, v := range item {
+			if v.Status < 300 {
+				continue
+			}
+
+			if v.Status == http.StatusTooManyRequests || v.Status >= 500 {
+				temp = append(temp, docs[n])
+				continue
+			}
+
+			rejected++
+			i.deadLetterDoc(tbl, string(v.Error), docs[n])
+		}
+	}
+
+	if rejected > 0 {
+		return temp, fmt.Errorf("%d documents were rejected for table %s", rejected, tbl)
+	}
+
+	return temp, nil
+}
+
+func (i *tsdbIntfOpenSearch) deadLetterDoc(tbl string, detail string, doc tsdbIntfOpenSearchDoc) {
+	e := tsdbDeadLetter {
+		Time:		time.Now(),
+		Driver:		"opensearch",
+		Table:		tbl,
+		Reason:		"rejected",
+		Detail:		detail,
+		Record:		json.RawMessage(doc.body),
+	}
+
+	err := i.deadLetter.Write(e)
+	if err != nil {
+		log.Printf("Failed to write dead-letter record: %v", err)
+	}
+}
+
+func (i *tsdbIntfOpenSearch) request(method string, path string, body []byte) ([]byte, error) {
+	u := i.url.JoinPath(path)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if path == "/_bulk" {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if i.user != "" {
+		req.SetBasicAuth(i.user, i.password)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to send request: %v", err)
+		return nil, &tsdbRetryError{err: err}
+	}
+	defer resp.Body.Close()
+
+	msg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &tsdbRetryError{err: err}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("OpenSearch request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return nil, &tsdbRetryError{err: err}
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (i *tsdbIntfOpenSearch) Close() error {
+	i.httpClient.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,316 @@
+package tsdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulk endpoint answering each document with the next status, 200 when none left
+// rounds replace items for consecutive requests, ids of each request are kept in sent
+type opensearchTestServer struct {
+	mu		sync.Mutex
+	status		int
+	items		[]int
+	rounds		[][]int
+	ids		[]string
+	sent		[][]string
+}
+
+func (s *opensearchTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path != "/_bulk" {
+		w.Write([]byte("{}"))
+		return
+	}
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	sc := bufio.NewScanner(bytes.NewReader(body))
+
+	statuses := s.items
+	if len(s.rounds) > 0 {
+		statuses = s.rounds[0]
+		s.rounds = s.rounds[1:]
+	}
+
+	var items []map[string]opensearchBulkItem
+	var sent []string
+	rejected := false
+	for n := 0; sc.Scan(); n++ {
+		var meta map[string]map[string]string
+		json.Unmarshal(sc.Bytes(), &meta)
+		s.ids = append(s.ids, meta["index"]["_id"])
+		sent = append(sent, meta["index"]["_id"])
+		sc.Scan()
+
+		st := http.StatusCreated
+		if n < len(statuses) {
+			st = statuses[n]
+		}
+		if st >= 300 {
+			rejected = true
+		}
+		items = append(items, map[string]opensearchBulkItem{"index": { Status: st }})
+	}
+	s.sent = append(s.sent, sent)
+
+	json.NewEncoder(w).Encode(opensearchBulkResponse { Errors: rejected, Items: items })
+}
+
+func TestOpenSearchAddRecords(t *testing.T) {
+	srv := &opensearchTestServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	cfg := TsdbIntfConf {
+		DriverOpenSearch:	TsdbIntfConfDrvOpenSearch {
+						Url:		ts.URL,
+						Timeout:	5,
+					},
+		Datasource:		[]TsdbIntfConfDS {
+						{
+							Channel:	"/sites/s1/stats/clients",
+							Datalayout:	"stats_client",
+							Table:		"clients",
+							Keys:		[]string{"mac"},
+						},
+					},
+	}
+
+	b, err := tsdbIntfOpenSearchNew(cfg, &tsdbDeadLetterLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []tsdbRecord
+	for _, mac := range []string{"a", "b", "c"} {
+		data, err := tsdbLayoutDecode("stats_client", `{"mac":"` + mac + `","rssi":-61}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, tsdbRecord { Channel: "/sites/s1/stats/clients", Time: time.Unix(1700000000, 0), Data: data })
+	}
+
+	tests := []struct {
+		name		string
+		status		int
+		items		[]int
+		err		bool
+		retry		[]string
+	}{
+		{ name: "accepted" },
+		{ name: "temporarily rejected", items: []int{201, 429, 503}, err: true, retry: []string{"b", "c"} },
+		{ name: "rejected", items: []int{400, 201, 201}, err: true },
+		{ name: "mixed", items: []int{400, 429, 201}, err: true, retry: []string{"b"} },
+		{ name: "unavailable", status: http.StatusServiceUnavailable, err: true, retry: []string{"a", "b", "c"} },
+		{ name: "bad request", status: http.StatusBadRequest, err: true },
+	}
+
+	var ids []string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.mu.Lock()
+			srv.status = tt.status
+			srv.items = tt.items
+			srv.ids = nil
+			srv.mu.Unlock()
+
+			err := b.AddRecords("clients", records)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			var retry []string
+			for _, rec := range tsdbRetryRecords(err, records) {
+				v, _ := rec.Data.GetJsonKeyValueAsStr("mac")
+				retry = append(retry, v)
+			}
+			if strings.Join(retry, ",") != strings.Join(tt.retry, ",") {
+				t.Errorf("retry %v, want %v", retry, tt.retry)
+			}
+
+			// ids only depend on the record, so a retried write replaces the earlier copy
+			if tt.status == 0 {
+				if ids == nil {
+					ids = srv.ids
+				} else if strings.Join(ids, ",") != strings.Join(srv.ids, ",") {
+					t.Errorf("ids changed between writes: %v and %v", ids, srv.ids)
+				}
+			}
+		})
+	}
+
+	if len(ids) != 3 || ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("unexpected document ids %v", ids)
+	}
+}
+
+func opensearchTestNew(t *testing.T, maxRetries int) (*tsdbIntfOpenSearch, *opensearchTestServer, *fanoutTestSink, []tsdbRecord) {
+	srv := &opensearchTestServer{}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	cfg := TsdbIntfConf {
+		DriverOpenSearch:	TsdbIntfConfDrvOpenSearch {
+						Url:		ts.URL,
+						Timeout:	5,
+						MaxRetries:	maxRetries,
+					},
+		Datasource:		[]TsdbIntfConfDS {
+						{
+							Channel:	"/sites/s1/stats/clients",
+							Datalayout:	"stats_client",
+							Table:		"clients",
+							Keys:		[]string{"mac"},
+						},
+						{
+							Channel:	"/sites/s1/raw",
+							Datalayout:	"raw",
+							Table:		"raw",
+						},
+					},
+	}
+
+	dl := &fanoutTestSink{}
+	b, err := tsdbIntfOpenSearchNew(cfg, dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.backoff = time.Millisecond
+
+	var records []tsdbRecord
+	for _, mac := range []string{"a", "b", "c"} {
+		data, err := tsdbLayoutDecode("stats_client", `{"mac":"` + mac + `","rssi":-61}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, tsdbRecord { Channel: "/sites/s1/stats/clients", Time: time.Unix(1700000000, 0), Data: data })
+	}
+
+	return b, srv, dl, records
+}
+
+func TestOpenSearchRetry(t *testing.T) {
+	tests := []struct {
+		name		string
+		rounds		[][]int
+		err		bool
+		retry		[]string
+		rejected	int
+		sent		[]int
+	}{
+		{
+			name:	"transient items resent until accepted",
+			rounds:	[][]int{{201, 429, 503}, {429, 201}, {201}},
+			sent:	[]int{3, 2, 1},
+		},
+		{
+			name:	"retries used up",
+			rounds:	[][]int{{429, 201, 201}, {429}, {503}},
+			err:	true,
+			retry:	[]string{"a"},
+			sent:	[]int{3, 1, 1},
+		},
+		{
+			name:		"rejected on retry",
+			rounds:		[][]int{{201, 429, 201}, {400}},
+			err:		true,
+			rejected:	1,
+			sent:		[]int{3, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		b, srv, dl, records := opensearchTestNew(t, 2)
+		srv.rounds = tt.rounds
+
+		err := b.AddRecords("clients", records)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+
+		var retry []string
+		for _, rec := range tsdbRetryRecords(err, records) {
+			v, _ := rec.Data.GetJsonKeyValueAsStr("mac")
+			retry = append(retry, v)
+		}
+		if strings.Join(retry, ",") != strings.Join(tt.retry, ",") {
+			t.Errorf("%s: retry %v, want %v", tt.name, retry, tt.retry)
+		}
+
+		if dl.count("rejected") != tt.rejected {
+			t.Errorf("%s: got %d dead-lettered, want %d", tt.name, dl.count("rejected"), tt.rejected)
+		}
+
+		// only rejected documents are resent, under the id they were first sent with
+		if len(srv.sent) != len(tt.sent) {
+			t.Fatalf("%s: got %d requests, want %d", tt.name, len(srv.sent), len(tt.sent))
+		}
+		first := make(map[string]bool)
+		for _, v := range srv.sent[0] {
+			first[v] = true
+		}
+		for n, want := range tt.sent {
+			if len(srv.sent[n]) != want {
+				t.Errorf("%s: request %d sent %d documents, want %d", tt.name, n, len(srv.sent[n]), want)
+			}
+			for _, v := range srv.sent[n] {
+				if !first[v] {
+					t.Errorf("%s: request %d sent unknown id %s", tt.name, n, v)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenSearchRequestRejected(t *testing.T) {
+	tests := []struct {
+		name		string
+		status		int
+		raw		bool
+		retriable	bool
+		rejected	int
+	}{
+		{ name: "bad request", status: http.StatusBadRequest, rejected: 3 },
+		{ name: "forbidden raw", status: http.StatusForbidden, raw: true, rejected: 1 },
+		{ name: "unavailable", status: http.StatusServiceUnavailable, retriable: true },
+		{ name: "unavailable raw", status: http.StatusServiceUnavailable, raw: true, retriable: true },
+	}
+
+	for _, tt := range tests {
+		b, srv, dl, records := opensearchTestNew(t, 2)
+		srv.status = tt.status
+
+		var err error
+		if tt.raw {
+			err = b.AddRecordRaw("/sites/s1/raw", time.Now(), `{"a":1}`)
+		} else {
+			err = b.AddRecords("clients", records)
+		}
+
+		// request refused as a whole is not resent by the driver
+		if err == nil || tsdbRetriable(err) != tt.retriable {
+			t.Errorf("%s: got error %v, want retriable %v", tt.name, err, tt.retriable)
+		}
+		if !tt.raw && tt.retriable && len(tsdbRetryRecords(err, records)) != len(records) {
+			t.Errorf("%s: not every record is retried", tt.name)
+		}
+		if dl.count("rejected") != tt.rejected {
+			t.Errorf("%s: got %d dead-lettered, want %d", tt.name, dl.count("rejected"), tt.rejected)
+		}
+	}
+}
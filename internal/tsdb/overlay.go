@@ -0,0 +1,72 @@
+package tsdb
+
+import (
+	"strconv"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+// decoded message with some keys replaced or added by the processing stages
+type tsdbOverlayData struct {
+	mistdatafmt.MistDataFmtIntf
+	values		map[string]string
+}
+
+func tsdbOverlayNew(data mistdatafmt.MistDataFmtIntf) *tsdbOverlayData {
+	// stack on existing overlay instead of nesting
+	if o, ok := data.(*tsdbOverlayData); ok {
+		return o
+	}
+
+	return &tsdbOverlayData {
+		MistDataFmtIntf:	data,
+		values:			make(map[string]string),
+	}
+}
+
+// metric set to empty by a processing stage has no value for this record, e.g. rate of first sample
+func tsdbValueUnset(data mistdatafmt.MistDataFmtIntf, key string) bool {
+	o, ok := data.(*tsdbOverlayData)
+	if !ok {
+		return false
+	}
+
+	v, ok := o.values[key]
+	return ok && v == ""
+}
+
+func (m *tsdbOverlayData) Set(key string, value string) {
+	m.values[key] = value
+}
+
+func (m *tsdbOverlayData) GetJsonKeyValue(key string) (interface{}, error) {
+	if v, ok := m.values[key]; ok {
+		return v, nil
+	}
+
+	return m.MistDataFmtIntf.GetJsonKeyValue(key)
+}
+
+func (m *tsdbOverlayData) GetJsonKeyValueAsStr(key string) (string, error) {
+	if v, ok := m.values[key]; ok {
+		return v, nil
+	}
+
+	return m.MistDataFmtIntf.GetJsonKeyValueAsStr(key)
+}
+
+func (m *tsdbOverlayData) GetJsonKeyValueAsFloat64(key string) (float64, error) {
+	if v, ok := m.values[key]; ok {
+		return strconv.ParseFloat(v, 64)
+	}
+
+	return m.MistDataFmtIntf.GetJsonKeyValueAsFloat64(key)
+}
+
+func (m *tsdbOverlayData) GetJsonKeyValueAsInt64(key string) (int64, error) {
+	if v, ok := m.values[key]; ok {
+		return strconv.ParseInt(v, 10, 64)
+	}
+
+	return m.MistDataFmtIntf.GetJsonKeyValueAsInt64(key)
+}
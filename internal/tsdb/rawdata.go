@@ -0,0 +1,87 @@
+package tsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// generic top-level view of a raw JSON payload
+type tsdbRawData map[string]interface{}
+
+func (m *tsdbRawData) UnmarshalJSON(b []byte) error {
+	v := make(map[string]interface{})
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err := d.Decode(&v)
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+func (m *tsdbRawData) GetJsonKeyValue(key string) (interface{}, error) {
+	v, ok := (*m)[key]
+	if !ok {
+		return "", fmt.Errorf("Specified key not found")
+	}
+
+	return v, nil
+}
+
+func (m *tsdbRawData) GetJsonKeyValueAsStr(key string) (string, error) {
+	v, ok := (*m)[key]
+	if !ok {
+		return "", fmt.Errorf("Specified key not found")
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case json.Number:
+		return string(t), nil
+	case bool:
+		return fmt.Sprintf("%v", t), nil
+	}
+
+	// nested objects and arrays are returned as JSON
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (m *tsdbRawData) GetJsonKeyValueAsFloat64(key string) (float64, error) {
+	v, ok := (*m)[key]
+	if !ok {
+		return 0, fmt.Errorf("Specified key not found")
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("Specified key is not a number")
+	}
+
+	return n.Float64()
+}
+
+func (m *tsdbRawData) GetJsonKeyValueAsInt64(key string) (int64, error) {
+	v, ok := (*m)[key]
+	if !ok {
+		return 0, fmt.Errorf("Specified key not found")
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("Specified key is not a number")
+	}
+
+	return n.Int64()
+}
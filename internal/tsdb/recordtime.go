@@ -0,0 +1,56 @@
+package tsdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type tsdbTimeSrc struct {
+	Key		string
+	Unit		time.Duration
+}
+
+func tsdbTimeSrcNew(key string, unit string) (tsdbTimeSrc, error) {
+	r := tsdbTimeSrc {
+		Key:	key,
+	}
+
+	switch strings.ToLower(unit) {
+	case "", "s", "sec", "seconds":
+		r.Unit = time.Second
+	case "ms", "milliseconds":
+		r.Unit = time.Millisecond
+	case "us", "microseconds":
+		r.Unit = time.Microsecond
+	case "ns", "nanoseconds":
+		r.Unit = time.Nanosecond
+	default:
+		return r, fmt.Errorf("Unknown time unit: %s", unit)
+	}
+
+	return r, nil
+}
+
+// parse epoch value in configured unit, both integer and fractional values are accepted
+func (t tsdbTimeSrc) parse(v string) (time.Time, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err == nil {
+		return time.Unix(0, 0).Add(time.Duration(n) * t.Unit), nil
+	}
+
+	// split fractional value to avoid float rounding on sub-unit part
+	ip, fp, ok := strings.Cut(v, ".")
+	n, err = strconv.ParseInt(ip, 10, 64)
+	if !ok || err != nil || fp == "" {
+		return time.Time{}, fmt.Errorf("Invalid timestamp value: %s", v)
+	}
+
+	f, err := strconv.ParseFloat("0." + fp, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid timestamp value: %s", v)
+	}
+
+	return time.Unix(0, 0).Add(time.Duration(n) * t.Unit + time.Duration(f * float64(t.Unit))), nil
+}
@@ -0,0 +1,417 @@
+package tsdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/yumyudai/misttools/pkg/mistdatafmt"
+)
+
+type TsdbIntfConfDrvTimescaleDB struct {
+	Dsn		string
+	Schema		string
+	Hypertable	bool
+}
+
+type tsdbIntfTimescaleDB struct {
+	debug		bool
+	schema		string
+	hypertable	bool
+	dataOut		map[string]tsdbIntfTimescaleDBDataOut
+
+	db		*sql.DB
+}
+
+type tsdbIntfTimescaleDBDataOutColumn struct {
+	Key		string
+	Type		string
+}
+
+type tsdbIntfTimescaleDBDataOut struct {
+	Channel		string
+	Table		string
+	Raw		bool
+	Keys		[]string
+	Metrics		[]tsdbIntfTimescaleDBDataOutColumn
+}
+
+// postgres allows up to 65535 bind parameters per statement
+const timescaleMaxParams = 65535
+
+func tsdbIntfTimescaleDBNew(cfg TsdbIntfConf) (*tsdbIntfTimescaleDB, error) {
+	var err error
+
+	// check valid parameter
+	if cfg.DriverTimescaleDB.Dsn == "" {
+		return nil, fmt.Errorf("TimescaleDB DSN not specified")
+	}
+
+	// start building interface
+	r := &tsdbIntfTimescaleDB {
+		debug:		cfg.Debug,
+		schema:		cfg.DriverTimescaleDB.Schema,
+		hypertable:	cfg.DriverTimescaleDB.Hypertable,
+		dataOut:	make(map[string]tsdbIntfTimescaleDBDataOut),
+	}
+
+	if r.schema == "" {
+		r.schema = "public"
+	}
+
+	// build data out
+	for i := 0; i < len(cfg.Datasource); i++ {
+		if cfg.Datasource[i].Channel == "" ||
+			cfg.Datasource[i].Table == "" {
+			return nil, fmt.Errorf("Missing mandatory data out parameter")
+		}
+
+		dout := tsdbIntfTimescaleDBDataOut {
+			Channel:	cfg.Datasource[i].Channel,
+			Table:		cfg.Datasource[i].Table,
+			Raw:		strings.ToLower(cfg.Datasource[i].Datalayout) == "raw",
+			Keys:		cfg.Datasource[i].Keys,
+		}
+
+		for j := 0; j < len(cfg.Datasource[i].Metrics); j++ {
+			t := strings.ToUpper(cfg.Datasource[i].Metrics[j].Type)
+			switch t {
+			case "BIGINT":
+			case "BOOLEAN":
+			case "DOUBLE":
+			case "VARCHAR":
+			default:
+				return nil, fmt.Errorf("Unsupported data type for TimescaleDB: %s", t)
+			}
+
+			m := tsdbIntfTimescaleDBDataOutColumn {
+				Key:	cfg.Datasource[i].Metrics[j].Key,
+				Type:	t,
+			}
+
+			dout.Metrics = append(dout.Metrics, m)
+		}
+
+		r.dataOut[cfg.Datasource[i].Channel] = dout
+	}
+
+	// connect
+	log.Printf("Connecting to TimescaleDB..")
+	r.db, err = sql.Open("postgres", cfg.DriverTimescaleDB.Dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Ping()
+	if err != nil {
+		r.db.Close()
+		return nil, err
+	}
+	log.Printf("Connected to TimescaleDB..")
+
+	err = r.initSchema()
+	if err != nil {
+		r.db.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func timescaleColumnType(t string) string {
+	switch t {
+	case "BIGINT":
+		return "BIGINT"
+	case "BOOLEAN":
+		return "BOOLEAN"
+	case "DOUBLE":
+		return "DOUBLE PRECISION"
+	}
+
+	return "TEXT"
+}
+
+func (i *tsdbIntfTimescaleDB) tableName(tbl string) string {
+	return pq.QuoteIdentifier(i.schema) + "." + pq.QuoteIdentifier(tbl)
+}
+
+func (i *tsdbIntfTimescaleDB) initSchema() error {
+	var err error
+
+	// gather columns per table, several datasources may share one table
+	tables := make(map[string][]tsdbIntfTimescaleDBDataOutColumn)
+	for _, v := range i.dataOut {
+		cols := tables[v.Table]
+		if v.Raw {
+			cols = append(cols,
+				tsdbIntfTimescaleDBDataOutColumn { Key: "channel", Type: "VARCHAR" },
+				tsdbIntfTimescaleDBDataOutColumn { Key: "data", Type: "JSONB" },
+			)
+		} else {
+			for _, k := range v.Keys {
+				cols = append(cols, tsdbIntfTimescaleDBDataOutColumn { Key: k, Type: "VARCHAR" })
+			}
+			cols = append(cols, v.Metrics...)
+		}
+
+		tables[v.Table] = cols
+	}
+
+	for tbl, cols := range tables {
+		name := i.tableName(tbl)
+
+		log.Printf("Ensuring table %s exists..", name)
+		_, err = i.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (time TIMESTAMPTZ NOT NULL)", name))
+		if err != nil {
+			log.Printf("Could not create table: %v", err)
+			return err
+		}
+
+		// add columns that were introduced in config since last start
+		seen := make(map[string]bool)
+		for _, c := range cols {
+			if seen[c.Key] {
+				continue
+			}
+			seen[c.Key] = true
+
+			colType := timescaleColumnType(c.Type)
+			if c.Type == "JSONB" {
+				colType = "JSONB"
+			}
+
+			_, err = i.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+				name, pq.QuoteIdentifier(c.Key), colType))
+			if err != nil {
+				log.Printf("Could not add column %s to table %s: %v", c.Key, name, err)
+				return err
+			}
+		}
+
+		// existing plain table with rows is converted in place, otherwise create_hypertable refuses it
+		if i.hypertable {
+			_, err = i.db.Exec("SELECT create_hypertable($1, 'time', if_not_exists => TRUE, migrate_data => TRUE)", name)
+			if err != nil {
+				log.Printf("Could not create hypertable: %v", err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *tsdbIntfTimescaleDB) AddRecords(tbl string, records []tsdbRecord) error {
+	var failed int
+
+	// column set is fixed per channel, so group rows by channel
+	var order []string
+	columns := make(map[string][]string)
+	rows := make(map[string][][]interface{})
+	recs := make(map[string][]tsdbRecord)
+	for _, rec := range records {
+		outParams, ok := i.dataOut[rec.Channel]
+		if !ok {
+			log.Printf("Data out parameters for channel %s was not found", rec.Channel)
+			failed++
+			continue
+		}
+
+		cols, row, err := i.buildRow(outParams, rec.Time, rec.Data)
+		if err != nil {
+			log.Printf("Failed to build row for channel %s: %v", rec.Channel, err)
+			failed++
+			continue
+		}
+
+		if _, ok := columns[rec.Channel]; !ok {
+			order = append(order, rec.Channel)
+			columns[rec.Channel] = cols
+		}
+		rows[rec.Channel] = append(rows[rec.Channel], row)
+		recs[rec.Channel] = append(recs[rec.Channel], rec)
+	}
+
+	// each channel is written in its own transaction, only failed ones are retried
+	var errs []error
+	var retry []tsdbRecord
+	for _, ch := range order {
+		err := i.writeRows(tbl, columns[ch], rows[ch])
+		if tsdbRetriable(err) {
+			retry = append(retry, recs[ch]...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d records could not be built for table %s", failed, len(records), tbl))
+	}
+
+	return tsdbRetryJoin(errs, retry)
+}
+
+func (i *tsdbIntfTimescaleDB) buildRow(outParams tsdbIntfTimescaleDBDataOut, ts time.Time, data mistdatafmt.MistDataFmtIntf) ([]string, []interface{}, error) {
+	columns := []string{"time"}
+	row := []interface{}{ts.UTC()}
+
+	for _, v := range outParams.Keys {
+		dval, err := data.GetJsonKeyValueAsStr(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("JSON key %s does not exist", v)
+		}
+
+		columns = append(columns, v)
+		if dval == "" {
+			row = append(row, nil)
+		} else {
+			row = append(row, dval)
+		}
+	}
+
+	for _, v := range outParams.Metrics {
+		rval, err := data.GetJsonKeyValueAsStr(v.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("JSON key %s does not exist", v.Key)
+		} else if rval == "" && tsdbValueUnset(data, v.Key) {
+			columns = append(columns, v.Key)
+			row = append(row, nil)
+			continue
+		} else if rval == "" {
+			return nil, nil, fmt.Errorf("Measurement data is empty for JSON key %s", v.Key)
+		}
+
+		val, err := timescaleColumnValue(v.Type, rval)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid value for JSON key %s: %v", v.Key, err)
+		}
+
+		columns = append(columns, v.Key)
+		row = append(row, val)
+	}
+
+	return columns, row, nil
+}
+
+func (i *tsdbIntfTimescaleDB) AddRecordRaw(channel string, ts time.Time, data string) error {
+	outParams, ok := i.dataOut[channel]
+	if !ok {
+		return fmt.Errorf("Data out parameters for channel %s was not found", channel)
+	}
+
+	// data column is jsonb, store payloads that are not valid json as a json string
+	if !json.Valid([]byte(data)) {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+
+	columns := []string{"time", "channel", "data"}
+	row := []interface{}{ts.UTC(), channel, data}
+
+	return i.writeRows(outParams.Table, columns, [][]interface{}{row})
+}
+
+func (i *tsdbIntfTimescaleDB) writeRows(tbl string, columns []string, rows [][]interface{}) error {
+	if len(rows) < 1 {
+		return nil
+	}
+
+	var quoted []string
+	for _, c := range columns {
+		quoted = append(quoted, pq.QuoteIdentifier(c))
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", i.tableName(tbl), strings.Join(quoted, ", "))
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return &tsdbRetryError{err: err}
+	}
+
+	// build multi-row insert, split to stay within bind parameter limit
+	perStmt := timescaleMaxParams / len(columns)
+	for start := 0; start < len(rows); start += perStmt {
+		end := start + perStmt
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var sb strings.Builder
+		var args []interface{}
+		sb.WriteString(prefix)
+		for n, row := range rows[start:end] {
+			if n > 0 {
+				sb.WriteString(", ")
+			}
+
+			sb.WriteString("(")
+			for m := range row {
+				if m > 0 {
+					sb.WriteString(", ")
+				}
+				args = append(args, row[m])
+				sb.WriteString("$" + strconv.Itoa(len(args)))
+			}
+			sb.WriteString(")")
+		}
+
+		if i.debug {
+			log.Printf("Query: %s Args: %v", sb.String(), args)
+		}
+
+		_, err = tx.Exec(sb.String(), args...)
+		if err != nil {
+			log.Printf("Failed to write record: %v", err)
+			tx.Rollback()
+			return timescaleError(err)
+		}
+	}
+
+	return timescaleError(tx.Commit())
+}
+
+// connection and server availability problems are retriable, anything else is about the data
+// ref. https://www.postgresql.org/docs/current/errcodes-appendix.html
+func timescaleError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return &tsdbRetryError{err: err}
+	}
+
+	switch pqErr.Code.Class() {
+	case "08", "53", "57", "58":
+		return &tsdbRetryError{err: err}
+	}
+
+	return err
+}
+
+func (i *tsdbIntfTimescaleDB) Close() error {
+	return i.db.Close()
+}
+
+func timescaleColumnValue(t string, v string) (interface{}, error) {
+	switch t {
+	case "BIGINT":
+		return strconv.ParseInt(v, 10, 64)
+	case "DOUBLE":
+		return strconv.ParseFloat(v, 64)
+	case "BOOLEAN":
+		return strconv.ParseBool(v)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,256 @@
+package tsdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// database/sql connection recording executed statements instead of talking to postgres
+type timescaleTestConn struct {
+	mu		sync.Mutex
+	queries		[]string
+	args		[][]driver.Value
+}
+
+func (c *timescaleTestConn) Connect(_ context.Context) (driver.Conn, error) {
+	return c, nil
+}
+
+func (c *timescaleTestConn) Driver() driver.Driver {
+	return nil
+}
+
+func (c *timescaleTestConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (c *timescaleTestConn) Close() error {
+	return nil
+}
+
+func (c *timescaleTestConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *timescaleTestConn) Commit() error {
+	return nil
+}
+
+func (c *timescaleTestConn) Rollback() error {
+	return nil
+}
+
+func (c *timescaleTestConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var v []driver.Value
+	for _, a := range args {
+		v = append(v, a.Value)
+	}
+	c.queries = append(c.queries, query)
+	c.args = append(c.args, v)
+
+	return driver.RowsAffected(1), nil
+}
+
+func timescaleTestNew(hypertable bool) (*tsdbIntfTimescaleDB, *timescaleTestConn) {
+	conn := &timescaleTestConn{}
+	r := &tsdbIntfTimescaleDB {
+		schema:		"public",
+		hypertable:	hypertable,
+		dataOut:	map[string]tsdbIntfTimescaleDBDataOut {
+					"/sites/s1/stats/clients": {
+						Channel:	"/sites/s1/stats/clients",
+						Table:		"clients",
+						Keys:		[]string{"mac", "ssid"},
+						Metrics:	[]tsdbIntfTimescaleDBDataOutColumn {
+									{ Key: "rssi", Type: "BIGINT" },
+									{ Key: "dual_band", Type: "BOOLEAN" },
+									{ Key: "tx_bytes_rate", Type: "DOUBLE" },
+									{ Key: "hostname", Type: "VARCHAR" },
+								},
+					},
+					"/sites/s1/raw": {
+						Channel:	"/sites/s1/raw",
+						Table:		"raw",
+						Raw:		true,
+					},
+				},
+		db:		sql.OpenDB(conn),
+	}
+
+	return r, conn
+}
+
+func TestTimescaleBuildRow(t *testing.T) {
+	i, _ := timescaleTestNew(false)
+	outParams := i.dataOut["/sites/s1/stats/clients"]
+	ts := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name	string
+		payload	string
+		rate	*string
+		want	[]interface{}
+		err	bool
+	}{
+		{
+			name:		"typed values",
+			payload:	`{"mac":"a","ssid":"corp","rssi":-61,"dual_band":true,"hostname":"h"}`,
+			rate:		strPtr("0.5"),
+			want:		[]interface{}{"a", "corp", int64(-61), true, 0.5, "h"},
+		},
+		{
+			name:		"empty key is null",
+			payload:	`{"mac":"a","rssi":-61,"hostname":"h"}`,
+			rate:		strPtr("0.5"),
+			want:		[]interface{}{"a", nil, int64(-61), false, 0.5, "h"},
+		},
+		{
+			name:		"unset derived metric is null",
+			payload:	`{"mac":"a","ssid":"corp","rssi":-61,"hostname":"h"}`,
+			rate:		strPtr(""),
+			want:		[]interface{}{"a", "corp", int64(-61), false, nil, "h"},
+		},
+		{
+			name:		"empty metric",
+			payload:	`{"mac":"a","ssid":"corp","rssi":-61}`,
+			rate:		strPtr("0.5"),
+			err:		true,
+		},
+		{
+			name:		"invalid metric value",
+			payload:	`{"mac":"a","ssid":"corp","rssi":-61,"hostname":"h"}`,
+			rate:		strPtr("fast"),
+			err:		true,
+		},
+	}
+
+	for _, tt := range tests {
+		data, err := tsdbLayoutDecode("stats_client", tt.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		o := tsdbOverlayNew(data)
+		if tt.rate != nil {
+			o.Set("tx_bytes_rate", *tt.rate)
+		}
+
+		cols, row, err := i.buildRow(outParams, ts, o)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		} else if tt.err {
+			continue
+		}
+
+		if strings.Join(cols, ",") != "time,mac,ssid,rssi,dual_band,tx_bytes_rate,hostname" {
+			t.Errorf("%s: columns %v", tt.name, cols)
+		}
+		if row[0] != ts.UTC() {
+			t.Errorf("%s: time %v, want %v", tt.name, row[0], ts.UTC())
+		}
+		for n, want := range tt.want {
+			if row[n + 1] != want {
+				t.Errorf("%s: column %s is %#v, want %#v", tt.name, cols[n + 1], row[n + 1], want)
+			}
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestTimescaleWriteRowsChunked(t *testing.T) {
+	i, conn := timescaleTestNew(false)
+
+	// 7 columns per row, so a statement holds at most 9362 rows
+	columns := []string{"time", "a", "b", "c", "d", "e", "f"}
+	perStmt := timescaleMaxParams / len(columns)
+
+	var rows [][]interface{}
+	for n := 0; n < perStmt * 2 + 10; n++ {
+		rows = append(rows, []interface{}{time.Unix(int64(n), 0), "a", "b", "c", "d", "e", "f"})
+	}
+
+	err := i.writeRows("clients", columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conn.queries) != 3 {
+		t.Fatalf("got %d statements, want 3", len(conn.queries))
+	}
+	for n, want := range []int{perStmt, perStmt, 10} {
+		if len(conn.args[n]) != want * len(columns) || len(conn.args[n]) > timescaleMaxParams {
+			t.Errorf("statement %d has %d parameters, want %d", n, len(conn.args[n]), want * len(columns))
+		}
+		if !strings.HasPrefix(conn.queries[n], `INSERT INTO "public"."clients" ("time", "a", "b", "c", "d", "e", "f") VALUES ($1, $2`) {
+			t.Errorf("statement %d: %.80s", n, conn.queries[n])
+		}
+	}
+}
+
+func TestTimescaleAddRecordRaw(t *testing.T) {
+	tests := []struct {
+		data	string
+		want	string
+	}{
+		{ `{"mac":"a"}`, `{"mac":"a"}` },
+		{ `[1,2]`, `[1,2]` },
+		{ `not json`, `"not json"` },
+		{ `{"mac":`, `"{\"mac\":"` },
+	}
+
+	for _, tt := range tests {
+		i, conn := timescaleTestNew(false)
+
+		err := i.AddRecordRaw("/sites/s1/raw", time.Unix(1700000000, 0), tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.data, err)
+		}
+
+		got := conn.args[0][2].(string)
+		if got != tt.want || !json.Valid([]byte(got)) {
+			t.Errorf("%s: stored %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestTimescaleInitSchema(t *testing.T) {
+	i, conn := timescaleTestNew(true)
+
+	err := i.initSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hypertable conversion also covers a pre-existing table holding rows
+	var hypertables int
+	for n, q := range conn.queries {
+		if !strings.Contains(q, "create_hypertable") {
+			continue
+		}
+		hypertables++
+
+		if !strings.Contains(q, "migrate_data => TRUE") {
+			t.Errorf("hypertable created without migrating data: %s", q)
+		}
+		if conn.args[n][0] != `"public"."clients"` && conn.args[n][0] != `"public"."raw"` {
+			t.Errorf("unexpected hypertable %v", conn.args[n][0])
+		}
+	}
+
+	if hypertables != 2 {
+		t.Errorf("got %d hypertables, want 2", hypertables)
+	}
+}
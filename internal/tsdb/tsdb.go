@@ -6,24 +6,34 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/yumyudai/misttools/internal/common"
+	"github.com/yumyudai/misttools/internal/privacy"
 	"github.com/yumyudai/misttools/pkg/mistdatafmt"
 )
 
 type tsdbIntfBackend interface {
-	AddRecordStatsClient(string, mistdatafmt.WsMsgClientStat) error
-	AddRecordRaw(string, string) error
+	AddRecords(string, []tsdbRecord) error
+	AddRecordRaw(string, time.Time, string) error
+	Close() error
 }
 
 type TsdbIntfConf struct {
 	Debug			bool		`mapstructure:"debug",default:false`
 	Driver			string		`mapstructure:"driver",default:"awstimestream"`
-	DriverAwsTimeStream	struct {
-		Region		string		`mapstructure:"aws_region",default:"us-east-1"`
-		Database	string		`mapstructure:"database"`
-		MaxRetries	int		`mapstructure:"max_retries",default:3`
-	}                                       `mapstructure:"aws_timestream"`
+	DriverAwsTimeStream	TsdbIntfConfDrvAwsTS		`mapstructure:"aws_timestream"`
+	DriverInfluxDB		TsdbIntfConfDrvInfluxDB		`mapstructure:"influxdb"`
+	DriverTimescaleDB	TsdbIntfConfDrvTimescaleDB	`mapstructure:"timescaledb"`
+	DriverFile		TsdbIntfConfDrvFile		`mapstructure:"file"`
+	DriverClickHouse	TsdbIntfConfDrvClickHouse	`mapstructure:"clickhouse"`
+	DriverOpenSearch	TsdbIntfConfDrvOpenSearch	`mapstructure:"opensearch"`
+	Backends		[]TsdbIntfConfBackend		`mapstructure:"backends"`
+	Wal			TsdbIntfConfWal			`mapstructure:"wal"`
+	Cardinality		TsdbIntfConfCardinality		`mapstructure:"cardinality"`
+	Batch			TsdbIntfConfBatch		`mapstructure:"batch"`
+	DeadLetter		TsdbIntfConfDeadLetter		`mapstructure:"dead_letter"`
+	Privacy			*privacy.Privacy
 
 	Datasource		[]TsdbIntfConfDS
 	DataInChannel		chan common.MistApiData
@@ -33,69 +43,166 @@ type TsdbIntfConfDS struct {
 	Channel		string	  `mapstructure:"channel"`
 	Datalayout	string	  `mapstructure:"data_layout"`
 	Table		string	  `mapstructure:"table"`
+	RecordType	string	  `mapstructure:"record_type"`
+	MeasureName	string	  `mapstructure:"measure_name"`
+	TimeKey		string	  `mapstructure:"time_key"`
+	TimeUnit	string	  `mapstructure:"time_unit"`
+	MemoryRetentionHours	int	`mapstructure:"memory_retention_hours"`
+	MagneticRetentionDays	int	`mapstructure:"magnetic_retention_days"`
+	MagneticStoreWrites	*bool	`mapstructure:"magnetic_store_writes"`
+	PartitionKey		string	`mapstructure:"partition_key"`
+	PartitionKeyRequired	bool	`mapstructure:"partition_key_required"`
 	Keys		[]string  `mapstructure:"keys"`
-	Metrics []struct {
-		Key	string	  `mapstructure:"key"`
-		Type	string	  `mapstructure:"type"`
-	}                         `mapstructure:"metrics"`
+	Metrics		[]TsdbIntfConfDSMetric	`mapstructure:"metrics"`
+	Derive		TsdbIntfConfDSDerive	`mapstructure:"derive"`
+	Dedup		TsdbIntfConfDSDedup	`mapstructure:"dedup"`
+	Aggregate	TsdbIntfConfDSAggregate	`mapstructure:"aggregate"`
+}
+
+type TsdbIntfConfDSMetric struct {
+	Key		string	  `mapstructure:"key"`
+	Type		string	  `mapstructure:"type"`
 }
 
 type TsdbIntf struct {
 	cfg		TsdbIntfConf
 	backend		tsdbIntfBackend
 	dataIn		chan common.MistApiData
-	layoutMap	map[string]int
+	layoutMap	map[string]string
+	tableMap	map[string]string
+	timeMap		map[string]tsdbTimeSrc
+	deriveMap	map[string]*tsdbDerive
+	dedupMap	map[string]*tsdbDedup
+	aggMap		map[string]*tsdbAggregate
+	cardinality	*tsdbCardinality
+	batches		map[string]*tsdbBatch
+	deadLetter	tsdbDeadLetterSink
 	wg		*sync.WaitGroup
 }
 
-const (
-	LAYOUT_STATS_CLIENT = iota
-	LAYOUT_RAW
-	LAYOUT_NULL
-)
-
 func New(cfg TsdbIntfConf) (*TsdbIntf, error) {
 	var err error
+
+	// datasources may be rewritten below, do not touch caller's copy
+	cfg.Datasource = append([]TsdbIntfConfDS(nil), cfg.Datasource...)
+
+	// catch typos in keys and metrics before the first message does
+	err = tsdbValidate(cfg.Datasource)
+	if err != nil {
+		return nil, err
+	}
+
 	r := &TsdbIntf {
 		cfg:		cfg,
 		dataIn:		cfg.DataInChannel,
-		layoutMap:	make(map[string]int),
+		layoutMap:	make(map[string]string),
+		tableMap:	make(map[string]string),
+		timeMap:	make(map[string]tsdbTimeSrc),
+		deriveMap:	make(map[string]*tsdbDerive),
+		dedupMap:	make(map[string]*tsdbDedup),
+		aggMap:		make(map[string]*tsdbAggregate),
+		batches:	make(map[string]*tsdbBatch),
 	}
 
 	// Populate layout mapping
 	for i := 0; i < len(cfg.Datasource); i++ {
 		l := strings.ToLower(cfg.Datasource[i].Datalayout)
-		switch l {
-		case "stats_client":
-			r.layoutMap[cfg.Datasource[i].Channel] = LAYOUT_STATS_CLIENT
-		case "raw":
-			r.layoutMap[cfg.Datasource[i].Channel] = LAYOUT_RAW
-		default:
+		if !tsdbLayoutExists(l) {
 			return nil, fmt.Errorf("Unsupported layout %s", l)
 		}
-	}
+		r.layoutMap[cfg.Datasource[i].Channel] = l
+		r.tableMap[cfg.Datasource[i].Channel] = cfg.Datasource[i].Table
 
-	// Init Backend Driver
-	switch cfg.Driver {
-	case "awstimestream":
-		r.backend, err = tsdbIntfAwsTsNew(cfg)
-		if err != nil {
-			return nil, err
+		// record time is taken from payload if time key is given
+		if cfg.Datasource[i].TimeKey != "" {
+			r.timeMap[cfg.Datasource[i].Channel], err = tsdbTimeSrcNew(cfg.Datasource[i].TimeKey, cfg.Datasource[i].TimeUnit)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-	case "dummy":
-		r.backend, err = tsdbIntfDummyNew(cfg)
+		// derived counter metrics replace or extend configured metrics before backend sees them
+		if len(cfg.Datasource[i].Derive.Counters) > 0 {
+			r.deriveMap[cfg.Datasource[i].Channel], err = tsdbDeriveNew(&cfg.Datasource[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// unchanged records are detected on derived metrics, before they are aggregated
+		if cfg.Datasource[i].Dedup.Window > 0 || cfg.Datasource[i].Dedup.UseTtl {
+			r.dedupMap[cfg.Datasource[i].Channel], err = tsdbDedupNew(&cfg.Datasource[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// aggregation runs on derived values, so it expands metrics after derivation
+		if cfg.Datasource[i].Aggregate.Window > 0 {
+			r.aggMap[cfg.Datasource[i].Channel], err = tsdbAggregateNew(&cfg.Datasource[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	r.cfg = cfg
+
+	// series tracking is only enabled with a ceiling
+	if cfg.Cardinality.MaxSeries > 0 {
+		r.cardinality, err = tsdbCardinalityNew(cfg.Cardinality, cfg.Datasource)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-	default:
-		return nil, fmt.Errorf("Unknown TSDB driver: %s", cfg.Driver)
+	// one dead-letter sink for all drivers, so a file sink is opened once
+	r.deadLetter, err = tsdbDeadLetterNew(cfg.DeadLetter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Init Backend Driver, several backends are written through fan-out
+	if len(cfg.Backends) > 0 {
+		r.backend, err = tsdbFanoutNew(cfg, r.deadLetter)
+	} else {
+		var backend tsdbIntfBackend
+		backend, err = tsdbBackendNew(cfg, r.deadLetter)
+		if err == nil {
+			r.backend, err = tsdbWalNew(cfg, cfg.Driver, backend, r.deadLetter)
+			if err != nil {
+				backend.Close()
+			}
+		}
+	}
+	if err != nil {
+		r.deadLetter.Close()
+		return nil, err
 	}
 
 	return r, nil
 }
 
+func tsdbBackendNew(cfg TsdbIntfConf, deadLetter tsdbDeadLetterSink) (tsdbIntfBackend, error) {
+	switch cfg.Driver {
+	case "awstimestream":
+		return tsdbIntfAwsTsNew(cfg, deadLetter)
+	case "influxdb":
+		return tsdbIntfInfluxDBNew(cfg)
+	case "timescaledb":
+		return tsdbIntfTimescaleDBNew(cfg)
+	case "file":
+		return tsdbIntfFileNew(cfg)
+	case "clickhouse":
+		return tsdbIntfClickHouseNew(cfg)
+	case "opensearch":
+		return tsdbIntfOpenSearchNew(cfg, deadLetter)
+	case "dummy":
+		return tsdbIntfDummyNew(cfg)
+	}
+
+	return nil, fmt.Errorf("Unknown TSDB driver: %s", cfg.Driver)
+}
+
 func (i *TsdbIntf) Run(wg *sync.WaitGroup, killSig chan struct{}) error {
 	var err error
 
@@ -104,17 +211,54 @@ func (i *TsdbIntf) Run(wg *sync.WaitGroup, killSig chan struct{}) error {
 	wg.Add(1)
 	defer i.finish()
 
+	// Batch latency timer, nil channel blocks forever if not configured
+	var flushTick <-chan time.Time
+	if i.cfg.Batch.MaxLatency > 0 {
+		ticker := time.NewTicker(time.Duration(i.cfg.Batch.MaxLatency) * time.Millisecond)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+
+	// Aggregation window timer
+	var aggTick <-chan time.Time
+	if len(i.aggMap) > 0 {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		aggTick = ticker.C
+	}
+
+	// Cardinality report timer
+	var statTick <-chan time.Time
+	if i.cardinality != nil {
+		intvl := i.cfg.Cardinality.LogInterval
+		if intvl < 1 {
+			intvl = tsdbCardinalityDefaultLog
+		}
+
+		ticker := time.NewTicker(time.Duration(intvl) * time.Second)
+		defer ticker.Stop()
+		statTick = ticker.C
+	}
+
 	// Main routine
 	for {
 		select {
 		case <-killSig:
+			i.aggregateExpire(true)
+			i.batchFlushAll()
 			return nil
+		case <-flushTick:
+			i.batchFlushAll()
+		case <-aggTick:
+			i.aggregateExpire(false)
+		case <-statTick:
+			i.cardinality.logStats()
 		case msg := <-i.dataIn:
 			if i.cfg.Debug {
 				log.Printf("TSDB Start Process: %v", msg)
 			}
 
-			err = i.processData(msg.Origin, msg.Data)
+			err = i.processData(msg.Origin, msg.RecvTime, msg.Data)
 			if err != nil {
 				log.Printf("TSDB driver has thrown error: %v", err)
 				log.Printf("Failed data: %v", msg)
@@ -125,41 +269,164 @@ func (i *TsdbIntf) Run(wg *sync.WaitGroup, killSig chan struct{}) error {
 	return nil
 }
 
-func (i *TsdbIntf) processData(channel string, data string) error {
+func (i *TsdbIntf) processData(channel string, recvTime time.Time, data string) error {
 	var err error
 
+	if recvTime.IsZero() {
+		recvTime = time.Now()
+	}
+
+	// sensitive fields are transformed before anything else sees the payload
+	data, err = i.cfg.Privacy.Apply(channel, data)
+	if err != nil {
+		return err
+	}
+
 	layout, e := i.layoutMap[channel]
 	if !e {
 		return fmt.Errorf("Data received on channel %s, but no layout defined", channel)
 	}
 		
-	switch layout {
-	case LAYOUT_STATS_CLIENT:
-		jsonData := &mistdatafmt.WsMsgClientStat{}
-		err = json.Unmarshal([]byte(data), jsonData)
+	if layout == LAYOUT_RAW {
+		ts := recvTime
+		if _, ok := i.timeMap[channel]; ok {
+			jsonData := &tsdbRawData{}
+			err = json.Unmarshal([]byte(data), jsonData)
+			if err != nil {
+				return err
+			}
+
+			ts = i.recordTime(channel, recvTime, jsonData)
+		}
+
+		return i.backend.AddRecordRaw(channel, ts, data)
+	}
+
+	jsonData, err := tsdbLayoutDecode(layout, data)
+	if err != nil {
+		return err
+	}
+
+	rec := tsdbRecord {
+		Channel:	channel,
+		Time:		i.recordTime(channel, recvTime, jsonData),
+		Data:		jsonData,
+		Raw:		data,
+		Size:		len(data),
+	}
+
+	if d, ok := i.deriveMap[channel]; ok {
+		var derived bool
+		rec.Data, derived, err = d.apply(rec.Time, rec.Data)
 		if err != nil {
 			return err
+		} else if !derived {
+			if i.cfg.Debug {
+				log.Printf("No previous sample to derive counters from on channel %s", channel)
+			}
+			return nil
 		}
+	}
 
-		err = i.backend.AddRecordStatsClient(channel, *jsonData)
+	if d, ok := i.dedupMap[channel]; ok {
+		changed, err := d.apply(rec.Time, rec.Data)
 		if err != nil {
 			return err
+		} else if !changed {
+			if i.cfg.Debug {
+				log.Printf("Skipping unchanged record on channel %s", channel)
+			}
+			return nil
 		}
+	}
 
-	case LAYOUT_RAW:
-		err = i.backend.AddRecordRaw(channel, data)
+	if a, ok := i.aggMap[channel]; ok {
+		added, err := a.add(time.Now(), rec)
 		if err != nil {
 			return err
+		} else if !added && i.cfg.Debug {
+			log.Printf("Dropping late record for closed aggregation window on channel %s", channel)
 		}
+		return nil
+	}
+
+	return i.emit(i.tableMap[channel], rec)
+}
 
-	default:
-		return fmt.Errorf("Unsupported data layout for channel %s", channel)
+// last stage before batching, applies cardinality guard
+func (i *TsdbIntf) emit(tbl string, rec tsdbRecord) error {
+	if i.cardinality != nil {
+		var ok bool
+		var err error
+		rec, ok, err = i.cardinality.check(tbl, rec)
+		if err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+	}
+
+	return i.batchAdd(tbl, rec)
+}
+
+// returns series count per table, nil if cardinality guard is not enabled
+func (i *TsdbIntf) CardinalityStats() []TsdbCardinalityStat {
+	if i.cardinality == nil {
+		return nil
+	}
+
+	return i.cardinality.stats()
+}
+
+// queues records of closed aggregation windows, or of all windows on shutdown
+func (i *TsdbIntf) aggregateExpire(all bool) {
+	now := time.Now()
+	for channel, a := range i.aggMap {
+		for _, rec := range a.expire(now, all) {
+			err := i.emit(i.tableMap[channel], rec)
+			if err != nil {
+				log.Printf("TSDB driver has thrown error on aggregation: %v", err)
+			}
+		}
 	}
-	
-	return nil
+}
+
+// returns the event time from payload, or receive time if not configured or absent
+func (i *TsdbIntf) recordTime(channel string, recvTime time.Time, data mistdatafmt.MistDataFmtIntf) time.Time {
+	src, ok := i.timeMap[channel]
+	if !ok {
+		return recvTime
+	}
+
+	v, err := data.GetJsonKeyValueAsStr(src.Key)
+	if err != nil || v == "" {
+		if i.cfg.Debug {
+			log.Printf("Time key %s is absent on channel %s, using receive time", src.Key, channel)
+		}
+		return recvTime
+	}
+
+	ts, err := src.parse(v)
+	if err != nil {
+		log.Printf("Failed to parse time key %s on channel %s: %v", src.Key, channel, err)
+		return recvTime
+	}
+
+	return ts
 }
 
 func (i *TsdbIntf) finish() {
+	err := i.backend.Close()
+	if err != nil {
+		log.Printf("TSDB driver has thrown error on close: %v", err)
+	}
+
+	// backends may still dead-letter while closing, so sink goes last
+	err = i.deadLetter.Close()
+	if err != nil {
+		log.Printf("TSDB dead-letter sink has thrown error on close: %v", err)
+	}
+
 	if i.wg != nil {
 		i.wg.Done()
 	}
@@ -0,0 +1,194 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var tsdbJsonNumberType = reflect.TypeOf(json.Number(""))
+
+// returns go type of each JSON field of the layout struct
+func tsdbLayoutFields(layout string) map[string]reflect.Type {
+	r := make(map[string]reflect.Type)
+
+	newFunc, ok := tsdbLayouts[layout]
+	if !ok {
+		return r
+	}
+
+	t := reflect.TypeOf(newFunc())
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	tsdbStructFields(t, r)
+	return r
+}
+
+func tsdbStructFields(t reflect.Type, r map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		// embedded structs contribute their fields at the same level
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			tsdbStructFields(f.Type, r)
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || !f.IsExported() {
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		r[name] = ft
+	}
+}
+
+// measure types which can be read from a field of the given go type
+func tsdbFieldTypes(t reflect.Type) []string {
+	if t == tsdbJsonNumberType {
+		return []string{"BIGINT", "DOUBLE", "VARCHAR"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return []string{"BOOLEAN", "VARCHAR"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return []string{"BIGINT", "DOUBLE", "VARCHAR"}
+	case reflect.Float32, reflect.Float64:
+		return []string{"DOUBLE", "VARCHAR"}
+	}
+
+	return []string{"VARCHAR"}
+}
+
+// LayoutTypedFields returns fields the layout decodes into something other than a plain string,
+// a string value written into them by a payload transform fails decoding
+func LayoutTypedFields(layout string) []string {
+	var r []string
+	for name, t := range tsdbLayoutFields(strings.ToLower(layout)) {
+		if t == tsdbJsonNumberType || t.Kind() != reflect.String {
+			r = append(r, name)
+		}
+	}
+
+	return r
+}
+
+func tsdbFieldNumeric(t reflect.Type) bool {
+	for _, v := range tsdbFieldTypes(t) {
+		if v == "BIGINT" || v == "DOUBLE" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checks every datasource against its layout and reports all problems at once
+func tsdbValidate(dss []TsdbIntfConfDS) error {
+	var problems []string
+	report := func(ds TsdbIntfConfDS, format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("channel %s: ", ds.Channel) + fmt.Sprintf(format, a...))
+	}
+
+	seen := make(map[string]bool)
+	for _, ds := range dss {
+		if ds.Channel == "" {
+			report(ds, "channel is not set")
+		} else if seen[ds.Channel] {
+			report(ds, "channel is defined more than once")
+		}
+		seen[ds.Channel] = true
+
+		if ds.Table == "" {
+			report(ds, "table is not set")
+		}
+
+		layout := strings.ToLower(ds.Datalayout)
+		if !tsdbLayoutExists(layout) {
+			report(ds, "unsupported layout %s", ds.Datalayout)
+			continue
+		} else if layout == LAYOUT_RAW {
+			// payload is free form, nothing to check fields against
+			continue
+		}
+
+		// decoder getters decide which keys are readable, struct types decide what they can be stored as
+		data := tsdbLayouts[layout]()
+		fields := tsdbLayoutFields(layout)
+		exists := func(k string) bool {
+			_, err := data.GetJsonKeyValueAsStr(k)
+			return err == nil
+		}
+
+		isKey := make(map[string]bool)
+		for _, k := range ds.Keys {
+			if !exists(k) {
+				report(ds, "key %s is not a field of layout %s", k, layout)
+			}
+			isKey[k] = true
+		}
+
+		for _, m := range ds.Metrics {
+			// drivers store keys and metrics side by side, the same field cannot be both
+			if isKey[m.Key] {
+				report(ds, "metric %s is also a key", m.Key)
+				continue
+			} else if !exists(m.Key) {
+				report(ds, "metric %s is not a field of layout %s", m.Key, layout)
+				continue
+			}
+
+			ft, ok := fields[m.Key]
+			if !ok {
+				continue
+			}
+
+			t := strings.ToUpper(m.Type)
+			compatible := false
+			for _, v := range tsdbFieldTypes(ft) {
+				if v == t {
+					compatible = true
+				}
+			}
+
+			if !compatible {
+				report(ds, "metric %s of go type %s cannot be stored as %s (use one of %s)",
+					m.Key, ft, m.Type, strings.Join(tsdbFieldTypes(ft), ", "))
+			}
+		}
+
+		if ds.TimeKey != "" && !exists(ds.TimeKey) {
+			report(ds, "time key %s is not a field of layout %s", ds.TimeKey, layout)
+		}
+
+		for _, c := range ds.Derive.Counters {
+			if !exists(c) {
+				report(ds, "counter %s is not a field of layout %s", c, layout)
+			} else if ft, ok := fields[c]; ok && !tsdbFieldNumeric(ft) {
+				report(ds, "counter %s of go type %s is not numeric", c, ft)
+			}
+		}
+
+		if ds.Derive.ResetKey != "" && !exists(ds.Derive.ResetKey) {
+			report(ds, "reset key %s is not a field of layout %s", ds.Derive.ResetKey, layout)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid TSDB datasource configuration, %d problem(s) found:\n  %s",
+			len(problems), strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package tsdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayoutTypedFields(t *testing.T) {
+	typed := make(map[string]bool)
+	for _, v := range LayoutTypedFields("STATS_CLIENT") {
+		typed[v] = true
+	}
+
+	for k, want := range map[string]bool{"rssi": true, "dual_band": true, "mac": false, "hostname": false} {
+		if typed[k] != want {
+			t.Errorf("%s: typed is %v, want %v", k, typed[k], want)
+		}
+	}
+
+	if len(LayoutTypedFields(LAYOUT_RAW)) > 0 {
+		t.Errorf("raw layout has typed fields")
+	}
+}
+
+func validateTestDS(f func(ds *TsdbIntfConfDS)) TsdbIntfConfDS {
+	ds := TsdbIntfConfDS {
+		Channel:	"/sites/s1/stats/clients",
+		Datalayout:	"stats_client",
+		Table:		"clients",
+		Keys:		[]string{"mac"},
+		Metrics:	[]TsdbIntfConfDSMetric {
+					{ Key: "rssi", Type: "BIGINT" },
+					{ Key: "hostname", Type: "VARCHAR" },
+				},
+	}
+	f(&ds)
+
+	return ds
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name	string
+		ds	TsdbIntfConfDS
+		want	[]string
+	}{
+		{
+			name:	"valid",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {}),
+		},
+		{
+			name:	"unknown key",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) { ds.Keys = []string{"mac_addr"} }),
+			want:	[]string{"key mac_addr is not a field"},
+		},
+		{
+			name:	"unknown metric",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Metrics = append(ds.Metrics, TsdbIntfConfDSMetric { Key: "rsi", Type: "BIGINT" })
+				}),
+			want:	[]string{"metric rsi is not a field"},
+		},
+		{
+			name:	"numeric type on string field",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) { ds.Metrics[1].Type = "BIGINT" }),
+			want:	[]string{"metric hostname of go type string cannot be stored as BIGINT"},
+		},
+		{
+			name:	"number stored as string",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) { ds.Metrics[0].Type = "varchar" }),
+		},
+		{
+			name:	"bool stored as number",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Metrics = append(ds.Metrics, TsdbIntfConfDSMetric { Key: "dual_band", Type: "DOUBLE" })
+				}),
+			want:	[]string{"metric dual_band of go type bool cannot be stored as DOUBLE"},
+		},
+		{
+			name:	"metric is also a key",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Metrics = append(ds.Metrics, TsdbIntfConfDSMetric { Key: "mac", Type: "VARCHAR" })
+				}),
+			want:	[]string{"metric mac is also a key"},
+		},
+		{
+			name:	"derived counter",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Metrics = append(ds.Metrics, TsdbIntfConfDSMetric { Key: "rx_bytes", Type: "BIGINT" })
+					ds.Derive.Counters = []string{"rx_bytes"}
+				}),
+		},
+		{
+			name:	"derived counter not in layout",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) { ds.Derive.Counters = []string{"rx_byte"} }),
+			want:	[]string{"counter rx_byte is not a field"},
+		},
+		{
+			name:	"derived counter not numeric",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) { ds.Derive.Counters = []string{"hostname"} }),
+			want:	[]string{"counter hostname of go type string is not numeric"},
+		},
+		{
+			// names derivation generates are not fields of the payload
+			name:	"derived metric configured",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Metrics = append(ds.Metrics, TsdbIntfConfDSMetric { Key: "rx_bytes_rate", Type: "DOUBLE" })
+					ds.Derive.Counters = []string{"rx_bytes"}
+				}),
+			want:	[]string{"metric rx_bytes_rate is not a field"},
+		},
+		{
+			name:	"aggregated metrics",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Aggregate.Window = 60
+					ds.Aggregate.Functions = []string{"avg", "last"}
+				}),
+		},
+		{
+			name:	"aggregated metric configured",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Metrics = append(ds.Metrics, TsdbIntfConfDSMetric { Key: "rssi_avg", Type: "DOUBLE" })
+					ds.Aggregate.Window = 60
+				}),
+			want:	[]string{"metric rssi_avg is not a field"},
+		},
+		{
+			name:	"reset key not in layout",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Derive.Counters = []string{"rx_bytes"}
+					ds.Derive.ResetKey = "uptime_sec"
+				}),
+			want:	[]string{"reset key uptime_sec is not a field"},
+		},
+		{
+			name:	"raw layout is not checked",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) { ds.Datalayout = "RAW"; ds.Keys = []string{"anything"} }),
+		},
+		{
+			name:	"every problem is reported",
+			ds:	validateTestDS(func(ds *TsdbIntfConfDS) {
+					ds.Table = ""
+					ds.Keys = []string{"mac_addr"}
+					ds.Metrics[1].Type = "DOUBLE"
+				}),
+			want:	[]string{"3 problem(s)", "table is not set", "key mac_addr", "metric hostname"},
+		},
+	}
+
+	for _, tt := range tests {
+		err := tsdbValidate([]TsdbIntfConfDS{tt.ds})
+		if len(tt.want) < 1 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		} else if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+
+		for _, v := range tt.want {
+			if !strings.Contains(err.Error(), v) {
+				t.Errorf("%s: error does not mention %q:\n%v", tt.name, v, err)
+			}
+		}
+	}
+
+	// the same channel cannot be configured twice
+	ds := validateTestDS(func(ds *TsdbIntfConfDS) {})
+	err := tsdbValidate([]TsdbIntfConfDS{ds, ds})
+	if err == nil || !strings.Contains(err.Error(), "defined more than once") {
+		t.Errorf("duplicate channel: got error %v", err)
+	}
+}
@@ -0,0 +1,683 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TsdbIntfConfWal struct {
+	Path		string
+	MaxBytes	int64
+	MaxBackoff	int
+}
+
+const (
+	tsdbWalMinBackoff	= time.Second
+	tsdbWalDefaultBackoff	= 60
+	tsdbWalExt		= ".wal"
+)
+
+// backend failure worth replaying later, as opposed to data the backend will never accept
+// records narrows down what to retry when part of the batch was written, nil means all
+type tsdbRetryError struct {
+	err		error
+	records		[]tsdbRecord
+}
+
+func (e *tsdbRetryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *tsdbRetryError) Unwrap() error {
+	return e.err
+}
+
+func tsdbRetriable(err error) bool {
+	var r *tsdbRetryError
+	return errors.As(err, &r)
+}
+
+// returns records of the batch which should be retried
+func tsdbRetryRecords(err error, records []tsdbRecord) []tsdbRecord {
+	var r *tsdbRetryError
+	if !errors.As(err, &r) {
+		return nil
+	} else if r.records == nil {
+		return records
+	}
+
+	return r.records
+}
+
+// combines errors of a batch written in several requests, retry holds records of retriable failures
+func tsdbRetryJoin(errs []error, retry []tsdbRecord) error {
+	err := errors.Join(errs...)
+	if len(retry) > 0 {
+		return &tsdbRetryError{err: err, records: retry}
+	}
+
+	return err
+}
+
+// backend wrapped by write-ahead buffer, or by dead-letter if there is none
+// deferred writes are taken without trying the backend, e.g. when its fan-out queue is full
+type tsdbWalBackend interface {
+	tsdbIntfBackend
+	deferRecords(string, []tsdbRecord, string) error
+	deferRaw(string, time.Time, string, string) error
+}
+
+// spools writes to disk while backend is unavailable and replays them in order
+// delivery is at least once, only records the backend reported as failed are spooled
+type tsdbWal struct {
+	name		string
+	backend		tsdbIntfBackend
+	dir		string
+	maxBytes	int64
+	maxBackoff	time.Duration
+	format		tsdbWalFormat
+
+	// backend sees one write at a time, segments can be added while it is busy
+	wmu		sync.Mutex
+	mu		sync.Mutex
+	pending		[]tsdbWalSegment
+	size		int64
+	seq		uint64
+
+	wake		chan struct{}
+	done		chan struct{}
+	wg		sync.WaitGroup
+}
+
+type tsdbWalSegment struct {
+	seq		uint64
+	size		int64
+}
+
+type tsdbWalEntry struct {
+	Table		string			`json:"table"`
+	Records		[]tsdbWalRecord		`json:"records,omitempty"`
+	Raw		*tsdbWalRecord		`json:"raw,omitempty"`
+}
+
+// payload is the message as received, decoded again through the channel layout on replay
+// values are set by processing stages on top of it, or all backend values if there is no payload
+type tsdbWalRecord struct {
+	Channel		string			`json:"channel"`
+	Time		time.Time		`json:"time"`
+	Payload		string			`json:"payload,omitempty"`
+	Values		map[string]string	`json:"values,omitempty"`
+	Data		string			`json:"data,omitempty"`
+}
+
+// wraps backend with write-ahead buffer if configured
+func tsdbWalNew(cfg TsdbIntfConf, name string, backend tsdbIntfBackend, deadLetter tsdbDeadLetterSink) (tsdbWalBackend, error) {
+	if cfg.Wal.Path == "" {
+		return tsdbWalNoneNew(cfg, name, backend, deadLetter), nil
+	}
+
+	r := &tsdbWal {
+		name:		name,
+		backend:	backend,
+		dir:		filepath.Join(cfg.Wal.Path, fileTableName(name)),
+		maxBytes:	cfg.Wal.MaxBytes,
+		maxBackoff:	time.Duration(cfg.Wal.MaxBackoff) * time.Second,
+		format:		tsdbWalFormatNew(cfg),
+		wake:		make(chan struct{}, 1),
+		done:		make(chan struct{}),
+	}
+
+	if r.maxBackoff < tsdbWalMinBackoff {
+		r.maxBackoff = tsdbWalDefaultBackoff * time.Second
+	}
+
+	err := os.MkdirAll(r.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// pick up writes left by previous run
+	ents, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range ents {
+		if !strings.HasSuffix(e.Name(), tsdbWalExt) {
+			os.Remove(filepath.Join(r.dir, e.Name()))
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), tsdbWalExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		st, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		r.pending = append(r.pending, tsdbWalSegment { seq: seq, size: st.Size() })
+		r.size += st.Size()
+	}
+
+	sort.Slice(r.pending, func(a, b int) bool { return r.pending[a].seq < r.pending[b].seq })
+	if len(r.pending) > 0 {
+		r.seq = r.pending[len(r.pending) - 1].seq + 1
+		log.Printf("Write-ahead buffer for %s has %d pending writes (%d bytes)", name, len(r.pending), r.size)
+	}
+
+	r.wg.Add(1)
+	go r.replayLoop()
+
+	return r, nil
+}
+
+func (w *tsdbWal) AddRecords(tbl string, records []tsdbRecord) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	// queued writes go first to keep order
+	if w.empty() {
+		err := w.backend.AddRecords(tbl, records)
+		if !tsdbRetriable(err) {
+			return err
+		}
+
+		records = tsdbRetryRecords(err, records)
+		log.Printf("Backend %s is unavailable, buffering %d records for table %s: %v", w.name, len(records), tbl, err)
+	}
+
+	return w.spoolRecords(tbl, records)
+}
+
+func (w *tsdbWal) deferRecords(tbl string, records []tsdbRecord, reason string) error {
+	log.Printf("Buffering %d records for table %s of backend %s: %s", len(records), tbl, w.name, reason)
+	return w.spoolRecords(tbl, records)
+}
+
+func (w *tsdbWal) spoolRecords(tbl string, records []tsdbRecord) error {
+	e := tsdbWalEntry {
+		Table:		tbl,
+	}
+
+	for _, rec := range records {
+		e.Records = append(e.Records, w.format.record(rec))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.spool(e)
+}
+
+func (w *tsdbWal) empty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.pending) < 1
+}
+
+// converts records to and from their form on disk
+type tsdbWalFormat struct {
+	fields		map[string][]string
+	layouts		map[string]string
+}
+
+func tsdbWalFormatNew(cfg TsdbIntfConf) tsdbWalFormat {
+	r := tsdbWalFormat {
+		fields:		make(map[string][]string),
+		layouts:	make(map[string]string),
+	}
+
+	// only values the backend reads are kept
+	for i := 0; i < len(cfg.Datasource); i++ {
+		f := append([]string(nil), cfg.Datasource[i].Keys...)
+		for _, m := range cfg.Datasource[i].Metrics {
+			f = append(f, m.Key)
+		}
+		r.fields[cfg.Datasource[i].Channel] = f
+		r.layouts[cfg.Datasource[i].Channel] = strings.ToLower(cfg.Datasource[i].Datalayout)
+	}
+
+	return r
+}
+
+func (w tsdbWalFormat) record(rec tsdbRecord) tsdbWalRecord {
+	r := tsdbWalRecord {
+		Channel:	rec.Channel,
+		Time:		rec.Time,
+		Values:		make(map[string]string),
+	}
+
+	_, known := w.layouts[rec.Channel]
+	if rec.Raw != "" && known {
+		r.Payload = rec.Raw
+		if o, ok := rec.Data.(*tsdbOverlayData); ok {
+			for k, v := range o.values {
+				r.Values[k] = v
+			}
+		}
+
+		return r
+	}
+
+	// without payload only values the backend reads are kept
+	for _, k := range w.fields[rec.Channel] {
+		v, err := rec.Data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			continue
+		}
+		r.Values[k] = v
+	}
+
+	return r
+}
+
+func (w *tsdbWal) AddRecordRaw(channel string, ts time.Time, data string) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	if w.empty() {
+		err := w.backend.AddRecordRaw(channel, ts, data)
+		if !tsdbRetriable(err) {
+			return err
+		}
+		log.Printf("Backend %s is unavailable, buffering raw record for channel %s: %v", w.name, channel, err)
+	}
+
+	return w.spoolRaw(channel, ts, data)
+}
+
+func (w *tsdbWal) deferRaw(channel string, ts time.Time, data string, reason string) error {
+	log.Printf("Buffering raw record for channel %s of backend %s: %s", channel, w.name, reason)
+	return w.spoolRaw(channel, ts, data)
+}
+
+func (w *tsdbWal) spoolRaw(channel string, ts time.Time, data string) error {
+	e := tsdbWalEntry {
+		Table:		channel,
+		Raw:		&tsdbWalRecord {
+					Channel:	channel,
+					Time:		ts,
+					Data:		data,
+				},
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.spool(e)
+}
+
+// writes entry as next segment, evicting oldest segments over size cap, caller holds lock
+func (w *tsdbWal) spool(e tsdbWalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	for w.maxBytes > 0 && len(w.pending) > 0 && w.size + int64(len(b)) > w.maxBytes {
+		old := w.pending[0]
+		log.Printf("Write-ahead buffer for %s is full, evicting oldest write %d", w.name, old.seq)
+		w.removeLocked(old.seq)
+	}
+
+	seq := w.seq
+	err = w.writeFile(w.path(seq), b)
+	if err != nil {
+		return fmt.Errorf("Failed to buffer write for table %s: %v", e.Table, err)
+	}
+
+	w.seq++
+	w.pending = append(w.pending, tsdbWalSegment { seq: seq, size: int64(len(b)) })
+	w.size += int64(len(b))
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// writes to temporary name first so a crash never leaves half a segment
+func (w *tsdbWal) writeFile(path string, b []byte) error {
+	f, err := os.OpenFile(path + ".tmp", os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path + ".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+
+	return err
+}
+
+func (w *tsdbWal) path(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, tsdbWalExt))
+}
+
+func (w *tsdbWal) removeLocked(seq uint64) {
+	for j := 0; j < len(w.pending); j++ {
+		if w.pending[j].seq != seq {
+			continue
+		}
+
+		err := os.Remove(w.path(seq))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove buffered write %d: %v", seq, err)
+		}
+
+		w.size -= w.pending[j].size
+		w.pending = append(w.pending[:j], w.pending[j + 1:]...)
+		return
+	}
+}
+
+func (w *tsdbWal) replayLoop() {
+	defer w.wg.Done()
+
+	backoff := tsdbWalMinBackoff
+	for {
+		w.mu.Lock()
+		var seg tsdbWalSegment
+		empty := len(w.pending) < 1
+		if !empty {
+			seg = w.pending[0]
+		}
+		w.mu.Unlock()
+
+		if empty {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.done:
+				return
+			}
+		}
+
+		w.wmu.Lock()
+		err := w.replay(seg)
+		w.wmu.Unlock()
+
+		if tsdbRetriable(err) {
+			log.Printf("Backend %s is still unavailable, retrying buffered writes in %v: %v", w.name, backoff, err)
+
+			select {
+			case <-time.After(backoff):
+			case <-w.done:
+				return
+			}
+
+			backoff *= 2
+			if backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+			continue
+		} else if err != nil {
+			log.Printf("Dropping buffered write %d for backend %s: %v", seg.seq, w.name, err)
+		}
+
+		backoff = tsdbWalMinBackoff
+
+		w.mu.Lock()
+		w.removeLocked(seg.seq)
+		if len(w.pending) < 1 {
+			log.Printf("Write-ahead buffer for %s has been drained", w.name)
+		}
+		w.mu.Unlock()
+	}
+}
+
+func (w *tsdbWal) replay(seg tsdbWalSegment) error {
+	b, err := os.ReadFile(w.path(seg.seq))
+	if err != nil {
+		return err
+	}
+
+	var e tsdbWalEntry
+	err = json.Unmarshal(b, &e)
+	if err != nil {
+		return err
+	}
+
+	if e.Raw != nil {
+		return w.backend.AddRecordRaw(e.Raw.Channel, e.Raw.Time, e.Raw.Data)
+	}
+
+	var records []tsdbRecord
+	for _, v := range e.Records {
+		rec, err := w.format.decode(v)
+		if err != nil {
+			log.Printf("Dropping buffered record for channel %s: %v", v.Channel, err)
+			continue
+		}
+
+		records = append(records, rec)
+	}
+
+	// replay keeps going with what is still failing, written records are not sent again
+	err = w.backend.AddRecords(e.Table, records)
+	if tsdbRetriable(err) {
+		retry := tsdbRetryRecords(err, records)
+		if len(retry) < len(records) {
+			w.rewrite(seg, e.Table, retry)
+		}
+	}
+
+	return err
+}
+
+func (w tsdbWalFormat) decode(v tsdbWalRecord) (tsdbRecord, error) {
+	rec := tsdbRecord {
+		Channel:	v.Channel,
+		Time:		v.Time,
+		Raw:		v.Payload,
+		Size:		len(v.Payload),
+	}
+
+	// written by older version, or for a channel without layout
+	if v.Payload == "" {
+		rec.Data = tsdbWalData(v.Values)
+		return rec, nil
+	}
+
+	layout, ok := w.layouts[v.Channel]
+	if !ok {
+		return rec, fmt.Errorf("Channel %s is no longer configured", v.Channel)
+	}
+
+	data, err := tsdbLayoutDecode(layout, v.Payload)
+	if err != nil {
+		return rec, err
+	}
+
+	if len(v.Values) < 1 {
+		rec.Data = data
+		return rec, nil
+	}
+
+	o := tsdbOverlayNew(data)
+	for k, val := range v.Values {
+		o.Set(k, val)
+	}
+	rec.Data = o
+
+	return rec, nil
+}
+
+// replaces pending segment with the records still to be written
+func (w *tsdbWal) rewrite(seg tsdbWalSegment, tbl string, records []tsdbRecord) {
+	e := tsdbWalEntry {
+		Table:		tbl,
+	}
+
+	for _, rec := range records {
+		e.Records = append(e.Records, w.format.record(rec))
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to update buffered write %d, it will be replayed as a whole: %v", seg.seq, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// segment may have been evicted meanwhile
+	for j := 0; j < len(w.pending); j++ {
+		if w.pending[j].seq != seg.seq {
+			continue
+		}
+
+		err = w.writeFile(w.path(seg.seq), b)
+		if err != nil {
+			log.Printf("Failed to update buffered write %d, it will be replayed as a whole: %v", seg.seq, err)
+			return
+		}
+
+		w.size += int64(len(b)) - w.pending[j].size
+		w.pending[j].size = int64(len(b))
+		return
+	}
+}
+
+// stops replay, pending writes stay on disk for next run
+func (w *tsdbWal) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	return w.backend.Close()
+}
+
+// used without write-ahead buffer, records of retriable failures are dead-lettered instead
+type tsdbWalNone struct {
+	name		string
+	backend		tsdbIntfBackend
+	format		tsdbWalFormat
+	deadLetter	tsdbDeadLetterSink
+}
+
+func tsdbWalNoneNew(cfg TsdbIntfConf, name string, backend tsdbIntfBackend, deadLetter tsdbDeadLetterSink) *tsdbWalNone {
+	return &tsdbWalNone {
+		name:		name,
+		backend:	backend,
+		format:		tsdbWalFormatNew(cfg),
+		deadLetter:	deadLetter,
+	}
+}
+
+func (w *tsdbWalNone) AddRecords(tbl string, records []tsdbRecord) error {
+	err := w.backend.AddRecords(tbl, records)
+	for _, rec := range tsdbRetryRecords(err, records) {
+		w.drop(tbl, "write_failed", err.Error(), w.format.record(rec))
+	}
+
+	return err
+}
+
+func (w *tsdbWalNone) AddRecordRaw(channel string, ts time.Time, data string) error {
+	err := w.backend.AddRecordRaw(channel, ts, data)
+	if tsdbRetriable(err) {
+		w.drop(channel, "write_failed", err.Error(), tsdbWalRecord { Channel: channel, Time: ts, Data: data })
+	}
+
+	return err
+}
+
+// nothing to buffer in, deferred writes are dead-lettered right away
+func (w *tsdbWalNone) deferRecords(tbl string, records []tsdbRecord, reason string) error {
+	for _, rec := range records {
+		w.drop(tbl, "deferred", reason, w.format.record(rec))
+	}
+
+	return fmt.Errorf("Backend %s dead-lettered %d records for table %s: %s", w.name, len(records), tbl, reason)
+}
+
+func (w *tsdbWalNone) deferRaw(channel string, ts time.Time, data string, reason string) error {
+	w.drop(channel, "deferred", reason, tsdbWalRecord { Channel: channel, Time: ts, Data: data })
+
+	return fmt.Errorf("Backend %s dead-lettered raw record for channel %s: %s", w.name, channel, reason)
+}
+
+func (w *tsdbWalNone) drop(tbl string, reason string, detail string, rec tsdbWalRecord) {
+	e := tsdbDeadLetter {
+		Time:		time.Now(),
+		Driver:		w.name,
+		Table:		tbl,
+		Reason:		reason,
+		Detail:		detail,
+		Record:		rec,
+	}
+
+	derr := w.deadLetter.Write(e)
+	if derr != nil {
+		log.Printf("Failed to write dead-letter record: %v", derr)
+	}
+}
+
+func (w *tsdbWalNone) Close() error {
+	return w.backend.Close()
+}
+
+// flattened record values read back from disk
+type tsdbWalData map[string]string
+
+func (m tsdbWalData) GetJsonKeyValue(key string) (interface{}, error) {
+	v, ok := m[key]
+	if !ok {
+		return "", fmt.Errorf("Specified key not found")
+	}
+
+	return v, nil
+}
+
+func (m tsdbWalData) GetJsonKeyValueAsStr(key string) (string, error) {
+	v, ok := m[key]
+	if !ok {
+		return "", fmt.Errorf("Specified key not found")
+	}
+
+	return v, nil
+}
+
+func (m tsdbWalData) GetJsonKeyValueAsFloat64(key string) (float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return 0, fmt.Errorf("Specified key not found")
+	}
+
+	return strconv.ParseFloat(v, 64)
+}
+
+func (m tsdbWalData) GetJsonKeyValueAsInt64(key string) (int64, error) {
+	v, ok := m[key]
+	if !ok {
+		return 0, fmt.Errorf("Specified key not found")
+	}
+
+	return strconv.ParseInt(v, 10, 64)
+}
@@ -0,0 +1,396 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	walTestChannelA	= "/sites/s1/stats/clients"
+	walTestChannelB	= "/sites/s2/stats/clients"
+)
+
+// backend which is down as a whole, or fails records of some channels
+type walTestBackend struct {
+	mu		sync.Mutex
+	down		bool
+	failing		map[string]bool
+	written		[]tsdbRecord
+	raw		[]string
+}
+
+func (b *walTestBackend) AddRecords(tbl string, records []tsdbRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down {
+		return &tsdbRetryError{err: errors.New("backend is down")}
+	}
+
+	var retry []tsdbRecord
+	for _, rec := range records {
+		if b.failing[rec.Channel] {
+			retry = append(retry, rec)
+			continue
+		}
+		b.written = append(b.written, rec)
+	}
+
+	if len(retry) > 0 {
+		return tsdbRetryJoin([]error{errors.New("channel is down")}, retry)
+	}
+
+	return nil
+}
+
+func (b *walTestBackend) AddRecordRaw(channel string, ts time.Time, data string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.down {
+		return &tsdbRetryError{err: errors.New("backend is down")}
+	}
+	b.raw = append(b.raw, data)
+
+	return nil
+}
+
+func (b *walTestBackend) Close() error {
+	return nil
+}
+
+func (b *walTestBackend) set(down bool, failing ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.down = down
+	b.failing = make(map[string]bool)
+	for _, v := range failing {
+		b.failing[v] = true
+	}
+}
+
+func (b *walTestBackend) count() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.written), len(b.raw)
+}
+
+func walTestConf(dir string) TsdbIntfConf {
+	cfg := TsdbIntfConf {
+		Datasource:	[]TsdbIntfConfDS {
+					{
+						Channel:	walTestChannelA,
+						Datalayout:	"stats_client",
+						Table:		"clients",
+						Keys:		[]string{"mac"},
+						Metrics:	[]TsdbIntfConfDSMetric {
+									{ Key: "rssi", Type: "BIGINT" },
+								},
+					},
+					{
+						Channel:	walTestChannelB,
+						Datalayout:	"stats_client",
+						Table:		"clients",
+						Keys:		[]string{"mac"},
+						Metrics:	[]TsdbIntfConfDSMetric {
+									{ Key: "rssi", Type: "BIGINT" },
+								},
+					},
+				},
+	}
+	cfg.Wal.Path = dir
+
+	return cfg
+}
+
+func walTestRecord(t *testing.T, channel string, mac string) tsdbRecord {
+	payload := `{"mac":"` + mac + `","hostname":"host-` + mac + `","rssi":-61}`
+	data, err := tsdbLayoutDecode("stats_client", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// derived value set by a processing stage on top of the payload
+	o := tsdbOverlayNew(data)
+	o.Set("rssi_rate", "0.5")
+
+	return tsdbRecord {
+		Channel:	channel,
+		Time:		time.Unix(1700000000, 0).UTC(),
+		Data:		o,
+		Raw:		payload,
+		Size:		len(payload),
+	}
+}
+
+func walTestEntries(t *testing.T, dir string) []tsdbWalEntry {
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "*" + tsdbWalExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r []tsdbWalEntry
+	for _, v := range matches {
+		b, err := os.ReadFile(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var e tsdbWalEntry
+		err = json.Unmarshal(b, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, e)
+	}
+
+	return r
+}
+
+func walTestWait(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for replay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWalSpool(t *testing.T) {
+	tests := []struct {
+		name		string
+		down		bool
+		failing		[]string
+		written		int
+		spooled		[]string
+	}{
+		{ "backend up", false, nil, 2, nil },
+		{ "backend down", true, nil, 0, []string{"a", "b"} },
+		{ "one channel down", false, []string{walTestChannelB}, 1, []string{"b"} },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b := &walTestBackend{}
+			b.set(tt.down, tt.failing...)
+
+			w, err := tsdbWalNew(walTestConf(dir), "test", b, &tsdbDeadLetterLog{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// stop replay so spooled segments stay as written
+			w.(*tsdbWal).Close()
+
+			records := []tsdbRecord {
+				walTestRecord(t, walTestChannelA, "a"),
+				walTestRecord(t, walTestChannelB, "b"),
+			}
+			err = w.AddRecords("clients", records)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			written, _ := b.count()
+			if written != tt.written {
+				t.Errorf("backend got %d records, want %d", written, tt.written)
+			}
+
+			var spooled []string
+			for _, e := range walTestEntries(t, dir) {
+				for _, v := range e.Records {
+					spooled = append(spooled, v.Values["rssi_rate"] + ":" + v.Payload)
+				}
+			}
+			if len(spooled) != len(tt.spooled) {
+				t.Fatalf("spooled %v, want macs %v", spooled, tt.spooled)
+			}
+			for n, mac := range tt.spooled {
+				if !strings.HasPrefix(spooled[n], `0.5:{"mac":"` + mac + `"`) {
+					t.Errorf("spooled %s, want payload of %s with overlay values", spooled[n], mac)
+				}
+			}
+		})
+	}
+}
+
+func TestWalEvict(t *testing.T) {
+	dir := t.TempDir()
+	b := &walTestBackend{}
+	b.set(true)
+
+	cfg := walTestConf(dir)
+	cfg.Wal.MaxBytes = 500
+	w, err := tsdbWalNew(cfg, "test", b, &tsdbDeadLetterLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.(*tsdbWal).Close()
+
+	for _, mac := range []string{"a", "b", "c", "d"} {
+		err = w.AddRecords("clients", []tsdbRecord{walTestRecord(t, walTestChannelA, mac)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := walTestEntries(t, dir)
+	if len(entries) < 1 || len(entries) > 3 {
+		t.Fatalf("got %d segments, want oldest evicted", len(entries))
+	}
+
+	last := entries[len(entries) - 1].Records[0].Payload
+	if !strings.Contains(last, `"mac":"d"`) {
+		t.Errorf("newest write was evicted, last segment holds %s", last)
+	}
+	if w.(*tsdbWal).size > cfg.Wal.MaxBytes {
+		t.Errorf("buffer holds %d bytes over cap %d", w.(*tsdbWal).size, cfg.Wal.MaxBytes)
+	}
+}
+
+func TestWalReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	b := &walTestBackend{}
+	b.set(true)
+
+	w, err := tsdbWalNew(walTestConf(dir), "test", b, &tsdbDeadLetterLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	err = w.AddRecords("clients", []tsdbRecord {
+		walTestRecord(t, walTestChannelA, "a"),
+		walTestRecord(t, walTestChannelB, "b"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddRecordRaw(walTestChannelA, time.Now(), `{"raw":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// channel b stays down after restart, replay keeps only its record and holds back later writes
+	b.set(false, walTestChannelB)
+	w, err = tsdbWalNew(walTestConf(dir), "test", b, &tsdbDeadLetterLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walTestWait(t, func() bool {
+		written, _ := b.count()
+		return written == 1
+	})
+	w.Close()
+
+	entries := walTestEntries(t, dir)
+	if len(entries) != 2 || len(entries[0].Records) != 1 || entries[0].Records[0].Channel != walTestChannelB || entries[1].Raw == nil {
+		t.Fatalf("pending segments after partial replay: %+v", entries)
+	}
+
+	// replayed record is decoded again from payload, with overlay values applied
+	b.mu.Lock()
+	rec := b.written[0]
+	b.mu.Unlock()
+
+	for k, want := range map[string]string{"mac": "a", "hostname": "host-a", "rssi": "-61", "rssi_rate": "0.5"} {
+		got, err := rec.Data.GetJsonKeyValueAsStr(k)
+		if err != nil {
+			t.Errorf("%s: %v", k, err)
+		} else if got != want {
+			t.Errorf("%s is %s, want %s", k, got, want)
+		}
+	}
+
+	// remaining record goes out once channel is back
+	b.set(false)
+	w, err = tsdbWalNew(walTestConf(dir), "test", b, &tsdbDeadLetterLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	walTestWait(t, func() bool {
+		written, raw := b.count()
+		return written == 2 && raw == 1
+	})
+}
+
+func TestWalDecodeLegacy(t *testing.T) {
+	f := tsdbWalFormatNew(walTestConf(""))
+
+	rec, err := f.decode(tsdbWalRecord {
+		Channel:	walTestChannelA,
+		Values:		map[string]string{"mac": "a", "rssi": "-61"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := rec.Data.GetJsonKeyValueAsStr("rssi")
+	if err != nil || v != "-61" {
+		t.Errorf("got %s %v, want -61", v, err)
+	}
+
+	_, err = f.decode(tsdbWalRecord { Channel: "/unknown", Payload: "{}" })
+	if err == nil {
+		t.Errorf("expected error for unknown channel")
+	}
+}
+
+func TestWalNone(t *testing.T) {
+	dir := t.TempDir()
+	b := &walTestBackend{}
+	b.set(false, walTestChannelB)
+
+	cfg := walTestConf("")
+	cfg.DeadLetter.Driver = "file"
+	cfg.DeadLetter.Path = filepath.Join(dir, "deadletter.jsonl")
+	dl, err := tsdbDeadLetterNew(cfg.DeadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+
+	w, err := tsdbWalNew(cfg, "test", b, dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	err = w.AddRecords("clients", []tsdbRecord {
+		walTestRecord(t, walTestChannelA, "a"),
+		walTestRecord(t, walTestChannelB, "b"),
+	})
+	if !tsdbRetriable(err) {
+		t.Fatalf("got error %v, want retriable error", err)
+	}
+
+	b.set(true)
+	err = w.AddRecordRaw(walTestChannelA, time.Now(), `{"raw":true}`)
+	if !tsdbRetriable(err) {
+		t.Fatalf("got error %v, want retriable error", err)
+	}
+
+	content, err := os.ReadFile(cfg.DeadLetter.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d dead-letter records, want 2:\n%s", len(lines), content)
+	} else if !strings.Contains(lines[0], `\"mac\":\"b\"`) || !strings.Contains(lines[1], `{\"raw\":true}`) {
+		t.Errorf("unexpected dead-letter records:\n%s", content)
+	}
+}
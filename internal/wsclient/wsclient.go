@@ -224,6 +224,7 @@ func (c *WsClient) processMsg(m *mistdatafmt.WsMsgData) {
 		out := common.MistApiData {
 			Origin: m.Channel,
 			Data: m.Data,
+			RecvTime: time.Now(),
 		}
 
 		for _, ch := range(c.msgChans) {
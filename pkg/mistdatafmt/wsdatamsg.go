@@ -745,7 +745,7 @@ func (m *WsMsgMapBleAsset) GetJsonKeyValueAsFloat64(key string) (float64, error)
 	return 0, fmt.Errorf("Specified key not found")
 }
 
-func (m *WsMsgMapBleAsset) GetJsonKeyValueInt64(key string) (int64, error) {
+func (m *WsMsgMapBleAsset) GetJsonKeyValueAsInt64(key string) (int64, error) {
 	switch key {
 	case "temperature":
 		return m.Temperature.Int64()
@@ -780,6 +780,13 @@ func (m *WsMsgMapBleAsset) GetJsonKeyValueInt64(key string) (int64, error) {
 	return 0, fmt.Errorf("Specified key not found")
 }
 
+// GetJsonKeyValueInt64 is kept for callers of the old name.
+//
+// Deprecated: use GetJsonKeyValueAsInt64 instead.
+func (m *WsMsgMapBleAsset) GetJsonKeyValueInt64(key string) (int64, error) {
+	return m.GetJsonKeyValueAsInt64(key)
+}
+
 type WsMsgBleSvcData struct {
 	UUID			string		`json:"uuid"`
 	Data			string		`json:"data"`
@@ -835,7 +842,7 @@ func (m *WsMsgBleSvcData) GetJsonKeyValueAsFloat64(key string) (float64, error)
 	return 0, fmt.Errorf("Specified key not found")
 }
 
-func (m *WsMsgBleSvcData) GetJsonKeyValueInt64(key string) (int64, error) {
+func (m *WsMsgBleSvcData) GetJsonKeyValueAsInt64(key string) (int64, error) {
 	switch key {
 	case "rx_cnt":
 		return m.RxCnt.Int64()
@@ -848,4 +855,9 @@ func (m *WsMsgBleSvcData) GetJsonKeyValueInt64(key string) (int64, error) {
 	return 0, fmt.Errorf("Specified key not found")
 }
 
-
+// GetJsonKeyValueInt64 is kept for callers of the old name.
+//
+// Deprecated: use GetJsonKeyValueAsInt64 instead.
+func (m *WsMsgBleSvcData) GetJsonKeyValueInt64(key string) (int64, error) {
+	return m.GetJsonKeyValueAsInt64(key)
+}